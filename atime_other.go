@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileAccessTime returns when a file was last served. serveImageFile updates
+// the modification time together with the access time, which is used here
+// because its place in syscall.Stat_t differs between platforms.
+func fileAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// oauth2ClientID identifies this service to OAuth2 token endpoints
+const oauth2ClientID = "docker-image-save"
+
+// authChallenge is one challenge of a WWW-Authenticate header
+type authChallenge struct {
+	// scheme is lower-cased, e.g. "bearer" or "basic"
+	scheme string
+	// params are keyed by lower-cased parameter name
+	params map[string]string
+}
+
+// parseAuthChallenges parses WWW-Authenticate header values as defined in
+// RFC 7235. A header may hold several challenges and quoted parameter values
+// may contain commas and backslash escapes.
+func parseAuthChallenges(headers []string) []authChallenge {
+	var challenges []authChallenge
+	for _, header := range headers {
+		s := header
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			var token string
+			token, s = readAuthToken(s)
+			if token == "" {
+				// Not a valid token character; skip it
+				s = s[1:]
+				continue
+			}
+
+			rest := strings.TrimLeft(s, " \t")
+			if strings.HasPrefix(rest, "=") && len(challenges) > 0 {
+				var value string
+				value, s = readAuthValue(strings.TrimLeft(rest[1:], " \t"))
+				challenges[len(challenges)-1].params[strings.ToLower(token)] = value
+				continue
+			}
+			challenges = append(challenges, authChallenge{scheme: strings.ToLower(token), params: make(map[string]string)})
+		}
+	}
+	return challenges
+}
+
+// readAuthToken reads an RFC 7230 token from the start of s
+func readAuthToken(s string) (string, string) {
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r))
+	})
+	if end == -1 {
+		end = len(s)
+	}
+	return s[:end], s[end:]
+}
+
+// readAuthValue reads a token or quoted-string parameter value from the start of s
+func readAuthValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		return readAuthToken(s)
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	// Unterminated quoted string: take the rest
+	return b.String(), ""
+}
+
+// findAuthChallenge returns the first challenge using scheme
+func findAuthChallenge(challenges []authChallenge, scheme string) (authChallenge, bool) {
+	for _, challenge := range challenges {
+		if challenge.scheme == scheme {
+			return challenge, true
+		}
+	}
+	return authChallenge{}, false
+}
+
+// basicAuthorization returns the Authorization header value for Basic authentication
+func basicAuthorization(creds RegistryCredentials) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Password))
+}
+
+// authenticateBasic handles registries that challenge with Basic instead of
+// issuing tokens: the credentials are checked once and then sent with every request
+func (c *RegistryClient) authenticateBasic(ctx context.Context, registryURL string, creds RegistryCredentials, hasCredentials bool) error {
+	if !hasCredentials || creds.Username == "" {
+		return fmt.Errorf("registry requires Basic authentication but no username and password are configured")
+	}
+	authorization := basicAuthorization(creds)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", registryURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeWithLog(resp.Body, responseBodyStr)
+
+	if resp.StatusCode != http.StatusOK {
+		return &ErrAuthenticationFailed{StatusCode: resp.StatusCode}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.basicAuth = authorization
+	return nil
+}
+
+// fetchOAuth2Token obtains a token with the OAuth2 POST flow of the
+// distribution token spec, using the refresh token when there is one and the
+// password grant otherwise. A refresh token issued in return is kept on source
+// for later renewals.
+func (c *RegistryClient) fetchOAuth2Token(ctx context.Context, source *tokenSource) (bearerToken, error) {
+	form := url.Values{
+		"service":   {source.service},
+		"scope":     {source.scope},
+		"client_id": {oauth2ClientID},
+	}
+	if source.refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", source.refreshToken)
+	} else {
+		form.Set("grant_type", "password")
+		form.Set("username", source.creds.Username)
+		form.Set("password", source.creds.Password)
+		form.Set("access_type", "offline")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", source.realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		return bearerToken{}, err
+	}
+	req.Header.Set(contentTypeHeader, "application/x-www-form-urlencoded")
+
+	requestedAt := time.Now()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	defer closeWithLog(resp.Body, responseBodyStr)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		log.WithField("response_body", string(body)).WithField("status_code", resp.StatusCode).Debug("OAuth2 token request failed")
+		return bearerToken{}, &ErrAuthenticationFailed{StatusCode: resp.StatusCode}
+	}
+
+	var tokenResp struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		IssuedAt     string `json:"issued_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return bearerToken{}, err
+	}
+	if tokenResp.AccessToken == "" {
+		return bearerToken{}, fmt.Errorf("OAuth2 token response has no access_token")
+	}
+	if tokenResp.RefreshToken != "" {
+		source.refreshToken = tokenResp.RefreshToken
+	}
+	return bearerToken{
+		value:     tokenResp.AccessToken,
+		expiresAt: tokenExpiry(requestedAt, tokenResp.IssuedAt, tokenResp.ExpiresIn),
+	}, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestParseAuthChallenges(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    []authChallenge
+	}{
+		{
+			name:    "bearer",
+			headers: []string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`},
+			want: []authChallenge{{scheme: "bearer", params: map[string]string{
+				"realm": "https://auth.docker.io/token", "service": "registry.docker.io",
+			}}},
+		},
+		{
+			name:    "quoted comma in scope",
+			headers: []string{`Bearer realm="https://auth.example.com/token",scope="repository:a/b:pull,push",service="reg"`},
+			want: []authChallenge{{scheme: "bearer", params: map[string]string{
+				"realm": "https://auth.example.com/token", "scope": "repository:a/b:pull,push", "service": "reg",
+			}}},
+		},
+		{
+			name:    "multiple challenges in one header",
+			headers: []string{`Basic realm="Artifactory Realm", Bearer realm="https://auth.example.com/token", service=reg`},
+			want: []authChallenge{
+				{scheme: "basic", params: map[string]string{"realm": "Artifactory Realm"}},
+				{scheme: "bearer", params: map[string]string{"realm": "https://auth.example.com/token", "service": "reg"}},
+			},
+		},
+		{
+			name:    "multiple headers",
+			headers: []string{`Basic realm="nexus"`, `BEARER Realm="https://auth.example.com/token"`},
+			want: []authChallenge{
+				{scheme: "basic", params: map[string]string{"realm": "nexus"}},
+				{scheme: "bearer", params: map[string]string{"realm": "https://auth.example.com/token"}},
+			},
+		},
+		{
+			name:    "escaped quote",
+			headers: []string{`Basic realm="say \"hi\", please"`},
+			want:    []authChallenge{{scheme: "basic", params: map[string]string{"realm": `say "hi", please`}}},
+		},
+		{
+			name:    "scheme without parameters",
+			headers: []string{`Negotiate`},
+			want:    []authChallenge{{scheme: "negotiate", params: map[string]string{}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseAuthChallenges(tt.headers)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAuthChallenges() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeOAuth2Registry challenges with Bearer and serves the OAuth2 POST token flow
+type fakeOAuth2Registry struct {
+	mu     sync.Mutex
+	grants []string // grant_type of every token request
+	tokens int
+}
+
+func (f *fakeOAuth2Registry) roundTrip(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Host == "auth.example.com":
+		if r.Method != http.MethodPost {
+			return newTestResponse(http.StatusMethodNotAllowed, nil), nil
+		}
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		grant := r.PostForm.Get("grant_type")
+		f.grants = append(f.grants, grant)
+		valid := grant == "password" && r.PostForm.Get("username") == "robot" && r.PostForm.Get("password") == "secret" ||
+			grant == "refresh_token" && r.PostForm.Get("refresh_token") == "refresh-1"
+		if !valid || r.PostForm.Get("scope") != "repository:team/app:pull" {
+			return newTestResponse(http.StatusUnauthorized, nil), nil
+		}
+		f.tokens++
+		body := fmt.Sprintf(`{"access_token":"access-%d","refresh_token":"refresh-1","expires_in":1}`, f.tokens)
+		return newTestResponse(http.StatusOK, []byte(body)), nil
+	case r.URL.Path == "/v2/":
+		resp := newTestResponse(http.StatusUnauthorized, nil)
+		resp.Header.Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com"`)
+		return resp, nil
+	default:
+		return newTestResponse(http.StatusOK, []byte("{}")), nil
+	}
+}
+
+func TestRegistryClient_OAuth2Flow(t *testing.T) {
+	tests := []struct {
+		name       string
+		creds      RegistryCredentials
+		oauth2     bool
+		wantGrants []string
+	}{
+		{
+			name:       "password grant then refresh token",
+			creds:      RegistryCredentials{Username: "robot", Password: "secret"},
+			oauth2:     true,
+			wantGrants: []string{"password", "refresh_token"},
+		},
+		{
+			name:       "identity token",
+			creds:      RegistryCredentials{IdentityToken: "refresh-1"},
+			wantGrants: []string{"refresh_token", "refresh_token"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFastRetries(t, "registry.example.com", 1)
+			SetRegistrySettings("registry.example.com", RegistrySettings{Retry: DefaultRetryConfig(), OAuth2: tt.oauth2})
+
+			store := NewCredentialStore()
+			store.Set("registry.example.com", StaticCredentials(tt.creds), false)
+			registry := &fakeOAuth2Registry{}
+			client := NewRegistryClient()
+			client.credentials = store
+			client.httpClient.Transport = roundTripFunc(registry.roundTrip)
+
+			if err := client.Authenticate(ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}); err != nil {
+				t.Fatalf("Authenticate failed: %v", err)
+			}
+			// The token expires within the refresh margin, so it is renewed before use
+			token, err := client.currentToken(context.Background())
+			if err != nil {
+				t.Fatalf("currentToken failed: %v", err)
+			}
+			if token != "access-2" {
+				t.Errorf("expected renewed token access-2, got %q", token)
+			}
+			if !reflect.DeepEqual(registry.grants, tt.wantGrants) {
+				t.Errorf("expected grants %v, got %v", tt.wantGrants, registry.grants)
+			}
+		})
+	}
+}
+
+func TestRegistryClient_BasicChallenge(t *testing.T) {
+	creds := RegistryCredentials{Username: "admin", Password: "secret"}
+	var manifestAuth string
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("Authorization") != basicAuthorization(creds) {
+			resp := newTestResponse(http.StatusUnauthorized, nil)
+			resp.Header.Set("WWW-Authenticate", `Basic realm="Sonatype Nexus Repository Manager"`)
+			return resp, nil
+		}
+		if r.URL.Path != "/v2/" {
+			manifestAuth = r.Header.Get("Authorization")
+		}
+		return newTestResponse(http.StatusOK, []byte("{}")), nil
+	})
+	ref := ImageReference{Registry: "nexus.example.com", Repository: "team/app", Tag: "latest"}
+
+	store := NewCredentialStore()
+	store.Set("nexus.example.com", StaticCredentials(creds), false)
+	client := NewRegistryClient()
+	client.credentials = store
+	client.httpClient.Transport = transport
+
+	if err := client.Authenticate(ref); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	resp, err := client.fetchManifestResponse(ref, ref.Reference())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	closeWithLog(resp.Body, "test response")
+	if resp.StatusCode != http.StatusOK || manifestAuth != basicAuthorization(creds) {
+		t.Errorf("expected manifest request with Basic credentials, got status %d and %q", resp.StatusCode, manifestAuth)
+	}
+
+	wrong := NewCredentialStore()
+	wrong.Set("nexus.example.com", StaticCredentials{Username: "admin", Password: "wrong"}, false)
+	client = NewRegistryClient()
+	client.credentials = wrong
+	client.httpClient.Transport = transport
+	if _, ok := errors.AsType[*ErrAuthenticationFailed](client.Authenticate(ref)); !ok {
+		t.Error("expected rejected Basic credentials to fail authentication")
+	}
+
+	client = NewRegistryClient()
+	client.credentials = NewCredentialStore()
+	client.httpClient.Transport = transport
+	if err := client.Authenticate(ref); err == nil {
+		t.Error("expected Basic challenge without credentials to fail")
+	}
+}
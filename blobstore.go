@@ -0,0 +1,320 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// blobsDirName holds compressed blobs and image configs, as served by the registry
+	blobsDirName = "blobs"
+	// layersDirName holds decompressed layers, keyed by diff ID
+	layersDirName = "layers"
+	// partialSuffix marks a blob that is still being downloaded
+	partialSuffix = ".partial"
+)
+
+// BlobStore keeps verified blobs and decompressed layers in the cache
+// directory, keyed by digest, so that images sharing layers only download
+// them once. A stored blob is evicted once no cached archive references it
+// and no build in progress is using it.
+type BlobStore struct {
+	dir string
+
+	mu sync.Mutex
+	// locks serialize the writers of each stored file
+	locks map[string]*blobLock
+	// active counts the builds in progress using each stored file
+	active map[string]int
+}
+
+// blobLock is a mutex for one stored file, dropped once nobody waits on it
+type blobLock struct {
+	mu      sync.Mutex
+	waiters int
+}
+
+// blobStores holds one store per cache directory so that builds and eviction
+// in the same process see each other
+var blobStores = struct {
+	mu     sync.Mutex
+	stores map[string]*BlobStore
+}{stores: make(map[string]*BlobStore)}
+
+// openBlobStore returns the blob store of a cache directory
+func openBlobStore(cacheDir string) *BlobStore {
+	dir := filepath.Clean(cacheDir)
+	blobStores.mu.Lock()
+	defer blobStores.mu.Unlock()
+	if store, ok := blobStores.stores[dir]; ok {
+		return store
+	}
+	store := &BlobStore{dir: dir, locks: make(map[string]*blobLock), active: make(map[string]int)}
+	blobStores.stores[dir] = store
+	return store
+}
+
+// blobPath returns where the blob with the given digest is stored
+func (s *BlobStore) blobPath(digest string) (string, error) {
+	return s.digestPath(blobsDirName, digest)
+}
+
+// layerPath returns where the decompressed layer with the given diff ID is stored
+func (s *BlobStore) layerPath(diffID string) (string, error) {
+	return s.digestPath(layersDirName, diffID)
+}
+
+func (s *BlobStore) digestPath(kind, digest string) (string, error) {
+	if err := validateDigest(digest); err != nil {
+		return "", err
+	}
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join(s.dir, kind, algorithm, hex), nil
+}
+
+// lock acquires the writer lock of a stored file and returns its unlock function
+func (s *BlobStore) lock(path string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[path]
+	if !ok {
+		l = &blobLock{}
+		s.locks[path] = l
+	}
+	l.waiters++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if l.waiters--; l.waiters == 0 {
+			delete(s.locks, path)
+		}
+	}
+}
+
+// lease starts a build's use of the store
+func (s *BlobStore) lease() *blobLease {
+	return &blobLease{store: s, blobs: make(map[string]bool), layers: make(map[string]bool)}
+}
+
+// evict removes the stored files that are not in referenced, the set of
+// paths used by cached archives, and are not used by a build in progress
+func (s *BlobStore) evict(referenced map[string]bool) {
+	for _, kind := range []string{blobsDirName, layersDirName} {
+		root := filepath.Join(s.dir, kind)
+		err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			s.evictFile(path, referenced)
+			return nil
+		})
+		if err != nil {
+			log.WithField("dir", root).WithError(err).Warn("Failed to scan blob store")
+		}
+	}
+}
+
+// evictFile removes a stored file, or a partial download of one, unless it is in use
+func (s *BlobStore) evictFile(path string, referenced map[string]bool) {
+	stored := strings.TrimSuffix(path, partialSuffix)
+	if referenced[stored] {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[stored] > 0 {
+		return
+	}
+	log.WithField("file", path).Info("Removing unreferenced blob")
+	removeWithLog(path)
+}
+
+// blobLease records the blobs and layers a build uses and keeps them from
+// being evicted until it is released. A nil lease stores nothing.
+type blobLease struct {
+	store *BlobStore
+
+	mu sync.Mutex
+	// blobs and layers hold the digests and diff IDs used, paths their stored files
+	blobs  map[string]bool
+	layers map[string]bool
+	paths  []string
+}
+
+// use marks a stored file as used by the build
+func (l *blobLease) use(used map[string]bool, digest, path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if used[digest] {
+		return
+	}
+	used[digest] = true
+	l.paths = append(l.paths, path)
+
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	l.store.active[path]++
+}
+
+// release ends the build's use of the store
+func (l *blobLease) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	for _, path := range l.paths {
+		if l.store.active[path]--; l.store.active[path] <= 0 {
+			delete(l.store.active, path)
+		}
+	}
+	l.paths = nil
+}
+
+// references returns the sorted digests of the blobs and diff IDs of the layers the build used
+func (l *blobLease) references() (blobs, layers []string) {
+	if l == nil {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Sorted(maps.Keys(l.blobs)), slices.Sorted(maps.Keys(l.layers))
+}
+
+// fetchBlob places the blob with the given digest at destPath, taking it from
+// the store if it is there and otherwise storing it with download first
+func (l *blobLease) fetchBlob(digest, destPath string, download func(path string) error) error {
+	path, err := l.store.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	l.use(l.blobs, digest, path)
+
+	unlock := l.store.lock(path)
+	defer unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		err := verifyFileDigest(path, digest)
+		if err == nil {
+			blobStoreHitsMetric.Inc()
+			log.WithField("digest", digest).Debug("Using stored blob")
+			return linkOrCopy(path, destPath)
+		}
+		// A stored blob that no longer matches its digest is downloaded
+		// again rather than passed on to every later build
+		verificationFailuresMetric.Inc()
+		log.WithField("digest", digest).WithError(err).Warn("Discarding corrupt stored blob")
+		removeWithLog(path)
+	}
+
+	blobStoreMissesMetric.Inc()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// A failed download removes the partial file; only one left behind by a
+	// process that stopped mid-download is resumed
+	partial := path + partialSuffix
+	if err := download(partial); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return err
+	}
+	return linkOrCopy(path, destPath)
+}
+
+// keepBlob records that the build uses the stored blob with the given digest
+// without reading it, as when its decompressed layer comes from the store, so
+// that the archive keeps referencing it
+func (l *blobLease) keepBlob(digest string) {
+	if l == nil {
+		return
+	}
+	path, err := l.store.blobPath(digest)
+	if err != nil {
+		return
+	}
+	l.use(l.blobs, digest, path)
+}
+
+// fetchLayer places the stored decompressed layer with the given diff ID at
+// destPath, returning false if the store does not have it. A stored layer
+// that no longer matches its diff ID is discarded so that it is downloaded
+// and stored again.
+func (l *blobLease) fetchLayer(diffID, destPath string) bool {
+	if l == nil {
+		return false
+	}
+	path, err := l.store.layerPath(diffID)
+	if err != nil {
+		return false
+	}
+	l.use(l.layers, diffID, path)
+
+	unlock := l.store.lock(path)
+	defer unlock()
+
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	if err := verifyFileDigest(path, diffID); err != nil {
+		verificationFailuresMetric.Inc()
+		log.WithField("diff_id", diffID).WithError(err).Warn("Discarding corrupt stored layer")
+		removeWithLog(path)
+		return false
+	}
+	if err := linkOrCopy(path, destPath); err != nil {
+		log.WithField("diff_id", diffID).WithError(err).Warn("Failed to use stored layer")
+		return false
+	}
+	blobStoreHitsMetric.Inc()
+	log.WithField("diff_id", diffID).Debug("Using stored layer")
+	return true
+}
+
+// storeLayer adds a verified decompressed layer to the store
+func (l *blobLease) storeLayer(diffID, srcPath string) {
+	if l == nil {
+		return
+	}
+	path, err := l.store.layerPath(diffID)
+	if err != nil {
+		return
+	}
+	l.use(l.layers, diffID, path)
+
+	unlock := l.store.lock(path)
+	defer unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		partial := path + partialSuffix
+		if err = linkOrCopy(srcPath, partial); err == nil {
+			err = os.Rename(partial, path)
+		}
+	}
+	if err != nil {
+		// The build still has its copy; the layer is just not shared
+		log.WithField("diff_id", diffID).WithError(err).Warn("Failed to store layer")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobLease_FetchBlobReusesStoredBlob(t *testing.T) {
+	cacheDir, err := os.MkdirTemp("", "test-blobstore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+
+	content := []byte("blob content")
+	digest := sha256Digest(content)
+	downloads := 0
+	download := func(path string) error {
+		downloads++
+		return os.WriteFile(path, content, 0644)
+	}
+
+	store := openBlobStore(cacheDir)
+	for i, lease := range []*blobLease{store.lease(), store.lease()} {
+		destPath := filepath.Join(cacheDir, fmt.Sprintf("dest-%d", i))
+		if err := lease.fetchBlob(digest, destPath, download); err != nil {
+			t.Fatalf("fetchBlob() error: %v", err)
+		}
+		data, err := os.ReadFile(destPath)
+		if err != nil || string(data) != string(content) {
+			t.Fatalf("expected %q at destination, got %q (%v)", content, data, err)
+		}
+		if blobs, _ := lease.references(); len(blobs) != 1 || blobs[0] != digest {
+			t.Errorf("expected the lease to reference %s, got %v", digest, blobs)
+		}
+		lease.release()
+	}
+
+	if downloads != 1 {
+		t.Errorf("expected the blob to be downloaded once, got %d", downloads)
+	}
+}
+
+func TestBlobLease_FetchBlobFailureStoresNothing(t *testing.T) {
+	cacheDir, err := os.MkdirTemp("", "test-blobstore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+
+	store := openBlobStore(cacheDir)
+	lease := store.lease()
+	defer lease.release()
+
+	digest := sha256Digest([]byte("never downloaded"))
+	err = lease.fetchBlob(digest, filepath.Join(cacheDir, "dest"), func(string) error {
+		return os.ErrDeadlineExceeded
+	})
+	if err == nil {
+		t.Fatal("expected the download error")
+	}
+	path, _ := store.blobPath(digest)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("a failed download must not be stored")
+	}
+}
+
+func TestBlobLease_StoreAndFetchLayer(t *testing.T) {
+	cacheDir, err := os.MkdirTemp("", "test-blobstore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+
+	content := []byte("layer tar")
+	diffID := sha256Digest(content)
+	srcPath := filepath.Join(cacheDir, "layer.tar")
+	if err := os.WriteFile(srcPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := openBlobStore(cacheDir)
+	first := store.lease()
+	if first.fetchLayer(diffID, filepath.Join(cacheDir, "missing.tar")) {
+		t.Fatal("expected no stored layer yet")
+	}
+	first.storeLayer(diffID, srcPath)
+	first.release()
+
+	second := store.lease()
+	defer second.release()
+	destPath := filepath.Join(cacheDir, "reused.tar")
+	if !second.fetchLayer(diffID, destPath) {
+		t.Fatal("expected the stored layer to be reused")
+	}
+	if data, err := os.ReadFile(destPath); err != nil || string(data) != string(content) {
+		t.Errorf("expected %q, got %q (%v)", content, data, err)
+	}
+	if _, layers := second.references(); len(layers) != 1 || layers[0] != diffID {
+		t.Errorf("expected the lease to reference %s, got %v", diffID, layers)
+	}
+
+	var nilLease *blobLease
+	if nilLease.fetchLayer(diffID, filepath.Join(cacheDir, "nil.tar")) {
+		t.Error("a nil lease must not reuse layers")
+	}
+}
+
+func TestBlobLease_FetchLayerDiscardsCorruptStoredLayer(t *testing.T) {
+	cacheDir, err := os.MkdirTemp("", "test-blobstore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+
+	diffID := sha256Digest([]byte("layer tar"))
+	store := openBlobStore(cacheDir)
+	path, _ := store.layerPath(diffID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("layer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lease := store.lease()
+	defer lease.release()
+	if lease.fetchLayer(diffID, filepath.Join(cacheDir, "reused.tar")) {
+		t.Fatal("expected a truncated stored layer not to be reused")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the corrupt stored layer to be removed, stat error %v", err)
+	}
+}
+
+func TestBlobStore_Evict(t *testing.T) {
+	cacheDir, err := os.MkdirTemp("", "test-blobstore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+
+	store := openBlobStore(cacheDir)
+	stored := make(map[string]string)
+	for _, name := range []string{"referenced", "unreferenced", "in-use"} {
+		lease := store.lease()
+		digest := sha256Digest([]byte(name))
+		err := lease.fetchBlob(digest, filepath.Join(cacheDir, name), func(path string) error {
+			return os.WriteFile(path, []byte(name), 0644)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "in-use" {
+			lease.release()
+		} else {
+			defer lease.release()
+		}
+		stored[name], _ = store.blobPath(digest)
+	}
+	// An interrupted download with no build using it
+	orphan, _ := store.blobPath(sha256Digest([]byte("interrupted")))
+	if err := os.WriteFile(orphan+partialSuffix, []byte("inter"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store.evict(map[string]bool{stored["referenced"]: true})
+
+	for name, survives := range map[string]bool{"referenced": true, "unreferenced": false, "in-use": true} {
+		_, err := os.Stat(stored[name])
+		if survives && err != nil {
+			t.Errorf("%s blob was incorrectly removed", name)
+		}
+		if !survives && !os.IsNotExist(err) {
+			t.Errorf("%s blob was not removed", name)
+		}
+	}
+	if _, err := os.Stat(orphan + partialSuffix); !os.IsNotExist(err) {
+		t.Error("orphaned partial download was not removed")
+	}
+}
+
+func TestBlobLease_FetchBlobReplacesCorruptStoredBlob(t *testing.T) {
+	cacheDir, err := os.MkdirTemp("", "test-blobstore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+
+	content := []byte("blob content")
+	digest := sha256Digest(content)
+	store := openBlobStore(cacheDir)
+	path, _ := store.blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lease := store.lease()
+	defer lease.release()
+	downloads := 0
+	destPath := filepath.Join(cacheDir, "dest")
+	err = lease.fetchBlob(digest, destPath, func(path string) error {
+		downloads++
+		return os.WriteFile(path, content, 0644)
+	})
+	if err != nil {
+		t.Fatalf("fetchBlob() error: %v", err)
+	}
+	if downloads != 1 {
+		t.Errorf("expected the corrupt blob to be downloaded again, got %d downloads", downloads)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != string(content) {
+		t.Errorf("expected the stored blob to be replaced, got %q (%v)", data, err)
+	}
+}
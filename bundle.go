@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxBundleImages bounds how many images a single bundle may contain
+const maxBundleImages = 20
+
+// bundleImage is an image of a bundle whose manifest has been resolved
+type bundleImage struct {
+	ref      ImageReference
+	client   *RegistryClient
+	manifest *ManifestV2
+}
+
+// normalizeBundle removes duplicate references and sorts them so the same set
+// of images always maps to the same cache entry
+func normalizeBundle(imageNames []string) ([]string, error) {
+	seen := make(map[string]bool, len(imageNames))
+	var names []string
+	for _, name := range imageNames {
+		key := canonicalImageName(ParseImageReference(name))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no images requested")
+	}
+	if len(names) > maxBundleImages {
+		return nil, fmt.Errorf("too many images in bundle (maximum %d)", maxBundleImages)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return canonicalImageName(ParseImageReference(names[i])) < canonicalImageName(ParseImageReference(names[j]))
+	})
+	return names, nil
+}
+
+// bundleFilename names a bundle archive after a hash of its image references,
+// e.g. bundle_3f2a9c1b7d4e8f60_linux_amd64.tar.gz
+func bundleFilename(imageNames []string, platform Platform) string {
+	hash := sha256.New()
+	for _, name := range imageNames {
+		hash.Write([]byte(canonicalImageName(ParseImageReference(name)) + "\n"))
+	}
+	parts := []string{"bundle", hex.EncodeToString(hash.Sum(nil))[:16], platform.OS, platform.Architecture}
+	if platform.Variant != "" {
+		parts = append(parts, platform.Variant)
+	}
+	for i, part := range parts {
+		parts[i] = sanitizeFilenameComponent(part)
+	}
+	return strings.Join(parts, "_") + FormatDocker.extension()
+}
+
+// DownloadBundle downloads several images and saves them as one docker-save
+// tar file, like "docker save a b c". Layers shared between the images are
+// downloaded and stored once. imageNames must already be normalized.
+func DownloadBundle(imageNames []string, outputDir string, platform Platform, credentials *CredentialStore) (string, error) {
+	// Resolve every manifest first so a missing image fails before any layer is downloaded
+	images := make([]bundleImage, 0, len(imageNames))
+	manifests := make(map[string]string, len(imageNames))
+	blobs := openBlobStore(outputDir).lease()
+	defer blobs.release()
+	for _, name := range imageNames {
+		ref, client, err := prepareDownload(name, credentials)
+		if err != nil {
+			return "", err
+		}
+		client.blobs = blobs
+		manifest, digest, err := fetchManifest(client, ref, platform)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", ref, err)
+		}
+		images = append(images, bundleImage{ref: ref, client: client, manifest: manifest})
+		manifests[name] = digest
+	}
+
+	imageManifests := make([]*ManifestV2, len(images))
+	for i, image := range images {
+		imageManifests[i] = image.manifest
+	}
+	if err := checkBuildSpace(outputDir, imageSize(imageManifests...)); err != nil {
+		return "", err
+	}
+
+	return buildArchive(outputDir, bundleFilename(imageNames, platform), FormatDocker, manifests, blobs, func(tempDir string) error {
+		return assembleDockerBundle(images, tempDir)
+	})
+}
+
+// assembleDockerBundle downloads every image of a bundle into the docker-save
+// layout in tempDir with one manifest.json entry per image
+func assembleDockerBundle(images []bundleImage, tempDir string) error {
+	manifestJSON := make([]map[string]interface{}, 0, len(images))
+	repositories := map[string]map[string]string{}
+
+	for _, image := range images {
+		log.WithField("image", image.ref.String()).Info("Adding image to bundle")
+		imageConfig, configDigest, err := downloadImageConfig(image.client, image.ref, image.manifest, tempDir)
+		if err != nil {
+			return err
+		}
+
+		layerPaths, err := downloadAllLayers(image.client, image.ref, image.manifest, imageConfig, tempDir)
+		if err != nil {
+			return err
+		}
+
+		manifestJSON = append(manifestJSON, dockerManifestEntry(image.ref, configDigest, layerPaths))
+		addRepositoryTag(repositories, image.ref, layerPaths)
+	}
+
+	if err := marshalJSONToFile(manifestJSON, tempDir, "manifest.json"); err != nil {
+		return err
+	}
+	return marshalJSONToFile(repositories, tempDir, "repositories")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeBundle(t *testing.T) {
+	tests := []struct {
+		name     string
+		images   []string
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name:     "sorted by canonical name",
+			images:   []string{"redis:7", "postgres:16", "ghcr.io/team/app:1.0"},
+			expected: []string{"postgres:16", "redis:7", "ghcr.io/team/app:1.0"},
+		},
+		{
+			name:     "duplicates removed",
+			images:   []string{"alpine:latest", "library/alpine:latest", "alpine"},
+			expected: []string{"alpine:latest"},
+		},
+		{
+			name:    "empty",
+			images:  nil,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeBundle(tt.images)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeBundle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("normalizeBundle() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizeBundle_TooMany(t *testing.T) {
+	var images []string
+	for i := 0; i <= maxBundleImages; i++ {
+		images = append(images, fmt.Sprintf("app:%d", i))
+	}
+	if _, err := normalizeBundle(images); err == nil {
+		t.Fatal("expected error for too many images")
+	}
+}
+
+func TestBundleFilename(t *testing.T) {
+	amd64 := Platform{OS: "linux", Architecture: "amd64"}
+	first := bundleFilename([]string{"postgres:16", "redis:7"}, amd64)
+	if !strings.HasPrefix(first, "bundle_") || !strings.HasSuffix(first, "_linux_amd64.tar.gz") {
+		t.Errorf("unexpected bundle filename %q", first)
+	}
+	if got := bundleFilename([]string{"postgres:16", "redis:7"}, amd64); got != first {
+		t.Errorf("expected stable filename, got %q and %q", first, got)
+	}
+	if got := bundleFilename([]string{"postgres:16", "redis:6"}, amd64); got == first {
+		t.Error("expected different images to produce a different filename")
+	}
+	if got := bundleFilename([]string{"postgres:16", "redis:7"}, Platform{OS: "linux", Architecture: "arm64"}); got == first {
+		t.Error("expected a different platform to produce a different filename")
+	}
+}
+
+func TestAssembleDockerBundle(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-bundle-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	platform := DefaultPlatform()
+	registry := newFakeRegistry()
+	registry.addTag("db", registry.addImage(t, platform, "shared-base", "db-layer"))
+	registry.addTag("app", registry.addImage(t, platform, "shared-base", "app-layer"))
+	_, sharedDigest, sharedDiffID := gzipLayer(t, "shared-base")
+
+	var images []bundleImage
+	for _, tag := range []string{"db", "app"} {
+		ref := ImageReference{Registry: "registry.example.com", Repository: "team/" + tag, Tag: tag}
+		client := registry.client()
+		manifest, _, err := client.getManifest(ref, platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, bundleImage{ref: ref, client: client, manifest: manifest})
+	}
+
+	if err := assembleDockerBundle(images, tempDir); err != nil {
+		t.Fatalf("assembleDockerBundle failed: %v", err)
+	}
+
+	if got := registry.requestCount(sharedDigest); got != 1 {
+		t.Errorf("expected shared layer to be downloaded once, got %d", got)
+	}
+
+	var manifestJSON []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	data, err := os.ReadFile(filepath.Join(tempDir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &manifestJSON); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifestJSON) != 2 {
+		t.Fatalf("expected 2 manifest entries, got %d", len(manifestJSON))
+	}
+	sharedLayer := strings.TrimPrefix(sharedDiffID, sha256Prefix) + "/layer.tar"
+	for i, want := range []string{"registry.example.com/team/db:db", "registry.example.com/team/app:app"} {
+		entry := manifestJSON[i]
+		if len(entry.RepoTags) != 1 || entry.RepoTags[0] != want {
+			t.Errorf("entry %d: expected RepoTags [%s], got %v", i, want, entry.RepoTags)
+		}
+		if len(entry.Layers) != 2 || entry.Layers[0] != sharedLayer {
+			t.Errorf("entry %d: expected shared base layer first, got %v", i, entry.Layers)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, entry.Config)); err != nil {
+			t.Errorf("entry %d: missing config: %v", i, err)
+		}
+	}
+
+	var repositories map[string]map[string]string
+	data, err = os.ReadFile(filepath.Join(tempDir, "repositories"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &repositories); err != nil {
+		t.Fatal(err)
+	}
+	if repositories["db"]["db"] == "" || repositories["app"]["app"] == "" {
+		t.Errorf("expected both images in repositories, got %v", repositories)
+	}
+}
+
+func TestDownloadBundle_SameImageUnderTwoTags(t *testing.T) {
+	registry := newFakeRegistry()
+	image := registry.addImage(t, DefaultPlatform(), "base", "app")
+	registry.addTag("one", image)
+	registry.addTag("alias", image)
+	registry.install(t, "registry.example.com")
+
+	cacheDir, err := os.MkdirTemp("", "test-bundle-alias-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+
+	names := []string{"registry.example.com/team/app:one", "registry.example.com/team/app:alias"}
+	if _, err := DownloadBundle(names, cacheDir, DefaultPlatform(), nil); err != nil {
+		t.Fatalf("DownloadBundle() error: %v", err)
+	}
+
+	// The stored config must survive the bundle for later builds to use it
+	if _, err := DownloadImage(names[0], cacheDir, DefaultPlatform(), FormatDocker, nil); err != nil {
+		t.Fatalf("DownloadImage() after bundle error: %v", err)
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,18 +17,147 @@ import (
 
 const (
 	cleanupInterval = 1 * time.Hour
+	// defaultRevalidateInterval is how long a cached archive of a tag is
+	// served before the tag is checked against the registry again
+	defaultRevalidateInterval = 5 * time.Minute
+	// revalidateTimeout bounds each registry request made to revalidate a tag
+	revalidateTimeout = 10 * time.Second
+	// revalidateRetryDelay is how long a tag that could not be revalidated is
+	// served from cache before the registry is asked again
+	revalidateRetryDelay = 1 * time.Minute
+	// metadataSuffix names the file stored next to each cached archive
+	metadataSuffix = ".json"
+	// temporaryCacheDirPrefix names the cache directory created when none is configured
+	temporaryCacheDirPrefix = "docker-image-cache-"
+	// maxPlatformLabelLength is the longest platform selection spelled out in
+	// a multi-platform archive's filename, keeping it under the 255 byte limit
+	maxPlatformLabelLength = 64
 )
 
+// archiveMetadata records what a cached archive was built from
+type archiveMetadata struct {
+	// Manifests maps each image in the archive to the digest of the manifest
+	// (or index) its reference resolved to when the archive was built
+	Manifests map[string]string `json:"manifests"`
+	// CreatedAt is when the archive was built
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	// ValidatedAt is when the digests were last confirmed against the
+	// registry, moved forward when a check fails to delay the next one
+	ValidatedAt time.Time `json:"validated_at"`
+	// Blobs and Layers are the digests of the blobs and the diff IDs of the
+	// decompressed layers in the blob store that the archive was built from
+	Blobs  []string `json:"blobs,omitempty"`
+	Layers []string `json:"layers,omitempty"`
+}
+
+// revalidateInterval holds how often cached archives of mutable tags are checked
+var revalidateInterval = struct {
+	mu       sync.RWMutex
+	interval time.Duration
+}{interval: defaultRevalidateInterval}
+
+// SetRevalidateInterval sets how long a cached archive is served before its
+// tags are checked against the registry again
+func SetRevalidateInterval(interval time.Duration) {
+	revalidateInterval.mu.Lock()
+	defer revalidateInterval.mu.Unlock()
+	revalidateInterval.interval = interval
+}
+
+// currentRevalidateInterval returns the configured revalidation interval
+func currentRevalidateInterval() time.Duration {
+	revalidateInterval.mu.RLock()
+	defer revalidateInterval.mu.RUnlock()
+	return revalidateInterval.interval
+}
+
+// metadataPath returns the path of the metadata file of a cached archive
+func metadataPath(archivePath string) string {
+	return archivePath + metadataSuffix
+}
+
+// readArchiveMetadata reads the metadata stored next to a cached archive
+func readArchiveMetadata(archivePath string) (archiveMetadata, error) {
+	data, err := os.ReadFile(metadataPath(archivePath))
+	if err != nil {
+		return archiveMetadata{}, err
+	}
+	var metadata archiveMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return archiveMetadata{}, fmt.Errorf("invalid archive metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// writeArchiveMetadata stores metadata next to a cached archive
+func writeArchiveMetadata(archivePath string, metadata archiveMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(metadataPath(archivePath), data, 0644)
+}
+
+// needsRevalidation reports whether any mutable tag in the archive is due to
+// be checked against the registry. Digest-pinned images never change.
+func (m archiveMetadata) needsRevalidation(now time.Time) bool {
+	for image := range m.Manifests {
+		ref := ParseImageReference(image)
+		if ref.Digest == "" && now.Sub(m.ValidatedAt) >= cacheRevalidateInterval(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// deferRevalidation moves ValidatedAt so that the archive is next due for
+// revalidation after revalidateRetryDelay, or its shortest interval if that
+// is sooner
+func (m archiveMetadata) deferRevalidation(now time.Time) archiveMetadata {
+	var shortest time.Duration
+	for image := range m.Manifests {
+		ref := ParseImageReference(image)
+		if ref.Digest != "" {
+			continue
+		}
+		if interval := cacheRevalidateInterval(ref); shortest == 0 || interval < shortest {
+			shortest = interval
+		}
+	}
+	m.ValidatedAt = now.Add(-max(shortest-revalidateRetryDelay, 0))
+	return m
+}
+
+// maxAge returns how long the archive is kept after it was last served: the
+// shortest lifetime of the images it holds
+func (m archiveMetadata) maxAge(fallback time.Duration) time.Duration {
+	var shortest time.Duration
+	for image := range m.Manifests {
+		age := cacheMaxAge(ParseImageReference(image), fallback)
+		if shortest == 0 || age < shortest {
+			shortest = age
+		}
+	}
+	if shortest == 0 {
+		return fallback
+	}
+	return shortest
+}
+
 // CacheManager handles the storage and cleanup of cached Docker images
 type CacheManager struct {
 	dir         string
 	maxCacheAge time.Duration
+	blobs       *BlobStore
+	index       *cacheIndex
+	// mu serializes cleanup and size-based eviction
+	mu sync.Mutex
 }
 
 // NewCacheManager creates a new CacheManager instance
 func NewCacheManager(dir string, maxCacheAge time.Duration) (*CacheManager, error) {
 	if dir == "" {
-		tmpDir, err := os.MkdirTemp("", "docker-image-cache-*")
+		tmpDir, err := os.MkdirTemp("", temporaryCacheDirPrefix+"*")
 		if err != nil {
 			return nil, fmt.Errorf("failed to create temporary cache directory: %w", err)
 		}
@@ -33,7 +166,43 @@ func NewCacheManager(dir string, maxCacheAge time.Duration) (*CacheManager, erro
 		return nil, fmt.Errorf("failed to create cache directory: %w", err)
 	}
 
-	return &CacheManager{dir: dir, maxCacheAge: maxCacheAge}, nil
+	return &CacheManager{dir: dir, maxCacheAge: maxCacheAge, blobs: openBlobStore(dir), index: openCacheIndex(dir)}, nil
+}
+
+// RecordBuild adds a newly built archive to the cache index
+func (c *CacheManager) RecordBuild(path string) {
+	c.index.recordBuild(path)
+}
+
+// RecordHit counts a request served from a cached archive in the cache index
+func (c *CacheManager) RecordHit(path string) {
+	c.index.recordHit(path)
+}
+
+// RecordRemoval drops an archive removed outside of cleanup from the cache index
+func (c *CacheManager) RecordRemoval(path string) {
+	c.index.remove(path)
+}
+
+// RecordValidation records in the cache index that the digests of a cached
+// archive were confirmed against the registry
+func (c *CacheManager) RecordValidation(path string, validatedAt time.Time) {
+	c.index.recordValidation(path, validatedAt)
+}
+
+// lookupMetadata returns what the cache index records about how the archive
+// at path was built, reporting false if there is no such archive
+func (c *CacheManager) lookupMetadata(path string) (archiveMetadata, bool) {
+	entry, ok := c.index.lookup(path)
+	if !ok {
+		return archiveMetadata{}, false
+	}
+	return entry.metadata(), true
+}
+
+// SaveIndex writes pending changes to the cache index
+func (c *CacheManager) SaveIndex() {
+	c.index.flush()
 }
 
 // StartCleanup starts a background goroutine that periodically removes old files
@@ -55,63 +224,181 @@ func (c *CacheManager) StartCleanup(ctx context.Context) {
 	}
 }
 
-// PerformCleanup removes files from the cache directory that are older than maxCacheAge
+// PerformCleanup removes the archives that were last served longer ago than
+// maxCacheAge, or than the cache TTL rule matching the images they hold, and
+// then the stored blobs that no remaining archive references. The cache is
+// then brought back within max_cache_size. The cache index is first
+// reconciled with what is on disk.
 func (c *CacheManager) PerformCleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Picks up archives removed or added behind the index's back
+	c.index.sync()
+
+	now := time.Now()
+	for name, entry := range c.index.snapshot() {
+		age := now.Sub(entry.LastAccess)
+		if age <= entry.metadata().maxAge(c.maxCacheAge) {
+			continue
+		}
+		path := filepath.Join(c.dir, name)
+		log.WithFields(log.Fields{
+			"file": name,
+			"age":  age,
+		}).Info("Removing old cached file")
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.WithField("file", name).WithError(err).Error("Failed to remove old cached file")
+			continue
+		}
+		removeWithLog(metadataPath(path))
+		c.index.remove(path)
+	}
+	c.removeOrphanedMetadata()
+
+	c.blobs.evict(c.referencedBlobs())
+	c.enforceMaxSize("")
+}
+
+// RemovePartialWrites removes the archives and metadata files left half
+// written in the cache directory by a process that stopped mid-build. Partial
+// blobs it left are kept, as the next download of the blob resumes from them,
+// and evicted by cleanup when no archive uses the blob. It must run before any
+// build starts.
+func (c *CacheManager) RemovePartialWrites() {
 	files, err := os.ReadDir(c.dir)
 	if err != nil {
-		log.WithError(err).Error("Failed to read cache directory during cleanup")
+		log.WithError(err).Error("Failed to read cache directory")
 		return
 	}
-
-	now := time.Now()
 	for _, file := range files {
-		if file.IsDir() {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), partialSuffix) {
 			continue
 		}
+		log.WithField("file", file.Name()).Info("Removing partially written file")
+		removeWithLog(filepath.Join(c.dir, file.Name()))
+	}
+}
 
-		info, err := file.Info()
-		if err != nil {
-			log.WithField("file", file.Name()).WithError(err).Warn("Failed to get info for file during cleanup")
-			continue
+// referencedBlobs returns the paths of the stored blobs and layers used by cached archives
+func (c *CacheManager) referencedBlobs() map[string]bool {
+	referenced := make(map[string]bool)
+	for _, entry := range c.index.snapshot() {
+		for _, path := range c.storedPaths(entry.Blobs, entry.Layers) {
+			referenced[path] = true
 		}
+	}
+	return referenced
+}
 
-		mtime := info.ModTime()
+// storedPaths returns the paths of the stored blobs and layers an archive was built from
+func (c *CacheManager) storedPaths(blobs, layers []string) []string {
+	paths := make([]string, 0, len(blobs)+len(layers))
+	for _, digest := range blobs {
+		if path, err := c.blobs.blobPath(digest); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	for _, diffID := range layers {
+		if path, err := c.blobs.layerPath(diffID); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
 
-		if now.Sub(mtime) > c.maxCacheAge {
-			path := filepath.Join(c.dir, file.Name())
-			log.WithFields(log.Fields{
-				"file": file.Name(),
-				"age":  now.Sub(mtime),
-			}).Info("Removing old cached file")
-			if err := os.Remove(path); err != nil {
-				log.WithField("file", file.Name()).WithError(err).Error("Failed to remove old cached file")
-			}
+// removeOrphanedMetadata removes the metadata files whose archive no longer exists
+func (c *CacheManager) removeOrphanedMetadata() {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.WithError(err).Error("Failed to read cache directory during cleanup")
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), metadataSuffix) {
+			continue
+		}
+		archivePath := filepath.Join(c.dir, strings.TrimSuffix(file.Name(), metadataSuffix))
+		if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+			removeWithLog(metadataPath(archivePath))
 		}
 	}
 }
 
 // GetCachePath returns the full path for a cached image
-func (c *CacheManager) GetCachePath(imageName string, platform Platform) string {
-	return filepath.Join(c.dir, c.GetCacheFilename(imageName, platform))
+func (c *CacheManager) GetCachePath(imageName string, platform Platform, format ImageFormat) string {
+	return filepath.Join(c.dir, c.GetCacheFilename(imageName, platform, format))
 }
 
 // GetCacheFilename generates a safe filename for caching
-func (c *CacheManager) GetCacheFilename(imageName string, platform Platform) string {
-	return imageFilename(ParseImageReference(imageName), platform)
+func (c *CacheManager) GetCacheFilename(imageName string, platform Platform, format ImageFormat) string {
+	return imageFilename(ParseImageReference(imageName), platform, format)
+}
+
+// GetMultiPlatformCachePath returns the full path for a cached multi-platform image
+func (c *CacheManager) GetMultiPlatformCachePath(imageName string, selection PlatformSelection) string {
+	return filepath.Join(c.dir, multiPlatformFilename(ParseImageReference(imageName), selection))
+}
+
+// GetBundleCachePath returns the full path for a cached bundle of images
+func (c *CacheManager) GetBundleCachePath(imageNames []string, platform Platform) string {
+	return filepath.Join(c.dir, bundleFilename(imageNames, platform))
 }
 
 // imageFilename builds the platform-qualified tar filename for an image reference.
-func imageFilename(ref ImageReference, platform Platform) string {
-	parts := []string{
-		sanitizeFilenameComponent(ref.Repository),
-		sanitizeFilenameComponent(ref.Tag),
-		sanitizeFilenameComponent(platform.OS),
-		sanitizeFilenameComponent(platform.Architecture),
-	}
+func imageFilename(ref ImageReference, platform Platform, format ImageFormat) string {
+	platformParts := []string{platform.OS, platform.Architecture}
 	if platform.Variant != "" {
-		parts = append(parts, sanitizeFilenameComponent(platform.Variant))
+		platformParts = append(platformParts, platform.Variant)
+	}
+	return archiveFilename(ref, platformParts, format)
+}
+
+// multiPlatformFilename builds the filename of a multi-platform OCI archive,
+// e.g. library_alpine_3.20_linux-amd64+linux-arm64.oci.tar. Selections whose
+// names would make the filename too long are named after a hash of them
+// instead, e.g. library_alpine_3.20_platforms-3f2a9c1b7d4e8f60.oci.tar.
+func multiPlatformFilename(ref ImageReference, selection PlatformSelection) string {
+	label := allPlatforms
+	if !selection.All {
+		names := make([]string, len(selection.Platforms))
+		for i, p := range selection.Platforms {
+			names[i] = strings.ReplaceAll(p.String(), "/", "-")
+		}
+		label = strings.Join(names, "+")
+	}
+	if len(label) > maxPlatformLabelLength {
+		sum := sha256.Sum256([]byte(label))
+		label = "platforms-" + hex.EncodeToString(sum[:])[:16]
+	}
+	return archiveFilename(ref, []string{label}, FormatOCI)
+}
+
+// archiveFilename joins the registry, repository, version and platform parts
+// into a safe filename. The registry is left out for Docker Hub, and
+// digest-pinned references are named after the digest so they never share a
+// cache entry with a mutable tag. A tag given with the digest is kept in the
+// name, as the archive is tagged with it.
+func archiveFilename(ref ImageReference, platformParts []string, format ImageFormat) string {
+	version := ref.Tag
+	if ref.Digest != "" {
+		version = strings.ReplaceAll(ref.Digest, ":", "-")
+		if ref.Tag != "" {
+			version = ref.Tag + "@" + version
+		}
+	}
+	var parts []string
+	if registry := canonicalRegistry(ref.Registry); registry != dockerHubCanonicalHost {
+		parts = append(parts, sanitizeFilenameComponent(strings.ReplaceAll(registry, ":", "-")))
+	}
+	parts = append(parts,
+		sanitizeFilenameComponent(ref.Repository),
+		sanitizeFilenameComponent(version),
+	)
+	for _, part := range platformParts {
+		parts = append(parts, sanitizeFilenameComponent(part))
 	}
-	return strings.Join(parts, "_") + ".tar.gz"
+	return strings.Join(parts, "_") + format.extension()
 }
 
 // Dir returns the cache directory path
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -48,6 +51,196 @@ func TestPerformCleanup(t *testing.T) {
 	}
 }
 
+func TestPerformCleanup_RemovesArchiveMetadata(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-cleanup-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	maxAge := 2 * time.Hour
+	oldTime := time.Now().Add(-maxAge - time.Hour)
+	files := map[string]bool{
+		// name: whether it should survive cleanup
+		"new.tar.gz":           true,
+		"new.tar.gz.json":      true,
+		"old.tar.gz":           false,
+		"old.tar.gz.json":      false,
+		"orphaned.tar.gz.json": false,
+	}
+	for name := range files {
+		path := filepath.Join(tempDir, name)
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(name, "old") {
+			if err := os.Chtimes(path, oldTime, oldTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	cache, _ := NewCacheManager(tempDir, maxAge)
+	cache.PerformCleanup()
+
+	for name, survives := range files {
+		_, err := os.Stat(filepath.Join(tempDir, name))
+		if survives && err != nil {
+			t.Errorf("%s was incorrectly removed", name)
+		}
+		if !survives && !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+}
+
+func TestPerformCleanup_CacheTTLPolicy(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-cleanup-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	policy, err := NewCacheTTLPolicy([]CacheTTLRule{
+		{Tag: "latest", MaxAge: time.Hour},
+		{Tag: `\d+\.\d+\.\d+`, MaxAge: 90 * 24 * time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetCacheTTLPolicy(policy)
+	defer SetCacheTTLPolicy(nil)
+
+	lastServed := time.Now().Add(-3 * time.Hour)
+	archives := []struct {
+		name     string
+		images   []string
+		survives bool
+	}{
+		{"rolling.tar.gz", []string{"alpine:latest"}, false},
+		{"release.tar.gz", []string{"golang:1.25.3"}, true},
+		// Within the default max age
+		{"other.tar.gz", []string{"alpine:3.20"}, true},
+		// A bundle expires with its shortest-lived image
+		{"bundle.tar.gz", []string{"golang:1.25.3", "redis:latest"}, false},
+		{"no-metadata.tar.gz", nil, true},
+	}
+	for _, archive := range archives {
+		path := filepath.Join(tempDir, archive.name)
+		if err := os.WriteFile(path, []byte("archive"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if archive.images != nil {
+			manifests := make(map[string]string)
+			for _, image := range archive.images {
+				manifests[image] = "sha256:1"
+			}
+			if err := writeArchiveMetadata(path, archiveMetadata{Manifests: manifests, ValidatedAt: lastServed}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chtimes(path, lastServed, lastServed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache, _ := NewCacheManager(tempDir, 48*time.Hour)
+	cache.PerformCleanup()
+
+	for _, archive := range archives {
+		_, err := os.Stat(filepath.Join(tempDir, archive.name))
+		if archive.survives && err != nil {
+			t.Errorf("%s was incorrectly removed", archive.name)
+		}
+		if !archive.survives && !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", archive.name)
+		}
+	}
+}
+
+func TestRemovePartialWrites(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-partial-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	cache, _ := NewCacheManager(tempDir, time.Hour)
+	blobPath, err := cache.blobs.blobPath("sha256:" + strings.Repeat("a", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		removed bool
+	}{
+		{path: filepath.Join(tempDir, "image.tar.gz"), removed: false},
+		{path: filepath.Join(tempDir, "image.tar.gz.json"), removed: false},
+		{path: filepath.Join(tempDir, "other.tar.gz.123456"+partialSuffix), removed: true},
+		{path: filepath.Join(tempDir, "other.tar.gz.json.654321"+partialSuffix), removed: true},
+		// Partial blobs are resumed by the next download
+		{path: blobPath + partialSuffix, removed: false},
+	}
+	for _, tt := range tests {
+		if err := os.MkdirAll(filepath.Dir(tt.path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(tt.path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.RemovePartialWrites()
+
+	for _, tt := range tests {
+		_, err := os.Stat(tt.path)
+		if tt.removed && !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", filepath.Base(tt.path))
+		}
+		if !tt.removed && err != nil {
+			t.Errorf("expected %s to be kept, got %v", filepath.Base(tt.path), err)
+		}
+	}
+}
+
+func TestArchiveMetadata_NeedsRevalidation(t *testing.T) {
+	defer SetRevalidateInterval(defaultRevalidateInterval)
+	SetRevalidateInterval(time.Hour)
+
+	now := time.Now()
+	pinned := "alpine@sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		name      string
+		manifests map[string]string
+		validated time.Time
+		want      bool
+	}{
+		{"tag within interval", map[string]string{"alpine:3.20": "sha256:1"}, now.Add(-time.Minute), false},
+		{"tag past interval", map[string]string{"alpine:3.20": "sha256:1"}, now.Add(-2 * time.Hour), true},
+		{"pinned digest past interval", map[string]string{pinned: "sha256:1"}, now.Add(-2 * time.Hour), false},
+		{"bundle with one tag", map[string]string{pinned: "sha256:1", "redis:7": "sha256:2"}, now.Add(-2 * time.Hour), true},
+		{"rolling tag with a shorter rule", map[string]string{"alpine:edge": "sha256:1"}, now.Add(-2 * time.Minute), true},
+		{"rolling tag within its rule", map[string]string{"alpine:edge": "sha256:1"}, now.Add(-30 * time.Second), false},
+	}
+
+	policy, err := NewCacheTTLPolicy([]CacheTTLRule{{Tag: "edge", RevalidateInterval: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetCacheTTLPolicy(policy)
+	defer SetCacheTTLPolicy(nil)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := archiveMetadata{Manifests: tt.manifests, ValidatedAt: tt.validated}
+			if got := metadata.needsRevalidation(now); got != tt.want {
+				t.Errorf("needsRevalidation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestGetCacheFilename(t *testing.T) {
 	cache, _ := NewCacheManager("", 1*time.Hour)
 	defer func(path string) {
@@ -60,6 +253,7 @@ func TestGetCacheFilename(t *testing.T) {
 	tests := []struct {
 		imageName string
 		platform  Platform
+		format    ImageFormat
 		expected  string
 	}{
 		{
@@ -75,21 +269,95 @@ func TestGetCacheFilename(t *testing.T) {
 		{
 			imageName: "ghcr.io/username/repo:v1.2.3",
 			platform:  Platform{OS: "linux", Architecture: "amd64"},
+			expected:  "ghcr.io_username_repo_v1.2.3_linux_amd64.tar.gz",
+		},
+		{
+			imageName: "docker.io/username/repo:v1.2.3",
+			platform:  Platform{OS: "linux", Architecture: "amd64"},
 			expected:  "username_repo_v1.2.3_linux_amd64.tar.gz",
 		},
+		{
+			imageName: "localhost:5000/username/repo:v1.2.3",
+			platform:  Platform{OS: "linux", Architecture: "amd64"},
+			expected:  "localhost-5000_username_repo_v1.2.3_linux_amd64.tar.gz",
+		},
 		{
 			imageName: "alpine:latest",
 			platform:  Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
 			expected:  "library_alpine_latest_linux_arm_v7.tar.gz",
 		},
+		{
+			imageName: "alpine@sha256:" + strings.Repeat("c", 64),
+			platform:  Platform{OS: "linux", Architecture: "amd64"},
+			expected:  "library_alpine_sha256-" + strings.Repeat("c", 64) + "_linux_amd64.tar.gz",
+		},
+		{
+			imageName: "alpine:3.20@sha256:" + strings.Repeat("c", 64),
+			platform:  Platform{OS: "linux", Architecture: "amd64"},
+			expected:  "library_alpine_3.20@sha256-" + strings.Repeat("c", 64) + "_linux_amd64.tar.gz",
+		},
+		{
+			imageName: "alpine:3.20",
+			platform:  Platform{OS: "linux", Architecture: "amd64"},
+			format:    FormatOCI,
+			expected:  "library_alpine_3.20_linux_amd64.oci.tar",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.imageName, func(t *testing.T) {
-			got := cache.GetCacheFilename(tt.imageName, tt.platform)
+			got := cache.GetCacheFilename(tt.imageName, tt.platform, tt.format)
 			if got != tt.expected {
 				t.Errorf("GetCacheFilename(%q) = %q, want %q", tt.imageName, got, tt.expected)
 			}
 		})
 	}
 }
+
+// platformLabelHash returns the hash naming a long platform selection
+func platformLabelHash(label string) string {
+	sum := sha256.Sum256([]byte(label))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func TestMultiPlatformFilename(t *testing.T) {
+	tests := []struct {
+		imageName string
+		selection string
+		expected  string
+	}{
+		{
+			imageName: "alpine:3.20",
+			selection: "all",
+			expected:  "library_alpine_3.20_all.oci.tar",
+		},
+		{
+			imageName: "alpine:3.20",
+			selection: "linux/arm64,linux/amd64",
+			expected:  "library_alpine_3.20_linux-amd64+linux-arm64.oci.tar",
+		},
+		{
+			imageName: "ghcr.io/username/repo:v1",
+			selection: "linux/arm/v7",
+			expected:  "ghcr.io_username_repo_v1_linux-arm-v7.oci.tar",
+		},
+		{
+			imageName: "alpine:3.20",
+			selection: "linux/amd64,linux/arm64,linux/arm/v6,linux/arm/v7,linux/386,linux/ppc64le,linux/s390x,linux/riscv64",
+			expected:  "library_alpine_3.20_platforms-" + platformLabelHash("linux-386+linux-amd64+linux-arm-v6+linux-arm-v7+linux-arm64+linux-ppc64le+linux-riscv64+linux-s390x") + ".oci.tar",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selection, func(t *testing.T) {
+			selection, err := ParsePlatformSelection(tt.selection)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := multiPlatformFilename(ParseImageReference(tt.imageName), selection)
+			if got != tt.expected {
+				t.Errorf("multiPlatformFilename(%q, %q) = %q, want %q", tt.imageName, tt.selection, got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// cacheIndexName is the file in the cache directory holding the index
+	cacheIndexName = "cache.index"
+	// cacheIndexVersion is bumped when the index format changes, which makes
+	// older indexes get rebuilt from disk
+	cacheIndexVersion = 2
+	// cacheIndexSaveDelay is how long changes to the index are batched before
+	// it is written, so that serving an archive doesn't rewrite it each time
+	cacheIndexSaveDelay = 5 * time.Second
+)
+
+// IndexedImage is an image held by a cached archive
+type IndexedImage struct {
+	Name     string `json:"name"`
+	Registry string `json:"registry"`
+	// Digest is the manifest (or index) digest the image was built from
+	Digest string `json:"digest"`
+}
+
+// CacheEntry describes a cached archive
+type CacheEntry struct {
+	Images     []IndexedImage `json:"images,omitempty"`
+	Size       int64          `json:"size"`
+	CreatedAt  time.Time      `json:"created_at"`
+	LastAccess time.Time      `json:"last_access"`
+	// Hits counts the requests served from the cache without a build
+	Hits int64 `json:"hits"`
+	// ValidatedAt is when the digests were last confirmed against the registry
+	ValidatedAt time.Time `json:"validated_at,omitzero"`
+	// Blobs and Layers are the stored blobs and decompressed layers the
+	// archive was built from
+	Blobs  []string `json:"blobs,omitempty"`
+	Layers []string `json:"layers,omitempty"`
+}
+
+// metadata returns what the entry records about how the archive was built
+func (e *CacheEntry) metadata() archiveMetadata {
+	manifests := make(map[string]string, len(e.Images))
+	for _, image := range e.Images {
+		manifests[image.Name] = image.Digest
+	}
+	return archiveMetadata{
+		Manifests:   manifests,
+		CreatedAt:   e.CreatedAt,
+		ValidatedAt: e.ValidatedAt,
+		Blobs:       e.Blobs,
+		Layers:      e.Layers,
+	}
+}
+
+// cacheIndexFile is the on-disk form of the index
+type cacheIndexFile struct {
+	Version int                    `json:"version"`
+	Entries map[string]*CacheEntry `json:"entries"`
+}
+
+// cacheIndex is the persistent record of the archives in a cache directory,
+// keyed by filename. Size limits, cleanup and revalidation read it instead of
+// the directory and the metadata files. Changes are saved after
+// cacheIndexSaveDelay; when the index is missing or unreadable it is rebuilt
+// from the archives and their metadata, losing only the hit counts.
+type cacheIndex struct {
+	dir string
+
+	// writeMu orders the writes of the index file
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	entries map[string]*CacheEntry
+	// saveTimer is set while changes are waiting to be saved
+	saveTimer *time.Timer
+}
+
+// openCacheIndex loads the index of a cache directory and reconciles it with
+// the archives on disk
+func openCacheIndex(dir string) *cacheIndex {
+	index := &cacheIndex{dir: dir, entries: make(map[string]*CacheEntry)}
+	if err := index.load(); err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warn("Failed to read cache index, rebuilding it")
+		}
+		index.entries = make(map[string]*CacheEntry)
+	}
+	index.sync()
+	return index
+}
+
+// load reads the index file
+func (x *cacheIndex) load() error {
+	data, err := os.ReadFile(filepath.Join(x.dir, cacheIndexName))
+	if err != nil {
+		return err
+	}
+	var file cacheIndexFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid cache index: %w", err)
+	}
+	if file.Version != cacheIndexVersion {
+		return fmt.Errorf("unsupported cache index version %d", file.Version)
+	}
+	for name, entry := range file.Entries {
+		if entry != nil {
+			x.entries[name] = entry
+		}
+	}
+	return nil
+}
+
+// changed schedules a save of the index. Must be called with x.mu held.
+func (x *cacheIndex) changed() {
+	if x.saveTimer == nil {
+		x.saveTimer = time.AfterFunc(cacheIndexSaveDelay, x.flush)
+	}
+}
+
+// flush writes the index file if it has unsaved changes
+func (x *cacheIndex) flush() {
+	x.writeMu.Lock()
+	defer x.writeMu.Unlock()
+
+	x.mu.Lock()
+	if x.saveTimer == nil {
+		x.mu.Unlock()
+		return
+	}
+	x.saveTimer.Stop()
+	x.saveTimer = nil
+	data, err := json.Marshal(cacheIndexFile{Version: cacheIndexVersion, Entries: x.entries})
+	x.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(x.dir, cacheIndexName), data, 0644)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to write cache index")
+	}
+}
+
+// sync adds the archives on disk missing from the index and drops the
+// entries whose archive is gone
+func (x *cacheIndex) sync() {
+	// Held while reading the directory so that archives recorded meanwhile
+	// are not dropped as missing
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	files, err := os.ReadDir(x.dir)
+	if err != nil {
+		log.WithError(err).Error("Failed to read cache directory for the index")
+		return
+	}
+
+	onDisk := make(map[string]bool)
+	for _, file := range files {
+		if !isCachedArchive(file) {
+			continue
+		}
+		onDisk[file.Name()] = true
+		if _, ok := x.entries[file.Name()]; ok {
+			continue
+		}
+		entry, err := archiveEntry(filepath.Join(x.dir, file.Name()))
+		if err != nil {
+			continue
+		}
+		x.entries[file.Name()] = entry
+		x.changed()
+	}
+	for name := range x.entries {
+		if !onDisk[name] {
+			delete(x.entries, name)
+			x.changed()
+		}
+	}
+}
+
+// archiveEntry describes an archive from the file and its metadata
+func archiveEntry(path string) (*CacheEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &CacheEntry{
+		Size:       info.Size(),
+		CreatedAt:  info.ModTime(),
+		LastAccess: fileAccessTime(info),
+	}
+	metadata, err := readArchiveMetadata(path)
+	if err != nil {
+		// Built before metadata was recorded
+		return entry, nil
+	}
+	if !metadata.CreatedAt.IsZero() {
+		entry.CreatedAt = metadata.CreatedAt
+	}
+	for _, name := range slices.Sorted(maps.Keys(metadata.Manifests)) {
+		entry.Images = append(entry.Images, IndexedImage{
+			Name:     name,
+			Registry: canonicalRegistry(ParseImageReference(name).Registry),
+			Digest:   metadata.Manifests[name],
+		})
+	}
+	entry.ValidatedAt = metadata.ValidatedAt
+	entry.Blobs = metadata.Blobs
+	entry.Layers = metadata.Layers
+	return entry, nil
+}
+
+// snapshot returns a copy of the entries
+func (x *cacheIndex) snapshot() map[string]CacheEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entries := make(map[string]CacheEntry, len(x.entries))
+	for name, entry := range x.entries {
+		entries[name] = *entry
+	}
+	return entries
+}
+
+// lookup returns the entry of the archive at path, indexing it if it is
+// missing. It reports false if the archive doesn't exist.
+func (x *cacheIndex) lookup(path string) (CacheEntry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entry, ok := x.entry(path)
+	if !ok {
+		return CacheEntry{}, false
+	}
+	return *entry, true
+}
+
+// entry returns the entry of the archive at path, indexing it from disk if
+// it is missing. Must be called with x.mu held.
+func (x *cacheIndex) entry(path string) (*CacheEntry, bool) {
+	name := filepath.Base(path)
+	if entry, ok := x.entries[name]; ok {
+		return entry, true
+	}
+	entry, err := archiveEntry(path)
+	if err != nil {
+		return nil, false
+	}
+	x.entries[name] = entry
+	x.changed()
+	return entry, true
+}
+
+// recordBuild adds a newly built archive, replacing any earlier entry
+func (x *cacheIndex) recordBuild(path string) {
+	entry, err := archiveEntry(path)
+	if err != nil {
+		log.WithField("file", filepath.Base(path)).WithError(err).Warn("Failed to index cached file")
+		return
+	}
+	entry.LastAccess = time.Now()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries[filepath.Base(path)] = entry
+	x.changed()
+}
+
+// recordHit counts a request served from the cached archive at path
+func (x *cacheIndex) recordHit(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entry, ok := x.entry(path)
+	if !ok {
+		return
+	}
+	entry.Hits++
+	entry.LastAccess = time.Now()
+	x.changed()
+}
+
+// recordValidation records that the digests of the archive at path were
+// confirmed against the registry at validatedAt
+func (x *cacheIndex) recordValidation(path string, validatedAt time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entry, ok := x.entry(path)
+	if !ok {
+		return
+	}
+	entry.ValidatedAt = validatedAt
+	x.changed()
+}
+
+// remove drops the entry of an archive that was removed from the cache
+func (x *cacheIndex) remove(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	name := filepath.Base(path)
+	if _, ok := x.entries[name]; !ok {
+		return
+	}
+	delete(x.entries, name)
+	x.changed()
+}
+
+// isCachedArchive reports whether a cache directory entry is an archive, as
+// opposed to metadata, the index, the blob store or a file being written
+func isCachedArchive(file os.DirEntry) bool {
+	name := file.Name()
+	return !file.IsDir() &&
+		(strings.HasSuffix(name, FormatDocker.extension()) || strings.HasSuffix(name, FormatOCI.extension()))
+}
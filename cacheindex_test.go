@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheIndex_RecordsBuildsHitsAndRemovals(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-index-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	cache, _ := NewCacheManager(tempDir, time.Hour)
+	path := filepath.Join(tempDir, "org_app_1.0_linux_amd64.tar.gz")
+	if err := os.WriteFile(path, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest := "sha256:" + strings.Repeat("c", 64)
+	createdAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	metadata := archiveMetadata{Manifests: map[string]string{"ghcr.io/org/app:1.0": digest}, CreatedAt: createdAt}
+	if err := writeArchiveMetadata(path, metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.RecordBuild(path)
+	cache.RecordHit(path)
+	cache.RecordHit(path)
+	validatedAt := time.Now().Truncate(time.Second)
+	cache.RecordValidation(path, validatedAt)
+	cache.SaveIndex()
+
+	// A reopened index reads what was recorded from the index file
+	index := openCacheIndex(tempDir)
+	entry, ok := index.entries[filepath.Base(path)]
+	if !ok {
+		t.Fatal("expected the archive to be indexed")
+	}
+	if entry.Hits != 2 {
+		t.Errorf("expected 2 hits, got %d", entry.Hits)
+	}
+	if entry.Size != int64(len("archive")) {
+		t.Errorf("expected size %d, got %d", len("archive"), entry.Size)
+	}
+	if !entry.CreatedAt.Equal(createdAt) {
+		t.Errorf("expected creation time %s, got %s", createdAt, entry.CreatedAt)
+	}
+	if len(entry.Images) != 1 || entry.Images[0].Registry != "ghcr.io" || entry.Images[0].Digest != digest {
+		t.Errorf("unexpected images %+v", entry.Images)
+	}
+	if !entry.ValidatedAt.Equal(validatedAt) {
+		t.Errorf("expected validation time %s, got %s", validatedAt, entry.ValidatedAt)
+	}
+
+	// Cleanup goes by the last access recorded in the index and removes
+	// expired archives from it
+	cache.index.mu.Lock()
+	cache.index.entries[filepath.Base(path)].LastAccess = time.Now().Add(-2 * time.Hour)
+	cache.index.mu.Unlock()
+	cache.PerformCleanup()
+	cache.SaveIndex()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expected the expired archive to be removed")
+	}
+	if _, ok := openCacheIndex(tempDir).entries[filepath.Base(path)]; ok {
+		t.Error("expected the removed archive to be dropped from the index")
+	}
+}
+
+func TestCacheIndex_RebuildsFromDisk(t *testing.T) {
+	tests := []struct {
+		name  string
+		index string
+	}{
+		{name: "missing index"},
+		{name: "corrupt index", index: "{not json"},
+		{name: "unknown version", index: `{"version": 99, "entries": {}}`},
+		{name: "older version", index: `{"version": 1, "entries": {}}`},
+		{name: "stale entries", index: `{"version": 2, "entries": {"gone.tar.gz": {"size": 1, "hits": 5}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "test-index-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupTempDir(t, tempDir)
+
+			for _, name := range []string{"a.tar.gz", "b.oci.tar"} {
+				if err := os.WriteFile(filepath.Join(tempDir, name), []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(tempDir, "c.tar.gz.1234"+partialSuffix), []byte("partial"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.index != "" {
+				if err := os.WriteFile(filepath.Join(tempDir, cacheIndexName), []byte(tt.index), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			openCacheIndex(tempDir).flush()
+
+			// The rebuilt index was written back to disk
+			index := &cacheIndex{dir: tempDir, entries: make(map[string]*CacheEntry)}
+			if err := index.load(); err != nil {
+				t.Fatalf("failed to load rebuilt index: %v", err)
+			}
+			if len(index.entries) != 2 {
+				t.Errorf("expected 2 entries, got %d", len(index.entries))
+			}
+			for _, name := range []string{"a.tar.gz", "b.oci.tar"} {
+				entry, ok := index.entries[name]
+				if !ok {
+					t.Errorf("expected %s to be indexed", name)
+					continue
+				}
+				if entry.Size != int64(len(name)) {
+					t.Errorf("expected size %d for %s, got %d", len(name), name, entry.Size)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheIndex_BatchesSaves(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-index-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	path := filepath.Join(tempDir, "app_1.0_linux_amd64.tar.gz")
+	if err := os.WriteFile(path, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache, _ := NewCacheManager(tempDir, time.Hour)
+	cache.SaveIndex()
+	indexPath := filepath.Join(tempDir, cacheIndexName)
+	saved, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		cache.RecordHit(path)
+	}
+	if data, _ := os.ReadFile(indexPath); string(data) != string(saved) {
+		t.Error("expected hits to be saved later, not on every request")
+	}
+
+	cache.SaveIndex()
+	if hits := openCacheIndex(tempDir).entries[filepath.Base(path)].Hits; hits != 3 {
+		t.Errorf("expected 3 hits once saved, got %d", hits)
+	}
+
+	// The index is neither an archive nor archive metadata to clean up
+	cache.PerformCleanup()
+	if _, err := os.Stat(indexPath); err != nil {
+		t.Errorf("expected cleanup to keep the index: %v", err)
+	}
+}
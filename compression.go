@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// layerCompression is the compression applied to a layer blob
+type layerCompression int
+
+const (
+	compressionUnknown layerCompression = iota
+	compressionNone
+	compressionGzip
+	compressionZstd
+)
+
+func (c layerCompression) String() string {
+	switch c {
+	case compressionNone:
+		return "uncompressed"
+	case compressionGzip:
+		return "gzip"
+	case compressionZstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ErrUnsupportedLayer is returned for layers whose media type cannot be unpacked
+type ErrUnsupportedLayer struct {
+	MediaType string
+}
+
+func (e *ErrUnsupportedLayer) Error() string {
+	return fmt.Sprintf("unsupported layer media type: %s", e.MediaType)
+}
+
+// compressionFromMediaType maps a layer media type to its compression. An
+// empty media type is reported as compressionUnknown and left to detection.
+func compressionFromMediaType(mediaType string) (layerCompression, error) {
+	switch strings.Replace(mediaType, ".nondistributable", "", 1) {
+	case "":
+		return compressionUnknown, nil
+	case "application/vnd.oci.image.layer.v1.tar",
+		"application/vnd.docker.image.rootfs.diff.tar":
+		return compressionNone, nil
+	case "application/vnd.oci.image.layer.v1.tar+gzip",
+		"application/vnd.docker.image.rootfs.diff.tar.gzip",
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":
+		return compressionGzip, nil
+	case "application/vnd.oci.image.layer.v1.tar+zstd":
+		return compressionZstd, nil
+	}
+	return compressionUnknown, &ErrUnsupportedLayer{MediaType: mediaType}
+}
+
+// detectCompression identifies gzip and zstd streams by their magic bytes
+func detectCompression(header []byte) layerCompression {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return compressionGzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return compressionZstd
+	}
+	return compressionNone
+}
+
+// checkLayerMediaTypes fails early when a manifest contains a layer that cannot be unpacked
+func checkLayerMediaTypes(manifest *ManifestV2) error {
+	for _, layer := range manifest.Layers {
+		if _, err := compressionFromMediaType(layer.MediaType); err != nil {
+			return fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// newLayerReader returns a reader for the uncompressed content of a layer.
+// The magic bytes take precedence over the media type, as some registries
+// mislabel layers; a layer declared compressed without any known compression
+// header is rejected rather than copied as is.
+func newLayerReader(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	declared, err := compressionFromMediaType(mediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	detected := detectCompression(header)
+	if detected == compressionNone && declared != compressionNone && declared != compressionUnknown {
+		return nil, fmt.Errorf("layer declared as %s (%s) has no %s header", declared, mediaType, declared)
+	}
+
+	switch detected {
+	case compressionGzip:
+		return gzip.NewReader(buffered)
+	case compressionZstd:
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return io.NopCloser(buffered), nil
+}
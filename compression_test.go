@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressForTest(t *testing.T, compression layerCompression, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case compressionGzip:
+		w = gzip.NewWriter(&buf)
+	case compressionZstd:
+		encoder, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = encoder
+	default:
+		return content
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressionFromMediaType(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		expected  layerCompression
+		wantErr   bool
+	}{
+		{mediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", expected: compressionGzip},
+		{mediaType: "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", expected: compressionGzip},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar+gzip", expected: compressionGzip},
+		{mediaType: "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip", expected: compressionGzip},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar+zstd", expected: compressionZstd},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar", expected: compressionNone},
+		{mediaType: "application/vnd.docker.image.rootfs.diff.tar", expected: compressionNone},
+		{mediaType: "", expected: compressionUnknown},
+		{mediaType: "application/vnd.in-toto+json", wantErr: true},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar+bzip2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mediaType, func(t *testing.T) {
+			got, err := compressionFromMediaType(tt.mediaType)
+			if tt.wantErr {
+				if _, ok := errors.AsType[*ErrUnsupportedLayer](err); !ok {
+					t.Fatalf("expected ErrUnsupportedLayer, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("compressionFromMediaType(%q) = %s, want %s", tt.mediaType, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewLayerReader(t *testing.T) {
+	content := []byte("layer tar content for decompression tests")
+
+	tests := []struct {
+		name        string
+		compression layerCompression
+		mediaType   string
+		wantErr     bool
+	}{
+		{name: "gzip", compression: compressionGzip, mediaType: "application/vnd.oci.image.layer.v1.tar+gzip"},
+		{name: "zstd", compression: compressionZstd, mediaType: "application/vnd.oci.image.layer.v1.tar+zstd"},
+		{name: "uncompressed", compression: compressionNone, mediaType: "application/vnd.oci.image.layer.v1.tar"},
+		{name: "zstd labelled as gzip", compression: compressionZstd, mediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip"},
+		{name: "gzip without media type", compression: compressionGzip, mediaType: ""},
+		{name: "plain data labelled as zstd", compression: compressionNone, mediaType: "application/vnd.oci.image.layer.v1.tar+zstd", wantErr: true},
+		{name: "plain data labelled as gzip", compression: compressionNone, mediaType: "application/vnd.oci.image.layer.v1.tar+gzip", wantErr: true},
+		{name: "unsupported media type", compression: compressionGzip, mediaType: "application/x-rar", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blob := compressForTest(t, tt.compression, content)
+			reader, err := newLayerReader(bytes.NewReader(blob), tt.mediaType)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newLayerReader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer closeWithLog(reader, "layer reader")
+
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("content mismatch: got %q, want %q", got, content)
+			}
+		})
+	}
+}
+
+func TestCheckLayerMediaTypes(t *testing.T) {
+	_, manifest, _ := fakeLayeredImage(t, []string{"a", "b"}, nil)
+	if err := checkLayerMediaTypes(manifest); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	manifest.Layers[1].MediaType = "application/vnd.in-toto+json"
+	err := checkLayerMediaTypes(manifest)
+	if _, ok := errors.AsType[*ErrUnsupportedLayer](err); !ok {
+		t.Fatalf("expected ErrUnsupportedLayer, got %v", err)
+	}
+}
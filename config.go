@@ -2,24 +2,255 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	defaultMaxConcurrentLayers    = 4
+	defaultMaxConcurrentDownloads = 16
+)
+
 // Config represents the application configuration
 type Config struct {
-	Port        int                       `yaml:"port"`
-	CacheDir    string                    `yaml:"cache_dir"`
-	MaxCacheAge time.Duration             `yaml:"max_cache_age"`
-	Registries  map[string]RegistryConfig `yaml:"registries"`
+	Port        int           `yaml:"port"`
+	CacheDir    string        `yaml:"cache_dir"`
+	MaxCacheAge time.Duration `yaml:"max_cache_age"`
+	// MaxCacheSize caps the disk space used by the cache; 0 means no limit
+	MaxCacheSize ByteSize `yaml:"max_cache_size"`
+	// TempDir is where archives are assembled before being packed into the
+	// cache; the system temporary directory is used when empty
+	TempDir string `yaml:"temp_dir"`
+	// RevalidateInterval is how long a cached archive of a tag is served
+	// before the tag is checked against the registry again
+	RevalidateInterval time.Duration `yaml:"revalidate_interval"`
+	// CacheTTL overrides max_cache_age and revalidate_interval per repository and tag
+	CacheTTL               []CacheTTLRule            `yaml:"cache_ttl"`
+	MaxConcurrentLayers    int                       `yaml:"max_concurrent_layers"`
+	MaxConcurrentDownloads int                       `yaml:"max_concurrent_downloads"`
+	Retry                  RetryConfig               `yaml:"retry"`
+	Registries             map[string]RegistryConfig `yaml:"registries"`
+	// TrustedPrivateRegistries are hostnames, IPs and CIDRs exempt from the
+	// private address checks, for self-hosted registries
+	TrustedPrivateRegistries []string     `yaml:"trusted_private_registries"`
+	Policy                   PolicyConfig `yaml:"policy"`
+	// DockerConfig is a Docker CLI config.json consulted for registries
+	// without credentials of their own, e.g. ~/.docker/config.json
+	DockerConfig string `yaml:"docker_config"`
+}
+
+// PolicyConfig holds glob rules over "registry/repository", e.g. docker.io/library/*.
+// Deny rules win; when allow rules are given, everything else is denied.
+type PolicyConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// CacheTTLRule sets cache lifetimes for images whose repository matches the
+// Repository glob (as in PolicyConfig) and whose tag matches the Tag regular
+// expression. Rules are checked in order and the first match applies; an
+// empty Repository or Tag matches everything. A zero duration keeps the default.
+type CacheTTLRule struct {
+	Repository         string        `yaml:"repository"`
+	Tag                string        `yaml:"tag"`
+	MaxAge             time.Duration `yaml:"max_age"`
+	RevalidateInterval time.Duration `yaml:"revalidate_interval"`
+}
+
+// ByteSize is a number of bytes, written in the configuration as a plain
+// number or with a unit, e.g. "512MB" or "1.5 GB". Units are powers of 1024,
+// matching the sizes shown in logs.
+type ByteSize int64
+
+var byteSizeUnits = map[string]float64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// UnmarshalYAML parses a size such as "50GB"
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := parseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
 }
 
-// RegistryConfig holds credentials for a specific registry
+// parseByteSize parses a number of bytes with an optional unit
+func parseByteSize(value string) (ByteSize, error) {
+	text := strings.TrimSpace(value)
+	number := strings.TrimRightFunc(text, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	unit := strings.ToUpper(strings.TrimSpace(text[len(number):]))
+	multiplier, ok := byteSizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", value, unit)
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return ByteSize(n * multiplier), nil
+}
+
+// RegistryConfig holds credentials and client settings for a specific registry
 type RegistryConfig struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
+	// Credentials can instead be read from the environment, from a secret
+	// file, or from a docker-credential-<credential_helper> binary
+	UsernameEnv      string `yaml:"username_env"`
+	PasswordEnv      string `yaml:"password_env"`
+	PasswordFile     string `yaml:"password_file"`
+	CredentialHelper string `yaml:"credential_helper"`
+	// AnonymousFallback retries anonymously when the credentials are rejected
+	AnonymousFallback bool        `yaml:"anonymous_fallback"`
+	Retry             RetryConfig `yaml:"retry"`
+	// Mirrors are pull-through caches tried in order before the registry,
+	// given as "host[:port][/prefix]"
+	Mirrors []string `yaml:"mirrors"`
+	// CAFile is a PEM bundle trusted for the registry in addition to the system roots
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	PlainHTTP          bool   `yaml:"plain_http"`
+	// OAuth2 requests tokens with the OAuth2 password grant (POST) instead of GET
+	OAuth2 bool `yaml:"oauth2"`
+	// Proxy is an http, https or socks5 proxy URL used to reach the registry
+	Proxy string `yaml:"proxy"`
+}
+
+// transportOptions returns the transport settings of a registry
+func (rc RegistryConfig) transportOptions() TransportOptions {
+	return TransportOptions{CAFile: rc.CAFile, InsecureSkipVerify: rc.InsecureSkipVerify, Proxy: rc.Proxy}
+}
+
+// buildTransport returns a dedicated transport for the registry, or nil when
+// it uses the default transport
+func (rc RegistryConfig) buildTransport() (http.RoundTripper, error) {
+	opts := rc.transportOptions()
+	if opts == (TransportOptions{}) {
+		return nil, nil
+	}
+	transport, err := newRegistryTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+// validateScope checks a registries key. Keys of the form registry/prefix
+// scope credentials to repositories under prefix and cannot hold client
+// settings, which apply to the whole registry.
+func (rc RegistryConfig) validateScope(key string) error {
+	_, prefix, scoped := strings.Cut(key, "/")
+	if !scoped {
+		return nil
+	}
+	if err := validateRepository(strings.Trim(prefix, "/")); err != nil {
+		return fmt.Errorf("invalid repository prefix: %w", err)
+	}
+	if rc.Retry != (RetryConfig{}) || len(rc.Mirrors) > 0 || rc.PlainHTTP || rc.OAuth2 || rc.transportOptions() != (TransportOptions{}) {
+		return fmt.Errorf("repository prefixes can only set credentials")
+	}
+	return nil
+}
+
+// credentialSource returns where the registry's credentials come from, or nil
+// if none are configured
+func (rc RegistryConfig) credentialSource() (CredentialSource, error) {
+	passwordSources := 0
+	for _, value := range []string{rc.Password, rc.PasswordEnv, rc.PasswordFile} {
+		if value != "" {
+			passwordSources++
+		}
+	}
+	if passwordSources > 1 {
+		return nil, fmt.Errorf("only one of password, password_env and password_file can be set")
+	}
+	if rc.Username != "" && rc.UsernameEnv != "" {
+		return nil, fmt.Errorf("only one of username and username_env can be set")
+	}
+
+	if rc.CredentialHelper != "" {
+		if passwordSources > 0 || rc.Username != "" || rc.UsernameEnv != "" {
+			return nil, fmt.Errorf("credential_helper cannot be combined with a username or password")
+		}
+		if !credentialHelperPattern.MatchString(rc.CredentialHelper) {
+			return nil, fmt.Errorf("invalid credential_helper: %q", rc.CredentialHelper)
+		}
+		return CredentialHelper{Name: rc.CredentialHelper}, nil
+	}
+	if rc.UsernameEnv == "" && rc.PasswordEnv == "" && rc.PasswordFile == "" {
+		if rc.Username == "" && rc.Password == "" {
+			return nil, nil
+		}
+		return StaticCredentials{Username: rc.Username, Password: rc.Password}, nil
+	}
+	return SecretCredentials{
+		Username:     rc.Username,
+		UsernameEnv:  rc.UsernameEnv,
+		Password:     rc.Password,
+		PasswordEnv:  rc.PasswordEnv,
+		PasswordFile: rc.PasswordFile,
+	}, nil
+}
+
+// parseMirrors parses the configured mirrors of a registry
+func (rc RegistryConfig) parseMirrors(trusted *TrustedRegistries) ([]RegistryMirror, error) {
+	mirrors := make([]RegistryMirror, 0, len(rc.Mirrors))
+	for _, value := range rc.Mirrors {
+		mirror, err := parseRegistryMirror(value, trusted)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors, nil
+}
+
+// RetryConfig controls how failed upstream requests are retried.
+// Unset fields in a registry's retry section inherit the global values.
+type RetryConfig struct {
+	// MaxAttempts counts the first attempt; 0 leaves it unset
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+// withDefaults fills unset fields from base
+func (r RetryConfig) withDefaults(base RetryConfig) RetryConfig {
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = base.MaxAttempts
+	}
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = base.InitialBackoff
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = base.MaxBackoff
+	}
+	return r
+}
+
+// validate checks that the retry settings are usable
+func (r RetryConfig) validate() error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("invalid max_attempts: %d (must be at least 1, or 0 for the default)", r.MaxAttempts)
+	}
+	if r.InitialBackoff < 0 || r.MaxBackoff < 0 {
+		return fmt.Errorf("retry backoff durations cannot be negative")
+	}
+	return nil
 }
 
 // LoadConfig loads configuration from a YAML file
@@ -51,6 +282,16 @@ func (c *Config) ApplyDefaults() {
 	if c.MaxCacheAge == 0 {
 		c.MaxCacheAge = 48 * time.Hour
 	}
+	if c.RevalidateInterval == 0 {
+		c.RevalidateInterval = defaultRevalidateInterval
+	}
+	if c.MaxConcurrentLayers == 0 {
+		c.MaxConcurrentLayers = defaultMaxConcurrentLayers
+	}
+	if c.MaxConcurrentDownloads == 0 {
+		c.MaxConcurrentDownloads = defaultMaxConcurrentDownloads
+	}
+	c.Retry = c.Retry.withDefaults(DefaultRetryConfig())
 }
 
 // Validate checks if the configuration is valid
@@ -58,12 +299,125 @@ func (c *Config) Validate() error {
 	if c.Port < 1 || c.Port > 65535 {
 		return fmt.Errorf("invalid port: %d (must be between 1 and 65535)", c.Port)
 	}
+	if c.RevalidateInterval < 0 {
+		return fmt.Errorf("invalid revalidate_interval: %s (cannot be negative)", c.RevalidateInterval)
+	}
+	if _, err := NewCacheTTLPolicy(c.CacheTTL); err != nil {
+		return fmt.Errorf("invalid cache_ttl: %w", err)
+	}
+	if c.MaxConcurrentLayers < 1 {
+		return fmt.Errorf("invalid max_concurrent_layers: %d (must be at least 1)", c.MaxConcurrentLayers)
+	}
+	if c.MaxConcurrentDownloads < 1 {
+		return fmt.Errorf("invalid max_concurrent_downloads: %d (must be at least 1)", c.MaxConcurrentDownloads)
+	}
+	if err := c.Retry.validate(); err != nil {
+		return fmt.Errorf("invalid retry settings: %w", err)
+	}
+	trusted, err := ParseTrustedRegistries(c.TrustedPrivateRegistries)
+	if err != nil {
+		return fmt.Errorf("invalid trusted_private_registries: %w", err)
+	}
+	if _, err := NewImagePolicy(c.Policy.Allow, c.Policy.Deny); err != nil {
+		return fmt.Errorf("invalid policy: %w", err)
+	}
+	if _, err := expandHome(c.DockerConfig); err != nil {
+		return fmt.Errorf("invalid docker_config: %w", err)
+	}
+	for registry, rc := range c.Registries {
+		if err := rc.validateScope(registry); err != nil {
+			return fmt.Errorf("invalid registry %s: %w", registry, err)
+		}
+		if err := rc.Retry.validate(); err != nil {
+			return fmt.Errorf("invalid retry settings for registry %s: %w", registry, err)
+		}
+		if _, err := rc.credentialSource(); err != nil {
+			return fmt.Errorf("invalid credentials for registry %s: %w", registry, err)
+		}
+		if _, err := rc.parseMirrors(trusted); err != nil {
+			return fmt.Errorf("invalid mirrors for registry %s: %w", registry, err)
+		}
+		if _, err := rc.buildTransport(); err != nil {
+			return fmt.Errorf("invalid transport settings for registry %s: %w", registry, err)
+		}
+	}
 	return nil
 }
 
-// ApplyCredentials registers all configured registry credentials
-func (c *Config) ApplyCredentials() {
-	for registry, creds := range c.Registries {
-		SetCredentials(registry, creds.Username, creds.Password)
+// ConfigureCredentials registers the configured credential sources in store.
+// Nothing is resolved until a registry is contacted.
+func (c *Config) ConfigureCredentials(store *CredentialStore) {
+	// Checked by Validate
+	for registry, rc := range c.Registries {
+		if source, _ := rc.credentialSource(); source != nil {
+			store.Set(registry, source, rc.AnonymousFallback)
+		}
 	}
+	if c.DockerConfig != "" {
+		path, _ := expandHome(c.DockerConfig)
+		store.SetFallback(DockerConfigCredentials{Path: path})
+	}
+}
+
+// ApplyRegistrySettings registers the default and per-registry client settings
+func (c *Config) ApplyRegistrySettings() {
+	SetDefaultRegistrySettings(RegistrySettings{Retry: c.Retry})
+	// Trusted registries, mirrors and transport settings were checked by Validate
+	trusted, _ := ParseTrustedRegistries(c.TrustedPrivateRegistries)
+	for registry, rc := range c.Registries {
+		if strings.Contains(registry, "/") {
+			// Repository scopes only carry credentials
+			continue
+		}
+		mirrors, _ := rc.parseMirrors(trusted)
+		transport, _ := rc.buildTransport()
+		SetRegistrySettings(registry, RegistrySettings{
+			Retry:     rc.Retry.withDefaults(c.Retry),
+			Mirrors:   mirrors,
+			Transport: transport,
+			PlainHTTP: rc.PlainHTTP,
+			OAuth2:    rc.OAuth2,
+		})
+	}
+}
+
+// ApplyTrustedRegistries exempts the configured private registries from the SSRF checks
+func (c *Config) ApplyTrustedRegistries() {
+	// Checked by Validate
+	trusted, _ := ParseTrustedRegistries(c.TrustedPrivateRegistries)
+	SetTrustedRegistries(trusted)
+}
+
+// ApplyImagePolicy restricts the images that can be requested
+func (c *Config) ApplyImagePolicy() {
+	// Checked by Validate
+	policy, _ := NewImagePolicy(c.Policy.Allow, c.Policy.Deny)
+	SetImagePolicy(policy)
+}
+
+// ApplyDownloadLimits configures layer download concurrency
+func (c *Config) ApplyDownloadLimits() {
+	SetDownloadLimits(c.MaxConcurrentLayers, c.MaxConcurrentDownloads)
+}
+
+// ApplyRevalidateInterval configures how often cached archives of tags are revalidated
+func (c *Config) ApplyRevalidateInterval() {
+	SetRevalidateInterval(c.RevalidateInterval)
+}
+
+// ApplyTempDir sets where archives are assembled
+func (c *Config) ApplyTempDir() {
+	SetTempDir(c.TempDir)
+}
+
+// ApplyCacheSizeLimit sets the disk space the cache may use before archives are evicted
+func (c *Config) ApplyCacheSizeLimit() {
+	SetMaxCacheSize(int64(c.MaxCacheSize))
+}
+
+// ApplyCacheTTLPolicy sets the per-repository and per-tag cache lifetimes
+func (c *Config) ApplyCacheTTLPolicy() {
+	// Checked by Validate
+	policy, _ := NewCacheTTLPolicy(c.CacheTTL)
+	SetCacheTTLPolicy(policy)
 }
@@ -3,7 +3,10 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -80,6 +83,121 @@ func TestLoadConfig_Defaults(t *testing.T) {
 	if config.Port != 8080 {
 		t.Errorf("expected default port 8080, got %d", config.Port)
 	}
+	if config.MaxConcurrentLayers != defaultMaxConcurrentLayers {
+		t.Errorf("expected default max_concurrent_layers %d, got %d", defaultMaxConcurrentLayers, config.MaxConcurrentLayers)
+	}
+	if config.MaxConcurrentDownloads != defaultMaxConcurrentDownloads {
+		t.Errorf("expected default max_concurrent_downloads %d, got %d", defaultMaxConcurrentDownloads, config.MaxConcurrentDownloads)
+	}
+	if config.RevalidateInterval != defaultRevalidateInterval {
+		t.Errorf("expected default revalidate_interval %s, got %s", defaultRevalidateInterval, config.RevalidateInterval)
+	}
+}
+
+func TestLoadConfig_CacheTTL(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	configContent := `
+cache_ttl:
+  - repository: docker.io/library/*
+    tag: latest|edge
+    max_age: 6h
+    revalidate_interval: 1m
+  - tag: '\d+\.\d+\.\d+'
+    max_age: 2160h
+`
+	configPath := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	config.ApplyCacheTTLPolicy()
+	defer SetCacheTTLPolicy(nil)
+
+	if got := cacheMaxAge(ParseImageReference("nginx:edge"), config.MaxCacheAge); got != 6*time.Hour {
+		t.Errorf("expected max age 6h for nginx:edge, got %s", got)
+	}
+	if got := cacheMaxAge(ParseImageReference("ghcr.io/org/app:1.2.3"), config.MaxCacheAge); got != 2160*time.Hour {
+		t.Errorf("expected max age 2160h for a release tag, got %s", got)
+	}
+
+	if err := os.WriteFile(configPath, []byte("cache_ttl:\n  - tag: latest\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("expected error for a cache_ttl rule without durations")
+	}
+}
+
+func TestLoadConfig_MaxCacheSize(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	configPath := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte("max_cache_size: 50GB"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if config.MaxCacheSize != 50<<30 {
+		t.Errorf("expected max_cache_size of 50 GB, got %d", config.MaxCacheSize)
+	}
+
+	if err := os.WriteFile(configPath, []byte("max_cache_size: 50 gigs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("expected error for an unknown max_cache_size unit")
+	}
+}
+
+func TestLoadConfig_InvalidRevalidateInterval(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	configPath := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte("revalidate_interval: -1m"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("expected error for negative revalidate_interval")
+	}
+}
+
+func TestLoadConfig_InvalidConcurrency(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	for _, content := range []string{"max_concurrent_layers: -1", "max_concurrent_downloads: -5"} {
+		configPath := filepath.Join(tempDir, "config.yaml")
+		if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadConfig(configPath); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
 }
 
 func TestLoadConfig_InvalidPort(t *testing.T) {
@@ -127,7 +245,7 @@ func TestLoadConfig_InvalidYAML(t *testing.T) {
 	}
 }
 
-func TestApplyCredentials(t *testing.T) {
+func TestConfigureCredentials_Inline(t *testing.T) {
 	config := &Config{
 		Port: 8080,
 		Registries: map[string]RegistryConfig{
@@ -138,11 +256,12 @@ func TestApplyCredentials(t *testing.T) {
 		},
 	}
 
-	config.ApplyCredentials()
+	store := NewCredentialStore()
+	config.ConfigureCredentials(store)
 
-	creds, ok := GetCredentials("ghcr.io")
-	if !ok {
-		t.Error("expected credentials for ghcr.io")
+	creds, ok, err := store.Lookup("ghcr.io", "")
+	if err != nil || !ok {
+		t.Errorf("expected credentials for ghcr.io, got %v, %v", ok, err)
 	}
 	if creds.Username != "testuser" {
 		t.Errorf("expected username 'testuser', got '%s'", creds.Username)
@@ -151,3 +270,347 @@ func TestApplyCredentials(t *testing.T) {
 		t.Errorf("expected password 'testpass', got '%s'", creds.Password)
 	}
 }
+
+func TestConfigureCredentials(t *testing.T) {
+	t.Setenv("TEST_QUAY_TOKEN", "quay-token")
+	config := &Config{
+		Registries: map[string]RegistryConfig{
+			"quay.io":              {Username: "robot", PasswordEnv: "TEST_QUAY_TOKEN"},
+			"flaky.example.com":    {Retry: RetryConfig{MaxAttempts: 3}},
+			"registry.example.com": {CredentialHelper: "ecr-login"},
+		},
+		DockerConfig: "/nonexistent/config.json",
+	}
+
+	store := NewCredentialStore()
+	config.ConfigureCredentials(store)
+
+	creds, ok, err := store.Lookup("quay.io", "robot/app")
+	if err != nil || !ok || creds.Password != "quay-token" {
+		t.Errorf("expected password from environment, got %+v, %v, %v", creds, ok, err)
+	}
+	// Registries without credentials fall back to the docker config, which is missing
+	if _, ok, err := store.Lookup("flaky.example.com", "app"); ok || err != nil {
+		t.Errorf("expected no credentials for registry without any, got %v, %v", ok, err)
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if _, ok := store.entries["registry.example.com"].source.(CredentialHelper); !ok {
+		t.Error("expected credential helper source for registry.example.com")
+	}
+}
+
+func TestRegistryConfig_CredentialSource_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RegistryConfig
+	}{
+		{name: "two passwords", config: RegistryConfig{Username: "u", Password: "p", PasswordFile: "/run/secrets/p"}},
+		{name: "two usernames", config: RegistryConfig{Username: "u", UsernameEnv: "USER", PasswordEnv: "PASS"}},
+		{name: "helper with password", config: RegistryConfig{CredentialHelper: "ecr-login", Password: "p"}},
+		{name: "invalid helper", config: RegistryConfig{CredentialHelper: "../../bin/sh"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Port: 8080, MaxConcurrentLayers: 1, MaxConcurrentDownloads: 1,
+				Registries: map[string]RegistryConfig{"registry.example.com": tt.config}}
+			if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "invalid credentials") {
+				t.Errorf("expected invalid credentials error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyRegistrySettings(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	configContent := `
+retry:
+  max_attempts: 6
+  initial_backoff: 2s
+registries:
+  flaky.example.com:
+    retry:
+      max_attempts: 10
+  docker.io:
+    mirrors:
+      - mirror.gcr.io
+      - harbor.example.com/dockerhub-proxy
+  registry.internal.example.com:
+    plain_http: true
+    oauth2: true
+    proxy: socks5://proxy.example.com:1080
+`
+	configPath := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	config.ApplyRegistrySettings()
+	defer SetDefaultRegistrySettings(RegistrySettings{Retry: DefaultRetryConfig()})
+	defer SetRegistrySettings("docker.io", RegistrySettings{Retry: DefaultRetryConfig()})
+	defer SetRegistrySettings("registry.internal.example.com", RegistrySettings{Retry: DefaultRetryConfig()})
+
+	flaky := GetRegistrySettings("flaky.example.com").Retry
+	if flaky.MaxAttempts != 10 {
+		t.Errorf("expected registry max_attempts 10, got %d", flaky.MaxAttempts)
+	}
+	if flaky.InitialBackoff != 2*time.Second {
+		t.Errorf("expected inherited initial_backoff 2s, got %v", flaky.InitialBackoff)
+	}
+	if flaky.MaxBackoff != DefaultRetryConfig().MaxBackoff {
+		t.Errorf("expected default max_backoff, got %v", flaky.MaxBackoff)
+	}
+
+	other := GetRegistrySettings("other.example.com").Retry
+	if other.MaxAttempts != 6 {
+		t.Errorf("expected global max_attempts 6 for unconfigured registry, got %d", other.MaxAttempts)
+	}
+
+	mirrors := GetRegistrySettings("registry-1.docker.io").Mirrors
+	expected := []RegistryMirror{{Host: "mirror.gcr.io"}, {Host: "harbor.example.com", Prefix: "dockerhub-proxy"}}
+	if !reflect.DeepEqual(mirrors, expected) {
+		t.Errorf("expected mirrors %v, got %v", expected, mirrors)
+	}
+
+	internal := GetRegistrySettings("registry.internal.example.com")
+	if !internal.PlainHTTP || !internal.OAuth2 {
+		t.Error("expected plain_http and oauth2 to be applied")
+	}
+	if internal.Transport == nil {
+		t.Error("expected a dedicated transport for a registry with a proxy")
+	}
+	if GetRegistrySettings("flaky.example.com").Transport != nil {
+		t.Error("expected registries without transport settings to use the default transport")
+	}
+}
+
+func TestLoadConfig_InvalidMirror(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	configContent := `
+registries:
+  docker.io:
+    mirrors:
+      - 10.0.0.5:5000
+`
+	configPath := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(configPath); err == nil || !strings.Contains(err.Error(), "invalid mirrors") {
+		t.Errorf("expected invalid mirrors error, got %v", err)
+	}
+}
+
+func TestLoadConfig_InvalidTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry string
+	}{
+		{name: "missing ca file", registry: "ca_file: /nonexistent/ca.pem"},
+		{name: "unsupported proxy scheme", registry: "proxy: ftp://proxy.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "config-test-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupTempDir(t, tempDir)
+
+			configContent := "registries:\n  registry.example.com:\n    " + tt.registry + "\n"
+			configPath := filepath.Join(tempDir, "config.yaml")
+			if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := LoadConfig(configPath); err == nil || !strings.Contains(err.Error(), "invalid transport settings") {
+				t.Errorf("expected invalid transport settings error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_TrustedPrivateRegistries(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "trusted mirror",
+			content: "trusted_private_registries:\n  - 10.0.0.0/8\nregistries:\n  docker.io:\n    mirrors:\n      - 10.0.0.5:5000\n",
+		},
+		{
+			name:    "invalid entry",
+			content: "trusted_private_registries:\n  - 10.0.0.5:5000\n",
+			wantErr: "invalid trusted_private_registries",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(tempDir, "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfig(configPath)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_InvalidPolicy(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	configContent := `
+policy:
+  allow:
+    - docker.io/library/[a-z]*
+`
+	configPath := filepath.Join(tempDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(configPath); err == nil || !strings.Contains(err.Error(), "invalid policy") {
+		t.Errorf("expected invalid policy error, got %v", err)
+	}
+}
+
+func TestLoadConfig_RepositoryScopedCredentials(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "scoped credentials",
+			content: "registries:\n  ghcr.io/org-a:\n    username: a\n    password: p\n    anonymous_fallback: true\n  ghcr.io:\n    retry:\n      max_attempts: 2\n",
+		},
+		{
+			name:    "scoped client settings",
+			content: "registries:\n  ghcr.io/org-a:\n    plain_http: true\n",
+			wantErr: "repository prefixes can only set credentials",
+		},
+		{
+			name:    "invalid prefix",
+			content: "registries:\n  ghcr.io/Org A:\n    username: a\n",
+			wantErr: "invalid repository prefix",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(tempDir, "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			config, err := LoadConfig(configPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			store := NewCredentialStore()
+			config.ConfigureCredentials(store)
+			creds, found, err := store.Lookup("ghcr.io", "org-a/app")
+			if err != nil || !found || creds.Username != "a" || !creds.AnonymousFallback {
+				t.Errorf("expected scoped credentials with anonymous fallback, got %+v, %v, %v", creds, found, err)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ByteSize
+		wantErr bool
+	}{
+		{input: "1024", want: 1024},
+		{input: "512B", want: 512},
+		{input: "1KB", want: 1024},
+		{input: "1.5 GB", want: 3 << 29},
+		{input: "50gb", want: 50 << 30},
+		{input: "2TB", want: 2 << 40},
+		{input: "10GiB", wantErr: true},
+		{input: "GB", wantErr: true},
+		{input: "-1GB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseByteSize(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseByteSize(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseByteSize(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		retry   RetryConfig
+		wantErr bool
+	}{
+		{name: "unset uses the default", retry: RetryConfig{}},
+		{name: "single attempt", retry: RetryConfig{MaxAttempts: 1}},
+		{name: "negative attempts", retry: RetryConfig{MaxAttempts: -1}, wantErr: true},
+		{name: "negative backoff", retry: RetryConfig{InitialBackoff: -time.Second}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.retry.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
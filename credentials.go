@@ -1,45 +1,339 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
+	"time"
 )
 
+// credentialHelperTimeout bounds how long a docker-credential-* helper may run
+const credentialHelperTimeout = 30 * time.Second
+
+// dockerHubAuthKey is the key Docker Hub credentials are stored under in
+// ~/.docker/config.json and the server URL credential helpers expect for it
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// credentialHelperPattern restricts helper names so they can only select a
+// docker-credential-<name> binary from PATH
+var credentialHelperPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// identityTokenUsername is the username credential helpers return alongside
+// an identity token instead of a password
+const identityTokenUsername = "<token>"
+
 // RegistryCredentials holds authentication credentials for a registry
 type RegistryCredentials struct {
 	Username string
 	Password string
+	// IdentityToken is an OAuth2 refresh token used instead of the password
+	IdentityToken string
+}
+
+// CredentialSource resolves the credentials of a registry when they are needed.
+// ok is false when the source has no credentials for the registry.
+type CredentialSource interface {
+	Resolve(registry string) (creds RegistryCredentials, ok bool, err error)
+}
+
+// StaticCredentials are credentials given inline
+type StaticCredentials RegistryCredentials
+
+// Resolve returns the inline credentials
+func (s StaticCredentials) Resolve(string) (RegistryCredentials, bool, error) {
+	return RegistryCredentials(s), true, nil
+}
+
+// SecretCredentials read each part of the credentials from an environment
+// variable, a file or a literal value, in that order of preference. Values
+// are read on every lookup so rotated secrets are picked up.
+type SecretCredentials struct {
+	Username     string
+	UsernameEnv  string
+	Password     string
+	PasswordEnv  string
+	PasswordFile string
+}
+
+// Resolve reads the username and password from their configured sources
+func (s SecretCredentials) Resolve(string) (RegistryCredentials, bool, error) {
+	username, err := readSecret(s.Username, s.UsernameEnv, "")
+	if err != nil {
+		return RegistryCredentials{}, false, fmt.Errorf("username: %w", err)
+	}
+	password, err := readSecret(s.Password, s.PasswordEnv, s.PasswordFile)
+	if err != nil {
+		return RegistryCredentials{}, false, fmt.Errorf("password: %w", err)
+	}
+	return RegistryCredentials{Username: username, Password: password}, true, nil
+}
+
+// readSecret returns value, the content of the environment variable env, or
+// the content of file, whichever is configured
+func readSecret(value, env, file string) (string, error) {
+	switch {
+	case env != "":
+		secret, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return secret, nil
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// CredentialHelper runs docker-credential-<Name> to obtain credentials
+type CredentialHelper struct {
+	Name string
+}
+
+// Resolve asks the helper for the registry's credentials
+func (h CredentialHelper) Resolve(registry string) (RegistryCredentials, bool, error) {
+	if !credentialHelperPattern.MatchString(h.Name) {
+		return RegistryCredentials{}, false, fmt.Errorf("invalid credential helper name: %q", h.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), credentialHelperTimeout)
+	defer cancel()
+
+	serverURL := registry
+	if normalizeRegistry(registry) == dockerHubRegistry {
+		serverURL = dockerHubAuthKey
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker-credential-"+h.Name, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Helpers report a missing entry on stdout and exit non-zero
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return RegistryCredentials{}, false, nil
+		}
+		return RegistryCredentials{}, false, fmt.Errorf("credential helper %s failed: %w: %s", h.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return RegistryCredentials{}, false, fmt.Errorf("credential helper %s returned invalid output: %w", h.Name, err)
+	}
+	if resp.Username == identityTokenUsername {
+		return RegistryCredentials{IdentityToken: resp.Secret}, true, nil
+	}
+	return RegistryCredentials{Username: resp.Username, Password: resp.Secret}, true, nil
+}
+
+// DockerConfigCredentials look up credentials in a Docker CLI config.json,
+// using its auths section, per-registry credHelpers and the default credsStore.
+// The file is read on every lookup.
+type DockerConfigCredentials struct {
+	Path string
+}
+
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
 }
 
-// CredentialStore manages credentials for multiple registries
+// Resolve returns the credentials config.json holds for registry
+func (d DockerConfigCredentials) Resolve(registry string) (RegistryCredentials, bool, error) {
+	data, err := os.ReadFile(d.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return RegistryCredentials{}, false, nil
+	}
+	if err != nil {
+		return RegistryCredentials{}, false, fmt.Errorf("failed to read docker config: %w", err)
+	}
+	var config dockerConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return RegistryCredentials{}, false, fmt.Errorf("failed to parse docker config %s: %w", d.Path, err)
+	}
+
+	registry = normalizeRegistry(registry)
+	for key, helper := range config.CredHelpers {
+		if dockerConfigRegistry(key) == registry {
+			return CredentialHelper{Name: helper}.Resolve(registry)
+		}
+	}
+	for key, auth := range config.Auths {
+		if dockerConfigRegistry(key) != registry {
+			continue
+		}
+		if auth.IdentityToken != "" {
+			return RegistryCredentials{IdentityToken: auth.IdentityToken}, true, nil
+		}
+		if auth.Auth == "" {
+			if auth.Username == "" {
+				continue
+			}
+			return RegistryCredentials{Username: auth.Username, Password: auth.Password}, true, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return RegistryCredentials{}, false, fmt.Errorf("invalid auth entry for %s in docker config: %w", key, err)
+		}
+		username, password, found := strings.Cut(string(decoded), ":")
+		if !found {
+			return RegistryCredentials{}, false, fmt.Errorf("invalid auth entry for %s in docker config", key)
+		}
+		return RegistryCredentials{Username: username, Password: password}, true, nil
+	}
+	if config.CredsStore != "" {
+		return CredentialHelper{Name: config.CredsStore}.Resolve(registry)
+	}
+	return RegistryCredentials{}, false, nil
+}
+
+// dockerConfigRegistry turns a config.json key such as https://ghcr.io or
+// https://index.docker.io/v1/ into a registry hostname
+func dockerConfigRegistry(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ := strings.Cut(key, "/")
+	return normalizeRegistry(host)
+}
+
+// expandHome replaces a leading ~/ in path with the user's home directory
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[2:]), nil
+}
+
+// CredentialStore maps registries, or repository prefixes within a registry,
+// to the sources of their credentials. Credentials are resolved when a
+// registry is contacted, not when configured.
 type CredentialStore struct {
-	credentials map[string]RegistryCredentials
-	mu          sync.RWMutex
+	// entries are keyed by scope: a normalized registry, optionally followed by
+	// a /-separated repository prefix such as ghcr.io/org-a
+	entries map[string]credentialEntry
+	// fallback is consulted for registries without a source of their own
+	fallback CredentialSource
+	mu       sync.RWMutex
 }
 
-var globalCredentialStore = &CredentialStore{
-	credentials: make(map[string]RegistryCredentials),
+// credentialEntry is a configured credential source and how it may be used
+type credentialEntry struct {
+	source            CredentialSource
+	anonymousFallback bool
 }
 
-// SetCredentials sets credentials for a specific registry
-func SetCredentials(registry string, username, password string) {
-	globalCredentialStore.mu.Lock()
-	defer globalCredentialStore.mu.Unlock()
-	globalCredentialStore.credentials[normalizeRegistry(registry)] = RegistryCredentials{
-		Username: username,
-		Password: password,
+// ScopedCredentials are the credentials chosen for a repository
+type ScopedCredentials struct {
+	RegistryCredentials
+	// Scope is the registry or registry/prefix the credentials were configured for
+	Scope string
+	// AnonymousFallback allows retrying anonymously when the credentials are rejected
+	AnonymousFallback bool
+}
+
+// NewCredentialStore creates an empty credential store
+func NewCredentialStore() *CredentialStore {
+	return &CredentialStore{entries: make(map[string]credentialEntry)}
+}
+
+// Set sets the credential source for a registry or a registry/prefix scope.
+// With anonymousFallback, rejected credentials are followed by an anonymous attempt.
+func (s *CredentialStore) Set(scope string, source CredentialSource, anonymousFallback bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[normalizeCredentialScope(scope)] = credentialEntry{source: source, anonymousFallback: anonymousFallback}
+}
+
+// SetFallback sets the source used for registries without their own source
+func (s *CredentialStore) SetFallback(source CredentialSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = source
+}
+
+// Lookup resolves the credentials for a repository, preferring the longest
+// matching repository prefix, then the registry, then the fallback source. A
+// nil store has no credentials.
+func (s *CredentialStore) Lookup(registry, repository string) (ScopedCredentials, bool, error) {
+	if s == nil {
+		return ScopedCredentials{}, false, nil
+	}
+	scope, entry, ok := s.match(registry, repository)
+	if !ok {
+		return ScopedCredentials{}, false, nil
 	}
+	creds, found, err := entry.source.Resolve(registry)
+	if err != nil {
+		return ScopedCredentials{}, false, fmt.Errorf("failed to resolve credentials for %s: %w", scope, err)
+	}
+	return ScopedCredentials{RegistryCredentials: creds, Scope: scope, AnonymousFallback: entry.anonymousFallback}, found, nil
+}
+
+// match finds the most specific entry for a repository
+func (s *CredentialStore) match(registry, repository string) (string, credentialEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	registry = normalizeRegistry(registry)
+	prefix := repository
+	for prefix != "" {
+		scope := registry + "/" + prefix
+		if entry, ok := s.entries[scope]; ok {
+			return scope, entry, true
+		}
+		idx := strings.LastIndex(prefix, "/")
+		if idx == -1 {
+			break
+		}
+		prefix = prefix[:idx]
+	}
+	if entry, ok := s.entries[registry]; ok {
+		return registry, entry, true
+	}
+	if s.fallback != nil {
+		return registry, credentialEntry{source: s.fallback}, true
+	}
+	return "", credentialEntry{}, false
 }
 
-// GetCredentials retrieves credentials for a specific registry
-func GetCredentials(registry string) (RegistryCredentials, bool) {
-	globalCredentialStore.mu.RLock()
-	defer globalCredentialStore.mu.RUnlock()
-	creds, ok := globalCredentialStore.credentials[normalizeRegistry(registry)]
-	return creds, ok
+// normalizeCredentialScope normalizes the registry part of a registry[/prefix] scope
+func normalizeCredentialScope(scope string) string {
+	registry, prefix, found := strings.Cut(scope, "/")
+	registry = normalizeRegistry(registry)
+	if !found {
+		return registry
+	}
+	return registry + "/" + strings.Trim(prefix, "/")
 }
 
-// normalizeRegistry normalizes registry names for consistent lookup
+// normalizeRegistry normalizes registry names for consistent lookup. Hostnames
+// are case-insensitive and 443 is the default HTTPS port, so GHCR.IO and
+// ghcr.io:443 name the same registry as ghcr.io.
 func normalizeRegistry(registry string) string {
+	registry = strings.TrimSuffix(strings.ToLower(registry), ":443")
 	switch registry {
 	case "docker.io", "index.docker.io", "registry-1.docker.io":
 		return "registry-1.docker.io"
@@ -1,20 +1,25 @@
 package main
 
 import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 )
 
-func TestSetAndGetCredentials(t *testing.T) {
-	globalCredentialStore.mu.Lock()
-	globalCredentialStore.credentials = make(map[string]RegistryCredentials)
-	globalCredentialStore.mu.Unlock()
+// setCredentials sets inline credentials for a registry in store
+func setCredentials(store *CredentialStore, registry, username, password string) {
+	store.Set(registry, StaticCredentials{Username: username, Password: password}, false)
+}
 
-	SetCredentials("test.registry.io", "testuser", "testpass")
+func TestSetAndGetCredentials(t *testing.T) {
+	store := NewCredentialStore()
+	setCredentials(store, "test.registry.io", "testuser", "testpass")
 
-	creds, ok := GetCredentials("test.registry.io")
-	if !ok {
-		t.Fatal("expected credentials to exist")
+	creds, ok, err := store.Lookup("test.registry.io", "")
+	if err != nil || !ok {
+		t.Fatalf("expected credentials to exist, got %v, %v", ok, err)
 	}
 	if creds.Username != "testuser" {
 		t.Errorf("expected username 'testuser', got '%s'", creds.Username)
@@ -25,10 +30,13 @@ func TestSetAndGetCredentials(t *testing.T) {
 }
 
 func TestGetCredentials_NotFound(t *testing.T) {
-	_, ok := GetCredentials("nonexistent.registry.io")
-	if ok {
+	if _, ok, _ := NewCredentialStore().Lookup("nonexistent.registry.io", ""); ok {
 		t.Error("expected credentials to not exist")
 	}
+	var none *CredentialStore
+	if _, ok, err := none.Lookup("nonexistent.registry.io", ""); ok || err != nil {
+		t.Errorf("expected a nil store to have no credentials, got %v, %v", ok, err)
+	}
 }
 
 func TestNormalizeRegistry(t *testing.T) {
@@ -54,9 +62,7 @@ func TestNormalizeRegistry(t *testing.T) {
 }
 
 func TestCredentialsConcurrency(t *testing.T) {
-	globalCredentialStore.mu.Lock()
-	globalCredentialStore.credentials = make(map[string]RegistryCredentials)
-	globalCredentialStore.mu.Unlock()
+	store := NewCredentialStore()
 
 	var wg sync.WaitGroup
 	registries := []string{"r1.io", "r2.io", "r3.io", "r4.io", "r5.io"}
@@ -65,7 +71,7 @@ func TestCredentialsConcurrency(t *testing.T) {
 		wg.Add(1)
 		go func(registry string) {
 			defer wg.Done()
-			SetCredentials(registry, "user-"+registry, "pass-"+registry)
+			setCredentials(store, registry, "user-"+registry, "pass-"+registry)
 		}(reg)
 	}
 	wg.Wait()
@@ -74,7 +80,7 @@ func TestCredentialsConcurrency(t *testing.T) {
 		wg.Add(1)
 		go func(registry string) {
 			defer wg.Done()
-			creds, ok := GetCredentials(registry)
+			creds, ok, _ := store.Lookup(registry, "")
 			if !ok {
 				t.Errorf("expected credentials for %s to exist", registry)
 				return
@@ -86,3 +92,227 @@ func TestCredentialsConcurrency(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestSecretCredentials_Resolve(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "credentials-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	passwordFile := filepath.Join(tempDir, "password")
+	if err := os.WriteFile(passwordFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_REGISTRY_USER", "env-user")
+	t.Setenv("TEST_REGISTRY_PASSWORD", "env-secret")
+
+	tests := []struct {
+		name    string
+		source  SecretCredentials
+		want    RegistryCredentials
+		wantErr bool
+	}{
+		{
+			name:   "environment",
+			source: SecretCredentials{UsernameEnv: "TEST_REGISTRY_USER", PasswordEnv: "TEST_REGISTRY_PASSWORD"},
+			want:   RegistryCredentials{Username: "env-user", Password: "env-secret"},
+		},
+		{
+			name:   "password file",
+			source: SecretCredentials{Username: "admin", PasswordFile: passwordFile},
+			want:   RegistryCredentials{Username: "admin", Password: "file-secret"},
+		},
+		{
+			name:    "unset environment variable",
+			source:  SecretCredentials{Username: "admin", PasswordEnv: "TEST_REGISTRY_UNSET"},
+			wantErr: true,
+		},
+		{
+			name:    "missing password file",
+			source:  SecretCredentials{Username: "admin", PasswordFile: filepath.Join(tempDir, "missing")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, ok, err := tt.source.Resolve("registry.example.com")
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil || !ok {
+				t.Fatalf("Resolve() = %v, %v", ok, err)
+			}
+			if creds != tt.want {
+				t.Errorf("Resolve() = %+v, want %+v", creds, tt.want)
+			}
+		})
+	}
+}
+
+func TestDockerConfigCredentials_Resolve(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "credentials-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	configPath := filepath.Join(tempDir, "config.json")
+	configContent := `{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("hubuser:hubpass")) + `"},
+    "ghcr.io": {"username": "ghuser", "password": "ghpass"},
+    "registry.example.com": {"auth": "", "identitytoken": "refresh-token"},
+    "https://quay.io": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("quayuser:quay:pass")) + `"}
+  }
+}`
+	if err := os.WriteFile(configPath, []byte(configContent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	source := DockerConfigCredentials{Path: configPath}
+
+	tests := []struct {
+		registry string
+		want     RegistryCredentials
+		wantOK   bool
+	}{
+		{registry: "registry-1.docker.io", want: RegistryCredentials{Username: "hubuser", Password: "hubpass"}, wantOK: true},
+		{registry: "ghcr.io", want: RegistryCredentials{Username: "ghuser", Password: "ghpass"}, wantOK: true},
+		{registry: "quay.io", want: RegistryCredentials{Username: "quayuser", Password: "quay:pass"}, wantOK: true},
+		{registry: "registry.example.com", want: RegistryCredentials{IdentityToken: "refresh-token"}, wantOK: true},
+		{registry: "gcr.io", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			creds, ok, err := source.Resolve(tt.registry)
+			if err != nil {
+				t.Fatalf("Resolve() error: %v", err)
+			}
+			if ok != tt.wantOK || creds != tt.want {
+				t.Errorf("Resolve() = %+v, %v, want %+v, %v", creds, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	if _, ok, err := (DockerConfigCredentials{Path: filepath.Join(tempDir, "missing.json")}).Resolve("ghcr.io"); ok || err != nil {
+		t.Errorf("expected a missing docker config to have no credentials, got %v, %v", ok, err)
+	}
+}
+
+// installCredentialHelper puts a docker-credential-test script on PATH that
+// knows credentials for ghcr.io only
+func installCredentialHelper(t *testing.T) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "credential-helper-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cleanupTempDir(t, dir) })
+	script := `#!/bin/sh
+read server
+if [ "$server" = "ghcr.io" ]; then
+  echo '{"ServerURL":"ghcr.io","Username":"helper-user","Secret":"helper-secret"}'
+  exit 0
+fi
+echo "credentials not found in native keychain"
+exit 1
+`
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestCredentialHelper_Resolve(t *testing.T) {
+	installCredentialHelper(t)
+	helper := CredentialHelper{Name: "test"}
+
+	creds, ok, err := helper.Resolve("ghcr.io")
+	if err != nil || !ok {
+		t.Fatalf("Resolve() = %v, %v", ok, err)
+	}
+	if creds.Username != "helper-user" || creds.Password != "helper-secret" {
+		t.Errorf("unexpected credentials: %+v", creds)
+	}
+
+	if _, ok, err := helper.Resolve("quay.io"); ok || err != nil {
+		t.Errorf("expected no credentials for an unknown registry, got %v, %v", ok, err)
+	}
+	if _, _, err := (CredentialHelper{Name: "../evil"}).Resolve("ghcr.io"); err == nil {
+		t.Error("expected error for invalid helper name")
+	}
+	if _, _, err := (CredentialHelper{Name: "missing"}).Resolve("ghcr.io"); err == nil {
+		t.Error("expected error for helper that is not installed")
+	}
+}
+
+func TestCredentialStore_Lookup(t *testing.T) {
+	installCredentialHelper(t)
+	store := NewCredentialStore()
+	store.Set("docker.io", StaticCredentials{Username: "hubuser", Password: "hubpass"}, false)
+	store.SetFallback(CredentialHelper{Name: "test"})
+
+	creds, ok, err := store.Lookup("registry-1.docker.io", "library/nginx")
+	if err != nil || !ok || creds.Username != "hubuser" {
+		t.Errorf("expected registry source to be used, got %+v, %v, %v", creds, ok, err)
+	}
+	creds, ok, err = store.Lookup("ghcr.io", "org/app")
+	if err != nil || !ok || creds.Username != "helper-user" {
+		t.Errorf("expected fallback source to be used, got %+v, %v, %v", creds, ok, err)
+	}
+	if _, ok, err := store.Lookup("quay.io", "org/app"); ok || err != nil {
+		t.Errorf("expected no credentials, got %v, %v", ok, err)
+	}
+
+	store.Set("broken.example.com", SecretCredentials{PasswordEnv: "TEST_REGISTRY_UNSET"}, false)
+	if _, _, err := store.Lookup("broken.example.com", "app"); err == nil {
+		t.Error("expected an unresolvable source to return an error")
+	}
+}
+
+func TestCredentialStore_LongestPrefixMatch(t *testing.T) {
+	store := NewCredentialStore()
+	store.Set("ghcr.io", StaticCredentials{Username: "registry"}, false)
+	store.Set("ghcr.io/org-a", StaticCredentials{Username: "org-a"}, false)
+	store.Set("ghcr.io/org-a/team", StaticCredentials{Username: "org-a-team"}, true)
+	store.Set("ghcr.io/org-b/", StaticCredentials{Username: "org-b"}, false)
+	store.Set("docker.io/company", StaticCredentials{Username: "hub-company"}, false)
+
+	tests := []struct {
+		registry   string
+		repository string
+		wantUser   string
+		wantScope  string
+		wantFound  bool
+	}{
+		{registry: "ghcr.io", repository: "org-a/app", wantUser: "org-a", wantScope: "ghcr.io/org-a", wantFound: true},
+		{registry: "ghcr.io", repository: "org-a/team/app", wantUser: "org-a-team", wantScope: "ghcr.io/org-a/team", wantFound: true},
+		{registry: "ghcr.io", repository: "org-b/app", wantUser: "org-b", wantScope: "ghcr.io/org-b", wantFound: true},
+		{registry: "ghcr.io", repository: "org-ab/app", wantUser: "registry", wantScope: "ghcr.io", wantFound: true},
+		{registry: "ghcr.io", repository: "org-c/app", wantUser: "registry", wantScope: "ghcr.io", wantFound: true},
+		{registry: "registry-1.docker.io", repository: "company/app", wantUser: "hub-company", wantScope: "registry-1.docker.io/company", wantFound: true},
+		{registry: "registry-1.docker.io", repository: "library/nginx", wantFound: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.registry+"/"+tt.repository, func(t *testing.T) {
+			creds, found, err := store.Lookup(tt.registry, tt.repository)
+			if err != nil {
+				t.Fatalf("Lookup() error: %v", err)
+			}
+			if found != tt.wantFound || creds.Username != tt.wantUser || (found && creds.Scope != tt.wantScope) {
+				t.Errorf("Lookup() = %+v, %v, want user %q in scope %q", creds, found, tt.wantUser, tt.wantScope)
+			}
+		})
+	}
+
+	creds, _, _ := store.Lookup("ghcr.io", "org-a/team/app")
+	if !creds.AnonymousFallback {
+		t.Error("expected anonymous fallback to be kept for its scope")
+	}
+}
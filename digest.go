@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrDigestMismatch is returned when content does not hash to its expected digest.
+type ErrDigestMismatch struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// digestVerifier hashes everything written to it so the result can be
+// compared against an expected content digest.
+type digestVerifier struct {
+	expected  string
+	algorithm string
+	hash      hash.Hash
+}
+
+// newDigestVerifier creates a verifier for the given "algorithm:hex" digest
+func newDigestVerifier(expected string) (*digestVerifier, error) {
+	algorithm, _, _ := strings.Cut(expected, ":")
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm: %s", algorithm)
+	}
+	return &digestVerifier{expected: expected, algorithm: algorithm, hash: h}, nil
+}
+
+// Write adds p to the running hash
+func (v *digestVerifier) Write(p []byte) (int, error) {
+	return v.hash.Write(p)
+}
+
+// Digest returns the digest of the data written so far
+func (v *digestVerifier) Digest() string {
+	return v.algorithm + ":" + hex.EncodeToString(v.hash.Sum(nil))
+}
+
+// Verify returns an *ErrDigestMismatch if the data written does not match the expected digest
+func (v *digestVerifier) Verify() error {
+	if actual := v.Digest(); actual != v.expected {
+		return &ErrDigestMismatch{Expected: v.expected, Actual: actual}
+	}
+	return nil
+}
+
+// verifyContentDigest checks that data hashes to the given digest
+func verifyContentDigest(data []byte, digest string) error {
+	verifier, err := newDigestVerifier(digest)
+	if err != nil {
+		return err
+	}
+	_, _ = verifier.Write(data)
+	return verifier.Verify()
+}
+
+// verifyFileDigest checks that the file at path hashes to the given digest
+func verifyFileDigest(path, digest string) error {
+	verifier, err := newDigestVerifier(digest)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer closeWithLog(file, "file")
+
+	if _, err := io.Copy(verifier, file); err != nil {
+		return err
+	}
+	return verifier.Verify()
+}
+
+// sha256Digest returns the sha256 digest of data in "sha256:hex" form
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return sha256Prefix + hex.EncodeToString(sum[:])
+}
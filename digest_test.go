@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDigestVerifier(t *testing.T) {
+	// sha256 of "hello"
+	const helloDigest = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	t.Run("Match", func(t *testing.T) {
+		v, err := newDigestVerifier(helloDigest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = v.Write([]byte("hel"))
+		_, _ = v.Write([]byte("lo"))
+		if err := v.Verify(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		v, err := newDigestVerifier(helloDigest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = v.Write([]byte("tampered"))
+		err = v.Verify()
+		mismatch, match := errors.AsType[*ErrDigestMismatch](err)
+		if !match {
+			t.Fatalf("expected ErrDigestMismatch, got %v", err)
+		}
+		if mismatch.Expected != helloDigest {
+			t.Errorf("expected Expected %q, got %q", helloDigest, mismatch.Expected)
+		}
+		if !strings.HasPrefix(mismatch.Actual, "sha256:") {
+			t.Errorf("unexpected Actual %q", mismatch.Actual)
+		}
+	})
+
+	t.Run("UnsupportedAlgorithm", func(t *testing.T) {
+		if _, err := newDigestVerifier("md5:abc"); err == nil {
+			t.Error("expected error for unsupported algorithm")
+		}
+	})
+}
+
+func TestVerifyContentDigest(t *testing.T) {
+	good := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	if err := verifyContentDigest([]byte("hello"), good); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := verifyContentDigest([]byte("tampered"), good); err == nil {
+		t.Error("expected digest mismatch error")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// cacheSpaceFactor is how many times the compressed size of an image a
+	// build may need in the cache directory: each layer is stored compressed
+	// and decompressed, and packed again into the archive
+	cacheSpaceFactor = 3
+	// tempSpaceFactor is how many times the compressed size of an image a
+	// build may need in the temporary directory, which holds the compressed and
+	// decompressed layers. They are hard links to the stored copies when both
+	// directories are on the same filesystem, taking no extra space.
+	tempSpaceFactor = 2
+)
+
+// availableSpace returns the bytes available on the filesystem holding dir,
+// or false if it can't be determined. It is a variable so that tests can
+// simulate a full disk.
+var availableSpace = filesystemAvailableSpace
+
+// ErrInsufficientStorage is returned when a build would not fit on the
+// filesystem holding the temporary or the cache directory
+type ErrInsufficientStorage struct {
+	// Location names the directory for clients, Dir is its path
+	Location  string
+	Dir       string
+	Required  int64
+	Available int64
+}
+
+func (e *ErrInsufficientStorage) Error() string {
+	return fmt.Sprintf("insufficient storage: building the image needs about %s in the %s, only %s available",
+		humanizeBytes(e.Required), e.Location, humanizeBytes(e.Available))
+}
+
+// imageSize returns the compressed size of the images' configs and layers,
+// counting blobs shared between them once
+func imageSize(manifests ...*ManifestV2) int64 {
+	seen := make(map[string]bool)
+	var size int64
+	add := func(digest string, blobSize int64) {
+		if !seen[digest] {
+			seen[digest] = true
+			size += blobSize
+		}
+	}
+	for _, manifest := range manifests {
+		add(manifest.Config.Digest, manifest.Config.Size)
+		for _, layer := range manifest.Layers {
+			add(layer.Digest, layer.Size)
+		}
+	}
+	return size
+}
+
+// sameFilesystem reports whether two directories are on the same filesystem
+func sameFilesystem(a, b string) bool {
+	idA, okA := filesystemID(a)
+	idB, okB := filesystemID(b)
+	return okA && okB && idA == idB
+}
+
+// checkBuildSpace checks that the temporary directory and outputDir have room
+// to build an archive of images with the given compressed size, so that a
+// build is refused up front instead of failing halfway with ENOSPC. When both
+// are on the same filesystem it is checked once, for the cache directory.
+func checkBuildSpace(outputDir string, size int64) error {
+	tempDir := buildTempDir()
+	checks := []struct {
+		location, dir string
+		required      int64
+	}{
+		{"temporary directory", tempDir, size * tempSpaceFactor},
+		{"cache directory", outputDir, size * cacheSpaceFactor},
+	}
+	if sameFilesystem(tempDir, outputDir) {
+		checks = checks[1:]
+	}
+	for _, c := range checks {
+		available, ok := availableSpace(c.dir)
+		if !ok || available >= c.required {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"dir":       c.dir,
+			"required":  humanizeBytes(c.required),
+			"available": humanizeBytes(available),
+		}).Warn("Not enough disk space to build image")
+		return &ErrInsufficientStorage{Location: c.location, Dir: c.dir, Required: c.required, Available: available}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// filesystemAvailableSpace returns the bytes available to unprivileged users
+// on the filesystem holding dir, or false if it can't be determined
+func filesystemAvailableSpace(dir string) (int64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
+
+// filesystemID returns the device of the filesystem holding path, or false if
+// it can't be determined
+func filesystemID(path string) (uint64, bool) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+// filesystemAvailableSpace reports that free space is unknown, which skips the
+// checks before a build
+func filesystemAvailableSpace(dir string) (int64, bool) {
+	return 0, false
+}
+
+// filesystemID reports that the filesystem is unknown
+func filesystemID(path string) (uint64, bool) {
+	return 0, false
+}
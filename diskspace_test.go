@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestImageSize(t *testing.T) {
+	manifest := func(config string, layers ...string) *ManifestV2 {
+		m := &ManifestV2{}
+		m.Config.Digest, m.Config.Size = config, 10
+		for _, digest := range layers {
+			m.Layers = append(m.Layers, struct {
+				MediaType string `json:"mediaType"`
+				Size      int64  `json:"size"`
+				Digest    string `json:"digest"`
+			}{Size: 100, Digest: digest})
+		}
+		return m
+	}
+
+	tests := []struct {
+		name      string
+		manifests []*ManifestV2
+		want      int64
+	}{
+		{name: "single image", manifests: []*ManifestV2{manifest("c1", "l1", "l2")}, want: 210},
+		{name: "shared layers counted once", manifests: []*ManifestV2{manifest("c1", "l1", "l2"), manifest("c2", "l1", "l3")}, want: 320},
+		{name: "no images", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imageSize(tt.manifests...); got != tt.want {
+				t.Errorf("imageSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckBuildSpace(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-diskspace-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	if _, ok := availableSpace(tempDir); !ok {
+		t.Skip("free space is not available on this platform")
+	}
+
+	if err := checkBuildSpace(tempDir, 1024); err != nil {
+		t.Errorf("expected a small image to fit, got %v", err)
+	}
+
+	err = checkBuildSpace(tempDir, 1<<60)
+	insufficient, match := errors.AsType[*ErrInsufficientStorage](err)
+	if !match {
+		t.Fatalf("expected ErrInsufficientStorage, got %v", err)
+	}
+	// The temporary directory is on the same filesystem, so the cache
+	// directory is checked once for the whole build
+	if insufficient.Dir != tempDir || insufficient.Required != cacheSpaceFactor<<60 {
+		t.Errorf("expected %d bytes required in %s, got %d in %s", int64(cacheSpaceFactor)<<60, tempDir, insufficient.Required, insufficient.Dir)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLocking reports whether lockFile can tell live build directories from
+// orphaned ones
+const fileLocking = true
+
+// lockFile takes an exclusive lock on file without waiting, reporting whether
+// it got it. The lock lasts until the file is closed or its process exits.
+func lockFile(file *os.File) bool {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+}
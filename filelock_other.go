@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// fileLocking reports whether lockFile can tell live build directories from
+// orphaned ones
+const fileLocking = false
+
+// lockFile reports that the lock was not taken, so build directories are never
+// considered orphaned and are left alone at startup
+func lockFile(file *os.File) bool {
+	return false
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"os"
 	"path/filepath"
@@ -17,57 +19,106 @@ func closeWithLog(c io.Closer, context string) {
 	}
 }
 
-// decompressGzip decompresses a gzip file to a destination path
-func decompressGzip(src, dst string) error {
+// removeWithLog removes a file and logs any error other than it not existing
+func removeWithLog(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.WithField("path", path).WithError(err).Warn("Failed to remove file")
+	}
+}
+
+// decompressLayer decompresses a layer blob of the given media type to a
+// destination path and returns the sha256 digest of the decompressed content
+func decompressLayer(src, dst, mediaType string) (string, error) {
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer closeWithLog(dstFile, "destination file")
+
+	return decompressLayerTo(src, dstFile, mediaType)
+}
+
+// layerDiffID returns the digest of a layer blob's uncompressed content
+// without writing it to disk
+func layerDiffID(src, mediaType string) (string, error) {
+	return decompressLayerTo(src, io.Discard, mediaType)
+}
+
+// decompressLayerTo decompresses a layer blob into w and returns the sha256
+// digest of the decompressed content
+func decompressLayerTo(src string, w io.Writer, mediaType string) (string, error) {
 	srcFile, err := os.Open(src)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer closeWithLog(srcFile, "source file")
 
-	gzReader, err := gzip.NewReader(srcFile)
+	reader, err := newLayerReader(srcFile, mediaType)
 	if err != nil {
-		_, err := srcFile.Seek(0, 0)
+		return "", err
+	}
+	defer closeWithLog(reader, "layer reader")
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), reader); err != nil {
+		return "", err
+	}
+	return sha256Prefix + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// createTar creates a gzip-compressed tar archive from a source directory
+func createTar(srcDir, destPath string) error {
+	return writeArchiveFile(destPath, func(w io.Writer) error {
+		gzWriter, err := gzip.NewWriterLevel(w, gzip.BestCompression)
 		if err != nil {
 			return err
 		}
-		dstFile, err := os.Create(dst)
-		if err != nil {
+		if err := writeTar(srcDir, gzWriter); err != nil {
+			closeWithLog(gzWriter, "gzip writer")
 			return err
 		}
-		defer closeWithLog(dstFile, "destination file")
-		_, err = io.Copy(dstFile, srcFile)
-		return err
-	}
-	defer closeWithLog(gzReader, "gzip reader")
-
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer closeWithLog(dstFile, "destination file")
+		return gzWriter.Close()
+	})
+}
 
-	_, err = io.Copy(dstFile, gzReader)
-	return err
+// createUncompressedTar creates a plain tar archive from a source directory
+func createUncompressedTar(srcDir, destPath string) error {
+	return writeArchiveFile(destPath, func(w io.Writer) error {
+		return writeTar(srcDir, w)
+	})
 }
 
-// createTar creates a gzip-compressed tar archive from a source directory
-func createTar(srcDir, destPath string) error {
+// writeArchiveFile creates destPath with the content written by write and
+// flushes it to disk. Errors from closing are returned, not just logged,
+// since they can mean the archive was truncated.
+func writeArchiveFile(destPath string, write func(w io.Writer) error) error {
 	file, err := os.Create(destPath)
 	if err != nil {
 		return err
 	}
-	defer closeWithLog(file, "tar.gz file")
-
-	gzWriter, err := gzip.NewWriterLevel(file, gzip.BestCompression)
-	if err != nil {
+	if err := write(file); err != nil {
+		closeWithLog(file, "archive file")
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		closeWithLog(file, "archive file")
 		return err
 	}
-	defer closeWithLog(gzWriter, "gzip writer")
+	return file.Close()
+}
 
-	tw := tar.NewWriter(gzWriter)
-	defer closeWithLog(tw, "tar writer")
+// writeTar writes the contents of srcDir as a tar stream to w
+func writeTar(srcDir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := addDirToTar(tw, srcDir); err != nil {
+		closeWithLog(tw, "tar writer")
+		return err
+	}
+	return tw.Close()
+}
 
+// addDirToTar adds every file and directory under srcDir to tw
+func addDirToTar(tw *tar.Writer, srcDir string) error {
 	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -111,3 +162,95 @@ func copyFileToTar(tw *tar.Writer, path string) error {
 	_, err = io.Copy(tw, f)
 	return err
 }
+
+// linkOrCopy makes the file at src available at dst, hard-linking it when
+// both are on the same filesystem and copying it otherwise. Linked files
+// share their content, so neither may be modified in place afterwards. An
+// existing dst is replaced rather than written to, as it may itself be a link.
+func linkOrCopy(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer closeWithLog(in, "source file")
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		closeWithLog(out, "destination file")
+		removeWithLog(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// verifyArchive reads a tar archive, gzip-compressed if compressed is set,
+// through to its end, failing if it is truncated or corrupt
+func verifyArchive(path string, compressed bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer closeWithLog(file, "archive file")
+
+	var r io.Reader = file
+	if compressed {
+		gzReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer closeWithLog(gzReader, "gzip reader")
+		r = gzReader
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return err
+		}
+	}
+	// The gzip checksum is only checked once the stream is read to its end
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so that readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+partialSuffix)
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		removeWithLog(tempPath)
+	}
+	return err
+}
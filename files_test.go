@@ -10,7 +10,7 @@ import (
 	"testing"
 )
 
-func TestDecompressGzip(t *testing.T) {
+func TestDecompressLayer_Gzip(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "test-decompress-*")
 	if err != nil {
 		t.Fatal(err)
@@ -39,8 +39,12 @@ func TestDecompressGzip(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := decompressGzip(gzPath, outPath); err != nil {
-		t.Fatalf("decompressGzip failed: %v", err)
+	digest, err := decompressLayer(gzPath, outPath, "application/vnd.oci.image.layer.v1.tar+gzip")
+	if err != nil {
+		t.Fatalf("decompressLayer failed: %v", err)
+	}
+	if err := verifyContentDigest(content, digest); err != nil {
+		t.Errorf("returned digest does not match decompressed content: %v", err)
 	}
 
 	result, err := os.ReadFile(outPath)
@@ -53,7 +57,7 @@ func TestDecompressGzip(t *testing.T) {
 	}
 }
 
-func TestDecompressGzip_NonGzip(t *testing.T) {
+func TestDecompressLayer_Uncompressed(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "test-decompress-nongz-*")
 	if err != nil {
 		t.Fatal(err)
@@ -68,8 +72,8 @@ func TestDecompressGzip_NonGzip(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := decompressGzip(srcPath, outPath); err != nil {
-		t.Fatalf("decompressGzip failed for non-gzip: %v", err)
+	if _, err := decompressLayer(srcPath, outPath, "application/vnd.oci.image.layer.v1.tar"); err != nil {
+		t.Fatalf("decompressLayer failed for uncompressed layer: %v", err)
 	}
 
 	result, err := os.ReadFile(outPath)
@@ -237,3 +241,82 @@ func TestCreateTar_NestedDirectories(t *testing.T) {
 		t.Error("nested file not found in tar archive")
 	}
 }
+
+func TestVerifyArchive(t *testing.T) {
+	srcDir, err := os.MkdirTemp("", "test-verify-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, srcDir)
+	if err := os.WriteFile(filepath.Join(srcDir, "layer.tar"), bytes.Repeat([]byte("layer"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir, err := os.MkdirTemp("", "test-verify-out-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, outDir)
+
+	tests := []struct {
+		name       string
+		create     func(srcDir, destPath string) error
+		compressed bool
+	}{
+		{name: "gzip", create: createTar, compressed: true},
+		{name: "uncompressed", create: createUncompressedTar, compressed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(outDir, tt.name+".tar")
+			if err := tt.create(srcDir, path); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyArchive(path, tt.compressed); err != nil {
+				t.Errorf("expected complete archive to verify, got %v", err)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(path, info.Size()/2); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyArchive(path, tt.compressed); err == nil {
+				t.Error("expected truncated archive to fail verification")
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-atomic-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, dir)
+
+	path := filepath.Join(dir, "metadata.json")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("expected %q, got %q", content, data)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the written file, found %d entries", len(entries))
+	}
+}
@@ -3,6 +3,7 @@ module github.com/jadolg/DockerImageSave
 go 1.26.2
 
 require (
+	github.com/klauspost/compress v1.19.1
 	github.com/prometheus/client_golang v1.24.1
 	github.com/sirupsen/logrus v1.9.4
 	golang.org/x/sync v0.22.0
@@ -1,20 +1,221 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 const sha256Prefix = "sha256:"
 
-// authenticateClient authenticates with the registry and returns the client
-func authenticateClient(ref ImageReference) (*RegistryClient, error) {
-	client := NewRegistryClient()
+// ImageFormat selects the layout of the generated archive
+type ImageFormat string
+
+const (
+	// FormatDocker is the legacy docker-save layout understood by docker load
+	FormatDocker ImageFormat = "docker"
+	// FormatOCI is an OCI image layout that keeps the original compressed layers and manifest
+	FormatOCI ImageFormat = "oci"
+)
+
+// ParseImageFormat parses the format query parameter, defaulting to FormatDocker
+func ParseImageFormat(value string) (ImageFormat, error) {
+	switch ImageFormat(value) {
+	case "", FormatDocker:
+		return FormatDocker, nil
+	case FormatOCI:
+		return FormatOCI, nil
+	}
+	return "", fmt.Errorf("invalid format parameter: %s (must be %q or %q)", value, FormatDocker, FormatOCI)
+}
+
+// extension returns the archive file extension for the format. OCI layouts
+// hold already-compressed blobs, so they are not compressed a second time.
+func (f ImageFormat) extension() string {
+	if f == FormatOCI {
+		return ".oci.tar"
+	}
+	return ".tar.gz"
+}
+
+// downloadLimits bounds concurrent layer downloads per image and across all images
+var downloadLimits = struct {
+	mu       sync.RWMutex
+	perImage int
+	global   *semaphore.Weighted
+}{
+	perImage: defaultMaxConcurrentLayers,
+	global:   semaphore.NewWeighted(defaultMaxConcurrentDownloads),
+}
+
+// SetDownloadLimits sets the per-image and server-wide layer download concurrency
+func SetDownloadLimits(perImage, global int) {
+	downloadLimits.mu.Lock()
+	defer downloadLimits.mu.Unlock()
+	downloadLimits.perImage = perImage
+	downloadLimits.global = semaphore.NewWeighted(int64(global))
+}
+
+// currentDownloadLimits returns the per-image limit and the server-wide semaphore
+func currentDownloadLimits() (int, *semaphore.Weighted) {
+	downloadLimits.mu.RLock()
+	defer downloadLimits.mu.RUnlock()
+	return downloadLimits.perImage, downloadLimits.global
+}
+
+const (
+	// buildWorkspaceName is the directory under temp_dir that holds the build
+	// directories of every running instance, so that the startup sweep never
+	// touches anything else in a shared temporary directory
+	buildWorkspaceName = "dockerimagesave-builds"
+	// buildLockSuffix names the lock file an instance holds on its directory
+	// in the workspace for as long as it runs
+	buildLockSuffix = ".lock"
+	// buildDirPattern names the temporary directories archives are assembled in
+	buildDirPattern = "docker-image-*"
+)
+
+// buildTempDirectory holds where build directories are created; empty means
+// os.TempDir. owned is the directory this process claimed in the workspace,
+// kept locked through lock.
+var buildTempDirectory = struct {
+	mu    sync.RWMutex
+	dir   string
+	owned string
+	lock  *os.File
+}{}
+
+// SetTempDir sets the directory builds assemble archives in before packing
+// them into the cache
+func SetTempDir(dir string) {
+	buildTempDirectory.mu.Lock()
+	defer buildTempDirectory.mu.Unlock()
+	if dir == buildTempDirectory.dir {
+		return
+	}
+	releaseBuildDir()
+	buildTempDirectory.dir = dir
+}
+
+// buildTempDir returns the directory build directories are created in
+func buildTempDir() string {
+	buildTempDirectory.mu.RLock()
+	defer buildTempDirectory.mu.RUnlock()
+	if buildTempDirectory.dir == "" {
+		return os.TempDir()
+	}
+	return buildTempDirectory.dir
+}
+
+// processBuildDir returns the directory of this process in the build
+// workspace, claiming it on first use
+func processBuildDir() (string, error) {
+	base := buildTempDir()
+
+	buildTempDirectory.mu.Lock()
+	defer buildTempDirectory.mu.Unlock()
+	if buildTempDirectory.owned != "" {
+		return buildTempDirectory.owned, nil
+	}
+	workspace := filepath.Join(base, buildWorkspaceName)
+	if err := os.MkdirAll(workspace, 0755); err != nil {
+		return "", err
+	}
+	dir, lock, err := claimBuildDir(workspace)
+	if err != nil {
+		return "", err
+	}
+	buildTempDirectory.owned = dir
+	buildTempDirectory.lock = lock
+	return dir, nil
+}
+
+// claimBuildDir creates a directory in workspace and locks it against the
+// startup sweep of other instances. The lock file is created and locked before
+// the directory exists, so a sweep never finds the directory unlocked while its
+// owner is alive.
+func claimBuildDir(workspace string) (string, *os.File, error) {
+	lock, err := os.CreateTemp(workspace, "*"+buildLockSuffix)
+	if err != nil {
+		return "", nil, err
+	}
+	if fileLocking && !lockFile(lock) {
+		log.WithField("file", lock.Name()).Warn("Failed to lock build directory, other instances may remove it")
+	}
+	dir := strings.TrimSuffix(lock.Name(), buildLockSuffix)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		closeWithLog(lock, "build directory lock")
+		removeWithLog(lock.Name())
+		return "", nil, err
+	}
+	return dir, lock, nil
+}
+
+// releaseBuildDir removes the directory this process claimed in the workspace,
+// if it is empty, and gives up its lock. Must be called with
+// buildTempDirectory.mu held.
+func releaseBuildDir() {
+	if buildTempDirectory.owned == "" {
+		return
+	}
+	if err := os.Remove(buildTempDirectory.owned); err == nil {
+		removeWithLog(buildTempDirectory.lock.Name())
+	}
+	closeWithLog(buildTempDirectory.lock, "build directory lock")
+	buildTempDirectory.owned = ""
+	buildTempDirectory.lock = nil
+}
+
+// RemoveOrphanedBuildDirs removes the directories in the build workspace under
+// tempDir whose instance stopped, along with the builds it left behind. A
+// directory is orphaned when its lock file can be locked; on platforms without
+// file locking nothing is removed.
+func RemoveOrphanedBuildDirs(tempDir string) {
+	workspace := filepath.Join(tempDir, buildWorkspaceName)
+	entries, err := os.ReadDir(workspace)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithField("dir", workspace).WithError(err).Warn("Failed to read build workspace")
+		}
+		return
+	}
+	for _, entry := range entries {
+		// Lock files without a directory are left alone: their instance may be
+		// about to create it
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(workspace, entry.Name())
+		lock, err := os.OpenFile(dir+buildLockSuffix, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			log.WithField("dir", entry.Name()).WithError(err).Warn("Failed to open build directory lock")
+			continue
+		}
+		if lockFile(lock) {
+			log.WithField("dir", entry.Name()).Info("Removing orphaned build directory")
+			if err := os.RemoveAll(dir); err != nil {
+				log.WithField("dir", entry.Name()).WithError(err).Warn("Failed to remove orphaned build directory")
+			} else {
+				removeWithLog(lock.Name())
+			}
+		}
+		closeWithLog(lock, "build directory lock")
+	}
+}
+
+// authenticateClient authenticates with the registry using credentials from
+// the given store and returns the client
+func authenticateClient(ref ImageReference, credentials *CredentialStore) (*RegistryClient, error) {
+	client := newRegistryClientFor(ref.Registry, credentials)
 
 	log.WithField("registry", ref.Registry).Info("Authenticating with registry")
 	if err := client.Authenticate(ref); err != nil {
@@ -25,56 +226,62 @@ func authenticateClient(ref ImageReference) (*RegistryClient, error) {
 	return client, nil
 }
 
-// fetchManifest retrieves the manifest for the image for the given platform
-func fetchManifest(client *RegistryClient, ref ImageReference, platform Platform) (*ManifestV2, error) {
+// fetchManifest retrieves the manifest for the image for the given platform,
+// along with the digest ref points to, which is recorded for revalidation
+func fetchManifest(client *RegistryClient, ref ImageReference, platform Platform) (*ManifestV2, string, error) {
 	log.WithFields(log.Fields{
 		"repository": ref.Repository,
-		"tag":        ref.Tag,
+		"reference":  ref.Reference(),
 		"platform":   platform,
 	}).Info("Fetching manifest")
-	manifest, err := client.getManifest(ref, platform)
+	manifest, digest, err := client.getManifest(ref, platform)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get manifest: %w", err)
+		return nil, "", fmt.Errorf("failed to get manifest: %w", err)
 	}
-	return manifest, nil
+	return manifest, digest, nil
 }
 
 // downloadImageConfig downloads and parses the image configuration
 func downloadImageConfig(client *RegistryClient, ref ImageReference, manifest *ManifestV2, tempDir string) (*ImageConfig, string, error) {
+	if err := validateDigest(manifest.Config.Digest); err != nil {
+		return nil, "", fmt.Errorf("invalid config digest: %w", err)
+	}
 	log.Info("Downloading image config")
 	configDigest := strings.TrimPrefix(manifest.Config.Digest, sha256Prefix)
 	configPath := filepath.Join(tempDir, configDigest+".json")
-	if err := client.DownloadBlob(ref, manifest.Config.Digest, configPath); err != nil {
+	if _, err := os.Stat(configPath); err == nil {
+		// Already downloaded by an earlier image of the same bundle
+		client.blobs.keepBlob(manifest.Config.Digest)
+	} else if err := client.DownloadBlob(context.Background(), ref, manifest.Config.Digest, configPath); err != nil {
 		return nil, "", fmt.Errorf("failed to download config: %w", err)
 	}
 
-	configData, err := os.ReadFile(configPath)
+	imageConfig, err := readImageConfig(configPath)
 	if err != nil {
 		return nil, "", err
 	}
 
+	return imageConfig, configDigest, nil
+}
+
+// readImageConfig parses an image configuration blob from disk
+func readImageConfig(path string) (*ImageConfig, error) {
+	configData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
 	var imageConfig ImageConfig
 	if err := json.Unmarshal(configData, &imageConfig); err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	return &imageConfig, configDigest, nil
+	return &imageConfig, nil
 }
 
-// downloadAndProcessLayer downloads a single layer and creates its metadata files
-func downloadAndProcessLayer(client *RegistryClient, ref ImageReference, layerDigestFull string, index int, totalLayers int, imageConfig *ImageConfig, tempDir string) (string, error) {
-	log.WithFields(log.Fields{
-		"layer_index":  index + 1,
-		"total_layers": totalLayers,
-		"digest":       layerDigestFull[:19] + "...",
-	}).Info("Downloading layer")
-	layerDigest := strings.TrimPrefix(layerDigestFull, sha256Prefix)
-
-	compressedPath := filepath.Join(tempDir, layerDigest+".tar.gz")
-	if err := client.DownloadBlob(ref, layerDigestFull, compressedPath); err != nil {
-		return "", fmt.Errorf("failed to download layer: %w", err)
-	}
-
+// downloadAndProcessLayer downloads a single layer and creates its metadata files.
+// Layers already in the blob store are reused instead.
+func downloadAndProcessLayer(ctx context.Context, client *RegistryClient, ref ImageReference, layerDigestFull, mediaType string, index int, totalLayers int, imageConfig *ImageConfig, tempDir string) (string, error) {
 	diffID := strings.TrimPrefix(imageConfig.RootFS.DiffIDs[index], sha256Prefix)
 	layerDir := filepath.Join(tempDir, diffID)
 	if err := os.MkdirAll(layerDir, 0755); err != nil {
@@ -82,8 +289,18 @@ func downloadAndProcessLayer(client *RegistryClient, ref ImageReference, layerDi
 	}
 
 	layerTarPath := filepath.Join(layerDir, "layer.tar")
-	if err := decompressGzip(compressedPath, layerTarPath); err != nil {
-		return "", fmt.Errorf("failed to decompress layer: %w", err)
+	if client.blobs.fetchLayer(imageConfig.RootFS.DiffIDs[index], layerTarPath) {
+		client.blobs.keepBlob(layerDigestFull)
+	} else {
+		log.WithFields(log.Fields{
+			"layer_index":  index + 1,
+			"total_layers": totalLayers,
+			"digest":       layerDigestFull,
+		}).Info("Downloading layer")
+		if err := downloadLayer(ctx, client, ref, layerDigestFull, mediaType, imageConfig.RootFS.DiffIDs[index], tempDir, layerTarPath); err != nil {
+			return "", err
+		}
+		client.blobs.storeLayer(imageConfig.RootFS.DiffIDs[index], layerTarPath)
 	}
 
 	if err := createLayerMetadata(layerDir, diffID, index, imageConfig); err != nil {
@@ -93,6 +310,27 @@ func downloadAndProcessLayer(client *RegistryClient, ref ImageReference, layerDi
 	return diffID, nil
 }
 
+// downloadLayer downloads a compressed layer and decompresses it to
+// layerTarPath, checking the result against the expected diff ID
+func downloadLayer(ctx context.Context, client *RegistryClient, ref ImageReference, layerDigestFull, mediaType, expectedDiffID, tempDir, layerTarPath string) error {
+	compressedPath := filepath.Join(tempDir, strings.TrimPrefix(layerDigestFull, sha256Prefix)+".blob")
+	if err := client.DownloadBlob(ctx, ref, layerDigestFull, compressedPath); err != nil {
+		return fmt.Errorf("failed to download layer: %w", err)
+	}
+	defer removeWithLog(compressedPath)
+
+	actualDiffID, err := decompressLayer(compressedPath, layerTarPath, mediaType)
+	if err != nil {
+		return fmt.Errorf("failed to decompress layer: %w", err)
+	}
+	if actualDiffID != expectedDiffID {
+		verificationFailuresMetric.Inc()
+		return fmt.Errorf("layer %s failed verification: %w", layerDigestFull,
+			&ErrDigestMismatch{Expected: expectedDiffID, Actual: actualDiffID})
+	}
+	return nil
+}
+
 // createLayerMetadata creates VERSION and json files for a layer
 func createLayerMetadata(layerDir, diffID string, index int, imageConfig *ImageConfig) error {
 	if err := os.WriteFile(filepath.Join(layerDir, "VERSION"), []byte("1.0"), 0644); err != nil {
@@ -111,26 +349,126 @@ func createLayerMetadata(layerDir, diffID string, index int, imageConfig *ImageC
 	return marshalJSONToFile(layerJSON, layerDir, "json")
 }
 
-// downloadAllLayers downloads all layers and returns their diff IDs
+// checkLayerCount ensures the config has a diff ID for every layer in the manifest
+func checkLayerCount(manifest *ManifestV2, imageConfig *ImageConfig) error {
+	if len(imageConfig.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("image config lists %d diff IDs but manifest has %d layers",
+			len(imageConfig.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	return nil
+}
+
+// checkLayerDigests rejects malformed layer digests before any layer is
+// downloaded, as they are used in file names and log fields
+func checkLayerDigests(manifest *ManifestV2) error {
+	for i, layer := range manifest.Layers {
+		if err := validateDigest(layer.Digest); err != nil {
+			return fmt.Errorf("layer %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// checkDiffIDs rejects malformed diff IDs in the image config before any
+// layer directory is named after them
+func checkDiffIDs(imageConfig *ImageConfig) error {
+	for i, diffID := range imageConfig.RootFS.DiffIDs {
+		if err := validateDigest(diffID); err != nil {
+			return fmt.Errorf("diff ID %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// downloadConcurrently runs download for each index within the per-image and
+// server-wide limits. The first failure cancels the context of the others.
+func downloadConcurrently(indices []int, download func(ctx context.Context, index int) error) error {
+	perImage, global := currentDownloadLimits()
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(perImage)
+
+	for _, i := range indices {
+		g.Go(func() error {
+			if err := global.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			defer global.Release(1)
+			return download(ctx, i)
+		})
+	}
+
+	return g.Wait()
+}
+
+// downloadAllLayers downloads all layers concurrently and returns their diff IDs
+// in manifest order. The first failure cancels the remaining downloads.
 func downloadAllLayers(client *RegistryClient, ref ImageReference, manifest *ManifestV2, imageConfig *ImageConfig, tempDir string) ([]string, error) {
+	if err := checkLayerCount(manifest, imageConfig); err != nil {
+		return nil, err
+	}
+	if err := checkLayerMediaTypes(manifest); err != nil {
+		return nil, err
+	}
+	if err := checkLayerDigests(manifest); err != nil {
+		return nil, err
+	}
+	if err := checkDiffIDs(imageConfig); err != nil {
+		return nil, err
+	}
+
 	layerPaths := make([]string, len(manifest.Layers))
+	seen := make(map[string]bool, len(manifest.Layers))
+	var pending []int
+
+	for i := range manifest.Layers {
+		diffID := imageConfig.RootFS.DiffIDs[i]
+		layerDir := strings.TrimPrefix(diffID, sha256Prefix)
+		if seen[diffID] {
+			// Identical layers share a directory; only download them once
+			layerPaths[i] = layerDir
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, layerDir, "layer.tar")); err == nil {
+			// Already extracted by an earlier image of the same bundle
+			layerPaths[i] = layerDir
+			seen[diffID] = true
+			continue
+		}
+		seen[diffID] = true
+		pending = append(pending, i)
+	}
 
-	for i, layer := range manifest.Layers {
-		diffID, err := downloadAndProcessLayer(client, ref, layer.Digest, i, len(manifest.Layers), imageConfig, tempDir)
+	err := downloadConcurrently(pending, func(ctx context.Context, i int) error {
+		layer := manifest.Layers[i]
+		path, err := downloadAndProcessLayer(ctx, client, ref, layer.Digest, layer.MediaType, i, len(manifest.Layers), imageConfig, tempDir)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		layerPaths[i] = diffID
+		layerPaths[i] = path
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
 	return layerPaths, nil
 }
 
 // createDockerManifest creates the manifest.json file for docker load
 func createDockerManifest(ref ImageReference, configDigest string, layerPaths []string, tempDir string) error {
-	repoTag := ref.Repository + ":" + ref.Tag
-	if ref.Registry != "registry-1.docker.io" {
-		repoTag = ref.Registry + "/" + repoTag
+	manifestJSON := []map[string]interface{}{dockerManifestEntry(ref, configDigest, layerPaths)}
+	return marshalJSONToFile(manifestJSON, tempDir, "manifest.json")
+}
+
+// dockerManifestEntry builds the manifest.json entry for one image.
+// Images pinned only by digest have no tag, so they are loaded untagged.
+func dockerManifestEntry(ref ImageReference, configDigest string, layerPaths []string) map[string]interface{} {
+	repoTags := []string{}
+	if ref.Tag != "" {
+		repoTag := ref.Repository + ":" + ref.Tag
+		if ref.Registry != "registry-1.docker.io" {
+			repoTag = ref.Registry + "/" + repoTag
+		}
+		repoTags = append(repoTags, repoTag)
 	}
 
 	layers := make([]string, len(layerPaths))
@@ -138,36 +476,39 @@ func createDockerManifest(ref ImageReference, configDigest string, layerPaths []
 		layers[i] = p + "/layer.tar"
 	}
 
-	manifestJSON := []map[string]interface{}{
-		{
-			"Config":   configDigest + ".json",
-			"RepoTags": []string{repoTag},
-			"Layers":   layers,
-		},
+	return map[string]interface{}{
+		"Config":   configDigest + ".json",
+		"RepoTags": repoTags,
+		"Layers":   layers,
 	}
-
-	return marshalJSONToFile(manifestJSON, tempDir, "manifest.json")
 }
 
 // createRepositoriesFile creates the repositories file for docker load
 func createRepositoriesFile(ref ImageReference, layerPaths []string, tempDir string) error {
-	imageName := filepath.Base(ref.Repository)
-	topLayer := layerPaths[len(layerPaths)-1]
+	repositories := map[string]map[string]string{}
+	addRepositoryTag(repositories, ref, layerPaths)
+	return marshalJSONToFile(repositories, tempDir, "repositories")
+}
 
-	repositories := map[string]map[string]string{
-		imageName: {ref.Tag: topLayer},
+// addRepositoryTag records the image's tag and top layer in repositories
+func addRepositoryTag(repositories map[string]map[string]string, ref ImageReference, layerPaths []string) {
+	if ref.Tag == "" || len(layerPaths) == 0 {
+		return
 	}
-
-	return marshalJSONToFile(repositories, tempDir, "repositories")
+	imageName := filepath.Base(ref.Repository)
+	if repositories[imageName] == nil {
+		repositories[imageName] = map[string]string{}
+	}
+	repositories[imageName][ref.Tag] = layerPaths[len(layerPaths)-1]
 }
 
-// createOutputTar creates the final tar archive
-func createOutputTar(ref ImageReference, tempDir, outputDir string, platform Platform) (string, error) {
+// createOutputTar creates the final tar archive named filename in outputDir
+func createOutputTar(tempDir, outputDir, filename string, format ImageFormat) (string, error) {
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return "", err
 	}
 
-	outputPath := filepath.Join(outputDir, imageFilename(ref, platform))
+	outputPath := filepath.Join(outputDir, filename)
 
 	// Defense-in-depth: confirm the assembled path stays within the output directory.
 	cleanOut := filepath.Clean(outputDir)
@@ -176,75 +517,203 @@ func createOutputTar(ref ImageReference, tempDir, outputDir string, platform Pla
 		return "", fmt.Errorf("output path escapes cache directory: %s", cleanPath)
 	}
 
-	log.Info("Creating tar archive")
-	if err := createTar(tempDir, outputPath); err != nil {
-		return "", fmt.Errorf("failed to create tar: %w", err)
+	// The archive is written next to its final path and only renamed into
+	// place once complete, so a truncated archive is never served as a cache hit
+	partial, err := os.CreateTemp(outputDir, filename+".*"+partialSuffix)
+	if err != nil {
+		return "", err
+	}
+	partialPath := partial.Name()
+	closeWithLog(partial, "partial archive")
+
+	if err := writeOutputTar(tempDir, partialPath, format); err != nil {
+		removeWithLog(partialPath)
+		return "", err
+	}
+	if err := os.Rename(partialPath, outputPath); err != nil {
+		removeWithLog(partialPath)
+		return "", err
 	}
 
 	log.WithField("path", outputPath).Info("Image saved")
 	return outputPath, nil
 }
 
-// DownloadImage downloads a Docker image and saves it as a tar file
-func DownloadImage(imageRef string, outputDir string, platform Platform) (string, error) {
-	ref := ParseImageReference(imageRef)
+// writeOutputTar packs tempDir into the archive at path and verifies it
+func writeOutputTar(tempDir, path string, format ImageFormat) error {
+	log.Info("Creating tar archive")
+	create := createTar
+	if format == FormatOCI {
+		create = createUncompressedTar
+	}
+	if err := create(tempDir, path); err != nil {
+		return fmt.Errorf("failed to create tar: %w", err)
+	}
+	if err := verifyArchive(path, format != FormatOCI); err != nil {
+		return fmt.Errorf("failed to verify tar: %w", err)
+	}
+	// Temporary files are private, archives are not
+	return os.Chmod(path, 0644)
+}
 
-	// Validate the image reference to prevent SSRF and other attacks
-	if err := ValidateImageReference(ref); err != nil {
-		return "", fmt.Errorf("invalid image reference: %w", err)
+// assembleDockerArchive downloads the image into the docker-save layout in tempDir
+func assembleDockerArchive(client *RegistryClient, ref ImageReference, manifest *ManifestV2, tempDir string) error {
+	imageConfig, configDigest, err := downloadImageConfig(client, ref, manifest, tempDir)
+	if err != nil {
+		return err
 	}
 
-	client, err := authenticateClient(ref)
+	layerPaths, err := downloadAllLayers(client, ref, manifest, imageConfig, tempDir)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	manifest, err := fetchManifest(client, ref, platform)
+	if err := createDockerManifest(ref, configDigest, layerPaths, tempDir); err != nil {
+		return err
+	}
+
+	return createRepositoriesFile(ref, layerPaths, tempDir)
+}
+
+// DownloadImage downloads a Docker image and saves it as a tar file in the given format
+func DownloadImage(imageRef string, outputDir string, platform Platform, format ImageFormat, credentials *CredentialStore) (string, error) {
+	ref, client, err := prepareDownload(imageRef, credentials)
 	if err != nil {
 		return "", err
 	}
+	client.blobs = openBlobStore(outputDir).lease()
+	defer client.blobs.release()
 
-	tempDir, err := os.MkdirTemp("", "docker-image-*")
+	manifest, digest, err := fetchManifest(client, ref, platform)
 	if err != nil {
 		return "", err
 	}
-	defer func(path string) {
-		if err := os.RemoveAll(path); err != nil {
-			log.WithError(err).Warn("Failed to remove temp dir")
+	if err := checkBuildSpace(outputDir, imageSize(manifest)); err != nil {
+		return "", err
+	}
+
+	manifests := map[string]string{imageRef: digest}
+	return buildArchive(outputDir, imageFilename(ref, platform, format), format, manifests, client.blobs, func(tempDir string) error {
+		if format == FormatOCI {
+			return assembleOCILayout(client, ref, manifest, platform, tempDir)
 		}
-	}(tempDir)
+		return assembleDockerArchive(client, ref, manifest, tempDir)
+	})
+}
 
-	imageConfig, configDigest, err := downloadImageConfig(client, ref, manifest, tempDir)
+// DownloadMultiPlatformImage downloads the selected platforms of an image and
+// saves them as a single OCI image layout tar file
+func DownloadMultiPlatformImage(imageRef string, outputDir string, selection PlatformSelection, credentials *CredentialStore) (string, error) {
+	ref, client, err := prepareDownload(imageRef, credentials)
 	if err != nil {
 		return "", err
 	}
+	client.blobs = openBlobStore(outputDir).lease()
+	defer client.blobs.release()
 
-	layerPaths, err := downloadAllLayers(client, ref, manifest, imageConfig, tempDir)
+	log.WithFields(log.Fields{
+		"repository": ref.Repository,
+		"reference":  ref.Reference(),
+		"platforms":  selection,
+	}).Info("Fetching image index")
+	list, manifest, digest, err := client.getImageIndex(ref)
 	if err != nil {
+		return "", fmt.Errorf("failed to get manifest: %w", err)
+	}
+	if list == nil && !selection.All {
+		return "", fmt.Errorf("image is not multi-platform; use the os and arch parameters instead")
+	}
+
+	var selected []int
+	platformManifests := []*ManifestV2{manifest}
+	if list != nil {
+		selected, platformManifests, err = fetchPlatformManifests(client, ref, list, selection)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := checkBuildSpace(outputDir, imageSize(platformManifests...)); err != nil {
 		return "", err
 	}
 
-	if err := createDockerManifest(ref, configDigest, layerPaths, tempDir); err != nil {
+	manifests := map[string]string{imageRef: digest}
+	return buildArchive(outputDir, multiPlatformFilename(ref, selection), FormatOCI, manifests, client.blobs, func(tempDir string) error {
+		if list == nil {
+			descriptor, err := writeOCIImage(client, ref, manifest, tempDir)
+			if err != nil {
+				return err
+			}
+			descriptor.Annotations = ociRefAnnotations(ref)
+			return writeOCILayoutFiles(tempDir, []ociDescriptor{descriptor})
+		}
+		return assembleMultiPlatformOCILayout(client, ref, list, selected, platformManifests, tempDir)
+	})
+}
+
+// prepareDownload parses and validates the image reference and authenticates with its registry
+func prepareDownload(imageRef string, credentials *CredentialStore) (ImageReference, *RegistryClient, error) {
+	ref := ParseImageReference(imageRef)
+
+	// Validate the image reference to prevent SSRF and other attacks
+	if err := ValidateImageReference(ref); err != nil {
+		return ImageReference{}, nil, fmt.Errorf("invalid image reference: %w", err)
+	}
+
+	client, err := authenticateClient(ref, credentials)
+	if err != nil {
+		return ImageReference{}, nil, err
+	}
+	return ref, client, nil
+}
+
+// buildArchive runs assemble in a temporary directory and packs the result into
+// outputDir/filename, recording the manifest digest of each image it holds so
+// that the cached archive can be revalidated later, and the stored blobs it
+// was built from so that they are kept while it is cached
+func buildArchive(outputDir, filename string, format ImageFormat, manifests map[string]string, blobs *blobLease, assemble func(tempDir string) error) (string, error) {
+	buildDir, err := processBuildDir()
+	if err != nil {
+		return "", err
+	}
+	tempDir, err := os.MkdirTemp(buildDir, buildDirPattern)
+	if err != nil {
+		return "", err
+	}
+	defer func(path string) {
+		if err := os.RemoveAll(path); err != nil {
+			log.WithError(err).Warn("Failed to remove temp dir")
+		}
+	}(tempDir)
+
+	if err := assemble(tempDir); err != nil {
 		return "", err
 	}
 
-	if err := createRepositoriesFile(ref, layerPaths, tempDir); err != nil {
+	outputPath, err := createOutputTar(tempDir, outputDir, filename, format)
+	if err != nil {
 		return "", err
 	}
 
-	return createOutputTar(ref, tempDir, outputDir, platform)
+	now := time.Now()
+	metadata := archiveMetadata{Manifests: manifests, CreatedAt: now, ValidatedAt: now}
+	metadata.Blobs, metadata.Layers = blobs.references()
+	if err := writeArchiveMetadata(outputPath, metadata); err != nil {
+		// The archive is still valid, it just won't be revalidated
+		log.WithField("path", outputPath).WithError(err).Warn("Failed to write archive metadata")
+	}
+	return outputPath, nil
 }
 
 // GetImagePlatforms returns the available platforms for a multi-arch image.
 // Returns nil, nil if the image is single-arch.
-func GetImagePlatforms(imageRef string) ([]Platform, error) {
+func GetImagePlatforms(imageRef string, credentials *CredentialStore) ([]Platform, error) {
 	ref := ParseImageReference(imageRef)
 
 	if err := ValidateImageReference(ref); err != nil {
 		return nil, fmt.Errorf("invalid image reference: %w", err)
 	}
 
-	client, err := authenticateClient(ref)
+	client, err := authenticateClient(ref, credentials)
 	if err != nil {
 		return nil, err
 	}
@@ -252,6 +721,27 @@ func GetImagePlatforms(imageRef string) ([]Platform, error) {
 	return client.GetPlatforms(ref)
 }
 
+// resolveImageDigest returns the digest of the manifest imageRef currently
+// points to. It runs while a request waits for a cached archive, so every
+// registry request gets a single attempt and revalidateTimeout.
+func resolveImageDigest(imageRef string, credentials *CredentialStore) (string, error) {
+	ref := ParseImageReference(imageRef)
+	if err := ValidateImageReference(ref); err != nil {
+		return "", fmt.Errorf("invalid image reference: %w", err)
+	}
+
+	client := newRegistryClientFor(ref.Registry, credentials)
+	client.singleAttempt = true
+	httpClient := *client.httpClient
+	httpClient.Timeout = revalidateTimeout
+	client.httpClient = &httpClient
+
+	if err := client.Authenticate(ref); err != nil {
+		return "", fmt.Errorf("authentication failed: %w", err)
+	}
+	return client.resolveManifestDigest(ref)
+}
+
 // marshalJSONToFile marshals v to JSON and writes it to dir/filename.
 func marshalJSONToFile(v interface{}, dir, filename string) error {
 	data, err := json.Marshal(v)
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCreateDockerManifest(t *testing.T) {
@@ -96,6 +105,39 @@ func TestCreateDockerManifest_CustomRegistry(t *testing.T) {
 	}
 }
 
+func TestCreateDockerManifest_DigestOnly(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-manifest-digest-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	ref := ImageReference{
+		Registry:   "registry-1.docker.io",
+		Repository: "library/alpine",
+		Digest:     "sha256:" + strings.Repeat("a", 64),
+	}
+
+	if err := createDockerManifest(ref, "cfg", []string{"layer1"}, tempDir); err != nil {
+		t.Fatalf("createDockerManifest failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifests []map[string]interface{}
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		t.Fatal(err)
+	}
+
+	repoTags := manifests[0]["RepoTags"].([]interface{})
+	if len(repoTags) != 0 {
+		t.Errorf("expected no RepoTags for digest-only reference, got %v", repoTags)
+	}
+}
+
 func TestCreateRepositoriesFile(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "test-repos-*")
 	if err != nil {
@@ -208,6 +250,250 @@ func TestCreateLayerMetadata_WithParent(t *testing.T) {
 	}
 }
 
+// gzipLayer returns a gzip-compressed layer along with its blob digest and diff ID
+func gzipLayer(t *testing.T, content string) (blob []byte, digest, diffID string) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blobSum := sha256.Sum256(buf.Bytes())
+	diffSum := sha256.Sum256([]byte(content))
+	return buf.Bytes(), "sha256:" + hex.EncodeToString(blobSum[:]), "sha256:" + hex.EncodeToString(diffSum[:])
+}
+
+// fakeLayeredImage builds a manifest and config for the given layer contents and
+// a client whose transport serves the layer blobs through serve.
+func fakeLayeredImage(t *testing.T, contents []string, serve func(digest string, blob []byte) (*http.Response, error)) (*RegistryClient, *ManifestV2, *ImageConfig) {
+	t.Helper()
+	blobs := make(map[string][]byte)
+	manifest := &ManifestV2{SchemaVersion: 2}
+	imageConfig := &ImageConfig{}
+	for _, content := range contents {
+		blob, digest, diffID := gzipLayer(t, content)
+		blobs[digest] = blob
+		manifest.Layers = append(manifest.Layers, struct {
+			MediaType string `json:"mediaType"`
+			Size      int64  `json:"size"`
+			Digest    string `json:"digest"`
+		}{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", Size: int64(len(blob)), Digest: digest})
+		imageConfig.RootFS.DiffIDs = append(imageConfig.RootFS.DiffIDs, diffID)
+	}
+
+	client := NewRegistryClient()
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		digest := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		blob, ok := blobs[digest]
+		if !ok {
+			return newTestResponse(http.StatusNotFound, nil), nil
+		}
+		return serve(digest, blob)
+	})
+	return client, manifest, imageConfig
+}
+
+func TestDownloadAllLayers_ConcurrentKeepsOrder(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-layers-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	SetDownloadLimits(2, 16)
+	defer SetDownloadLimits(defaultMaxConcurrentLayers, defaultMaxConcurrentDownloads)
+
+	var inFlight, maxInFlight atomic.Int32
+	contents := []string{"layer-a", "layer-b", "layer-c", "layer-d", "layer-e"}
+	client, manifest, imageConfig := fakeLayeredImage(t, contents, func(_ string, blob []byte) (*http.Response, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			current := maxInFlight.Load()
+			if n <= current || maxInFlight.CompareAndSwap(current, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return newTestResponse(http.StatusOK, blob), nil
+	})
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	layerPaths, err := downloadAllLayers(client, ref, manifest, imageConfig, tempDir)
+	if err != nil {
+		t.Fatalf("downloadAllLayers failed: %v", err)
+	}
+
+	for i, diffID := range imageConfig.RootFS.DiffIDs {
+		want := strings.TrimPrefix(diffID, sha256Prefix)
+		if layerPaths[i] != want {
+			t.Errorf("layer %d: expected %s, got %s", i, want, layerPaths[i])
+		}
+		data, err := os.ReadFile(filepath.Join(tempDir, want, "layer.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents[i] {
+			t.Errorf("layer %d: expected content %q, got %q", i, contents[i], data)
+		}
+	}
+
+	if got := maxInFlight.Load(); got > 2 {
+		t.Errorf("expected at most 2 concurrent downloads, got %d", got)
+	}
+}
+
+func TestDownloadAllLayers_FirstErrorCancels(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-layers-err-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	useFastRetries(t, "registry.example.com", 2)
+
+	contents := []string{"good-1", "bad", "good-2"}
+	_, badDigest, _ := gzipLayer(t, "bad")
+	client, manifest, imageConfig := fakeLayeredImage(t, contents, func(digest string, blob []byte) (*http.Response, error) {
+		if digest == badDigest {
+			return newTestResponse(http.StatusInternalServerError, nil), nil
+		}
+		return newTestResponse(http.StatusOK, blob), nil
+	})
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	if _, err := downloadAllLayers(client, ref, manifest, imageConfig, tempDir); err == nil {
+		t.Fatal("expected error when a layer fails to download")
+	}
+}
+
+func TestDownloadAllLayers_DiffIDCountMismatch(t *testing.T) {
+	client, manifest, imageConfig := fakeLayeredImage(t, []string{"a", "b"}, func(_ string, blob []byte) (*http.Response, error) {
+		return newTestResponse(http.StatusOK, blob), nil
+	})
+	imageConfig.RootFS.DiffIDs = imageConfig.RootFS.DiffIDs[:1]
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	if _, err := downloadAllLayers(client, ref, manifest, imageConfig, os.TempDir()); err == nil {
+		t.Fatal("expected error for diff ID count mismatch")
+	}
+}
+
+func TestDownloadAllLayers_MalformedDigests(t *testing.T) {
+	useFastRetries(t, "registry.example.com", 1)
+
+	for _, digest := range []string{"sha256:abc", "sha256:../../etc", ""} {
+		t.Run(digest, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "test-layers-digest-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupTempDir(t, tempDir)
+
+			client, manifest, imageConfig := fakeLayeredImage(t, []string{"a"}, func(_ string, blob []byte) (*http.Response, error) {
+				return newTestResponse(http.StatusOK, blob), nil
+			})
+			manifest.Layers[0].Digest = digest
+
+			// Must fail without panicking in a download goroutine
+			ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+			if _, err := downloadAllLayers(client, ref, manifest, imageConfig, tempDir); err == nil {
+				t.Fatalf("expected error for layer digest %q", digest)
+			}
+		})
+	}
+}
+
+func TestDownloadAllLayers_TraversalDiffID(t *testing.T) {
+	parentDir, err := os.MkdirTemp("", "test-layers-diffid-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, parentDir)
+	tempDir := filepath.Join(parentDir, "build")
+	if err := os.Mkdir(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	client, manifest, imageConfig := fakeLayeredImage(t, []string{"a"}, func(_ string, blob []byte) (*http.Response, error) {
+		return newTestResponse(http.StatusOK, blob), nil
+	})
+	imageConfig.RootFS.DiffIDs[0] = "sha256:../escaped"
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	if _, err := downloadAllLayers(client, ref, manifest, imageConfig, tempDir); err == nil {
+		t.Fatal("expected error for a diff ID containing a path")
+	}
+	if _, err := os.Stat(filepath.Join(parentDir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written outside the build directory, stat error %v", err)
+	}
+}
+
+func TestDownloadImage_ReusesStoredLayers(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addTag("one", registry.addImage(t, DefaultPlatform(), "base", "one"))
+	registry.addTag("two", registry.addImage(t, DefaultPlatform(), "base", "two"))
+	registry.install(t, "registry.example.com")
+
+	cacheDir, err := os.MkdirTemp("", "test-blobstore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+
+	for _, format := range []ImageFormat{FormatDocker, FormatOCI} {
+		for _, tag := range []string{"one", "two"} {
+			if _, err := DownloadImage("registry.example.com/team/app:"+tag, cacheDir, DefaultPlatform(), format, nil); err != nil {
+				t.Fatalf("DownloadImage(%s, %s) error: %v", tag, format, err)
+			}
+		}
+	}
+
+	_, baseDigest, baseDiffID := gzipLayer(t, "base")
+	if got := registry.requestCount(baseDigest); got != 1 {
+		t.Errorf("expected the shared layer to be downloaded once, got %d", got)
+	}
+
+	// Removing the first archive releases its own layer but keeps the shared one
+	cache, err := NewCacheManager(cacheDir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An archive built from a stored layer still references its compressed blob
+	metadata, err := readArchiveMetadata(cache.GetCachePath("registry.example.com/team/app:two", DefaultPlatform(), FormatDocker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(metadata.Blobs, baseDigest) {
+		t.Errorf("expected archive built from the stored layer to reference blob %s, got %v", baseDigest, metadata.Blobs)
+	}
+	_, oneDigest, oneDiffID := gzipLayer(t, "one")
+	for _, format := range []ImageFormat{FormatDocker, FormatOCI} {
+		path := cache.GetCachePath("registry.example.com/team/app:one", DefaultPlatform(), format)
+		removeWithLog(path)
+		removeWithLog(metadataPath(path))
+	}
+	cache.PerformCleanup()
+
+	store := openBlobStore(cacheDir)
+	for digest, survives := range map[string]bool{baseDigest: true, oneDigest: false} {
+		path, _ := store.blobPath(digest)
+		if _, err := os.Stat(path); (err == nil) != survives {
+			t.Errorf("blob %s: expected kept=%v, stat error %v", digest, survives, err)
+		}
+	}
+	for diffID, survives := range map[string]bool{baseDiffID: true, oneDiffID: false} {
+		path, _ := store.layerPath(diffID)
+		if _, err := os.Stat(path); (err == nil) != survives {
+			t.Errorf("layer %s: expected kept=%v, stat error %v", diffID, survives, err)
+		}
+	}
+}
+
 func TestDownloadImage_PublicImage(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test")
@@ -219,7 +505,7 @@ func TestDownloadImage_PublicImage(t *testing.T) {
 	}
 	defer cleanupTempDir(t, outputDir)
 
-	imagePath, err := DownloadImage("alpine:latest", outputDir, DefaultPlatform())
+	imagePath, err := DownloadImage("alpine:latest", outputDir, DefaultPlatform(), FormatDocker, nil)
 	if err != nil {
 		t.Fatalf("DownloadImage failed: %v", err)
 	}
@@ -248,7 +534,7 @@ func TestDownloadImage_WithAuthentication(t *testing.T) {
 	}
 	defer cleanupTempDir(t, outputDir)
 
-	imagePath, err := DownloadImage("busybox:latest", outputDir, DefaultPlatform())
+	imagePath, err := DownloadImage("busybox:latest", outputDir, DefaultPlatform(), FormatDocker, nil)
 	if err != nil {
 		t.Fatalf("DownloadImage with auth failed: %v", err)
 	}
@@ -269,7 +555,7 @@ func TestDownloadImage_NonExistentImage(t *testing.T) {
 	}
 	defer cleanupTempDir(t, outputDir)
 
-	_, err = DownloadImage("thisimagedoesnotexist12345:nonexistenttag", outputDir, DefaultPlatform())
+	_, err = DownloadImage("thisimagedoesnotexist12345:nonexistenttag", outputDir, DefaultPlatform(), FormatDocker, nil)
 	if err == nil {
 		t.Error("expected error for non-existent image")
 	}
@@ -315,7 +601,7 @@ func TestDownloadImage_NonExistentPlatform(t *testing.T) {
 			}
 			defer cleanupTempDir(t, outputDir)
 
-			_, err = DownloadImage(tt.image, outputDir, tt.platform)
+			_, err = DownloadImage(tt.image, outputDir, tt.platform, FormatDocker, nil)
 			if err == nil {
 				t.Errorf("expected error for unsupported platform %s/%s/%s", tt.platform.OS, tt.platform.Architecture, tt.platform.Variant)
 			}
@@ -328,7 +614,7 @@ func TestGetImagePlatforms_MultiArch(t *testing.T) {
 		t.Skip("skipping integration test")
 	}
 
-	platforms, err := GetImagePlatforms("ubuntu:latest")
+	platforms, err := GetImagePlatforms("ubuntu:latest", nil)
 	if err != nil {
 		t.Fatalf("GetImagePlatforms failed: %v", err)
 	}
@@ -354,8 +640,112 @@ func TestGetImagePlatforms_InvalidImage(t *testing.T) {
 		t.Skip("skipping integration test")
 	}
 
-	_, err := GetImagePlatforms("thisimagedoesnotexist12345:nonexistenttag")
+	_, err := GetImagePlatforms("thisimagedoesnotexist12345:nonexistenttag", nil)
 	if err == nil {
 		t.Error("expected error for non-existent image")
 	}
 }
+
+func TestCreateOutputTar_WritesAtomically(t *testing.T) {
+	srcDir, err := os.MkdirTemp("", "test-output-src-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, srcDir)
+	if err := os.WriteFile(filepath.Join(srcDir, "manifest.json"), []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir, err := os.MkdirTemp("", "test-output-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, outputDir)
+
+	if _, err := createOutputTar(filepath.Join(srcDir, "missing"), outputDir, "failed.tar.gz", FormatDocker); err == nil {
+		t.Fatal("expected an error for a missing source directory")
+	}
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected a failed build to leave nothing behind, found %s", entries[0].Name())
+	}
+
+	path, err := createOutputTar(srcDir, outputDir, "image.tar.gz", FormatDocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(outputDir, "image.tar.gz") {
+		t.Errorf("unexpected output path %s", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("expected mode 0644, got %s", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(outputDir); len(entries) != 1 {
+		t.Errorf("expected only the archive in the output directory, found %d entries", len(entries))
+	}
+}
+
+func TestRemoveOrphanedBuildDirs(t *testing.T) {
+	if !fileLocking {
+		t.Skip("file locking is not available on this platform")
+	}
+	dir, err := os.MkdirTemp("", "test-orphans-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, dir)
+
+	workspace := filepath.Join(dir, buildWorkspaceName)
+	if err := os.MkdirAll(workspace, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// An instance that is still running holds the lock on its directory
+	live, lock, err := claimBuildDir(workspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWithLog(lock, "test lock")
+
+	orphaned := filepath.Join(workspace, "123456")
+	unlocked := filepath.Join(workspace, "789012")
+	shared := filepath.Join(dir, "docker-image-123456")
+	for _, path := range []string{live, orphaned, unlocked, shared} {
+		if err := os.MkdirAll(filepath.Join(path, "docker-image-1", "layer"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(orphaned+buildLockSuffix, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	RemoveOrphanedBuildDirs(dir)
+
+	tests := []struct {
+		path    string
+		removed bool
+	}{
+		{orphaned, true},
+		{orphaned + buildLockSuffix, true},
+		{unlocked, true},
+		{live, false},
+		{lock.Name(), false},
+		// Anything outside the workspace belongs to someone else
+		{shared, false},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(tt.path)
+		if tt.removed && !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", tt.path)
+		}
+		if !tt.removed && err != nil {
+			t.Errorf("expected %s to be kept, got %v", tt.path, err)
+		}
+	}
+}
@@ -35,6 +35,7 @@ func main() {
 	var addr string
 	var cacheDir string
 	var maxCacheAge time.Duration
+	credentials := NewCredentialStore()
 
 	config, err := LoadConfig(*configPath)
 	if err != nil {
@@ -44,17 +45,36 @@ func main() {
 	} else {
 		addr = fmt.Sprintf(":%d", config.Port)
 		cacheDir = config.CacheDir
-		config.ApplyCredentials()
+		config.ApplyTrustedRegistries()
+		if len(config.TrustedPrivateRegistries) > 0 {
+			log.WithField("trusted", config.TrustedPrivateRegistries).Warn("Private address checks are disabled for trusted registries")
+		}
+		config.ApplyImagePolicy()
+		config.ConfigureCredentials(credentials)
+		config.ApplyRegistrySettings()
+		config.ApplyDownloadLimits()
+		config.ApplyRevalidateInterval()
+		config.ApplyCacheTTLPolicy()
+		config.ApplyCacheSizeLimit()
+		config.ApplyTempDir()
 		maxCacheAge = config.MaxCacheAge
 
 		log.WithField("path", *configPath).Info("Loaded configuration")
 		log.WithFields(log.Fields{
-			"cache_dir": cacheDir,
-			"max_age":   maxCacheAge,
+			"cache_dir":           cacheDir,
+			"max_age":             maxCacheAge,
+			"revalidate_interval": config.RevalidateInterval,
+			"max_size":            humanizeBytes(int64(config.MaxCacheSize)),
+			"temp_dir":            buildTempDir(),
 		}).Info("Using cache directory")
+		log.WithFields(log.Fields{
+			"per_image": config.MaxConcurrentLayers,
+			"global":    config.MaxConcurrentDownloads,
+		}).Info("Using layer download concurrency limits")
 	}
 
 	server := NewServer(addr, cacheDir, maxCacheAge)
+	server.SetCredentialStore(credentials)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -77,6 +97,7 @@ func main() {
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.WithError(err).Fatal("Server forced to shutdown")
 	}
+	server.Close()
 
 	log.Info("Server stopped")
 }
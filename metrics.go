@@ -14,4 +14,36 @@ var (
 		Name: "dockerimagesave_pulls_total",
 		Help: "The total number of docker pulls",
 	})
+	verificationFailuresMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dockerimagesave_verification_failures_total",
+		Help: "The total number of blobs or layers that failed digest verification",
+	})
+	tokenCacheHitsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dockerimagesave_token_cache_hits_total",
+		Help: "The total number of registry authentications served from the token cache",
+	})
+	tokenCacheMissesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dockerimagesave_token_cache_misses_total",
+		Help: "The total number of registry authentications that needed a new token",
+	})
+	blobStoreHitsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dockerimagesave_blob_store_hits_total",
+		Help: "The total number of blobs and layers reused from the blob store",
+	})
+	blobStoreMissesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dockerimagesave_blob_store_misses_total",
+		Help: "The total number of blobs downloaded into the blob store",
+	})
+	cacheEvictionsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dockerimagesave_cache_evictions_total",
+		Help: "The total number of cached archives evicted to stay within max_cache_size or make room for a build",
+	})
+	cacheEvictedBytesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dockerimagesave_cache_evicted_bytes_total",
+		Help: "The total number of bytes freed by evicting cached archives and their blobs",
+	})
+	cacheSizeMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dockerimagesave_cache_size_bytes",
+		Help: "The disk space used by the cache when it was last measured",
+	})
 )
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RegistryMirror is a pull-through cache that serves content of an upstream registry
+type RegistryMirror struct {
+	// Host is the mirror's hostname with an optional port
+	Host string
+	// Prefix is prepended to repository names, for caches that proxy
+	// several registries under different paths
+	Prefix string
+}
+
+// ParseRegistryMirror parses a mirror given as "host[:port][/prefix]".
+// An https:// scheme is accepted and ignored.
+func ParseRegistryMirror(value string) (RegistryMirror, error) {
+	return parseRegistryMirror(value, getTrustedRegistries())
+}
+
+// parseRegistryMirror parses a mirror, allowing private hosts listed in trusted
+func parseRegistryMirror(value string, trusted *TrustedRegistries) (RegistryMirror, error) {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "https://"), "/")
+	host, prefix, _ := strings.Cut(value, "/")
+
+	if err := validateRegistryTrusting(host, trusted); err != nil {
+		return RegistryMirror{}, fmt.Errorf("invalid mirror %q: %w", value, err)
+	}
+	if prefix != "" {
+		if err := validateRepository(prefix); err != nil {
+			return RegistryMirror{}, fmt.Errorf("invalid mirror prefix %q: %w", prefix, err)
+		}
+	}
+	return RegistryMirror{Host: strings.ToLower(host), Prefix: prefix}, nil
+}
+
+// String returns the mirror in the form it is configured
+func (m RegistryMirror) String() string {
+	if m.Prefix != "" {
+		return m.Host + "/" + m.Prefix
+	}
+	return m.Host
+}
+
+// reference rewrites ref to be fetched from the mirror
+func (m RegistryMirror) reference(ref ImageReference) ImageReference {
+	ref.Registry = m.Host
+	if m.Prefix != "" {
+		ref.Repository = m.Prefix + "/" + ref.Repository
+	}
+	return ref
+}
+
+// mirrorState is a mirror's client, or the error that made it unusable
+type mirrorState struct {
+	client *RegistryClient
+	err    error
+}
+
+// mirrorClient returns a client authenticated against mirror for ref's
+// repository. Authentication happens once per mirror; a failure is
+// remembered so later requests go straight to the next source.
+func (c *RegistryClient) mirrorClient(mirror RegistryMirror, ref ImageReference) (*RegistryClient, error) {
+	c.mirrorsMu.Lock()
+	defer c.mirrorsMu.Unlock()
+
+	key := mirror.String()
+	if state, ok := c.mirrors[key]; ok {
+		return state.client, state.err
+	}
+
+	// A mirror without transport settings of its own is reached like its registry
+	httpClient := c.httpClient
+	if transport := GetRegistrySettings(mirror.Host).Transport; transport != nil {
+		httpClient = newHTTPClient(transport)
+		httpClient.Timeout = c.httpClient.Timeout
+	}
+	client := &RegistryClient{httpClient: httpClient, credentials: c.credentials, tokens: c.tokens}
+	err := client.Authenticate(mirror.reference(ref))
+	if err != nil {
+		err = fmt.Errorf("authentication failed: %w", err)
+		client = nil
+	}
+	if c.mirrors == nil {
+		c.mirrors = make(map[string]mirrorState)
+	}
+	c.mirrors[key] = mirrorState{client: client, err: err}
+	return client, err
+}
+
+// requestManifest fetches a manifest by tag or digest from the first of the
+// registry's mirrors that has it, falling back to the registry itself
+func (c *RegistryClient) requestManifest(ctx context.Context, method string, ref ImageReference, reference string, headers map[string]string) (*http.Response, error) {
+	for _, mirror := range GetRegistrySettings(ref.Registry).Mirrors {
+		resp, err := c.requestManifestFromMirror(ctx, method, mirror, ref, reference, headers)
+		if err == nil {
+			log.WithFields(log.Fields{
+				"repository": ref.Repository,
+				"reference":  reference,
+				"source":     mirror.String(),
+			}).Info("Manifest served by mirror")
+			return resp, nil
+		}
+		logMirrorFallback(mirror, "manifest "+ref.Repository+":"+reference, err)
+	}
+
+	return c.doSafeRegistryRequest(ctx, method, ref.Registry, "/v2/%s/manifests/%s", headers, ref.Repository, reference)
+}
+
+// requestManifestFromMirror fetches a manifest from a mirror, treating any
+// response other than 200 as a miss. The mirror gets a single attempt, as a
+// failing mirror is better skipped than retried with backoff.
+func (c *RegistryClient) requestManifestFromMirror(ctx context.Context, method string, mirror RegistryMirror, ref ImageReference, reference string, headers map[string]string) (*http.Response, error) {
+	client, err := c.mirrorClient(mirror, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	mirrorRef := mirror.reference(ref)
+	resp, err := client.doSafeRegistryRequestOnce(ctx, method, mirrorRef.Registry, "/v2/%s/manifests/%s", headers, mirrorRef.Repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		drainAndClose(resp.Body)
+		return nil, fmt.Errorf("mirror returned status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// downloadBlobFromMirror makes a single attempt to download a blob from a
+// mirror. Blobs are verified against their digest, so a mirror cannot serve
+// altered content, and the next source resumes an interrupted download.
+func (c *RegistryClient) downloadBlobFromMirror(ctx context.Context, mirror RegistryMirror, ref ImageReference, digest, destPath string) error {
+	client, err := c.mirrorClient(mirror, ref)
+	if err != nil {
+		return err
+	}
+	return client.downloadBlobAttempt(ctx, mirror.reference(ref), digest, destPath)
+}
+
+// logMirrorFallback logs that a mirror could not serve content and the next source is tried
+func logMirrorFallback(mirror RegistryMirror, content string, err error) {
+	log.WithFields(log.Fields{
+		"mirror":  mirror.String(),
+		"content": content,
+	}).WithError(err).Warn("Mirror could not serve content, trying next source")
+}
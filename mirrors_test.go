@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseRegistryMirror(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected RegistryMirror
+		wantErr  bool
+	}{
+		{value: "mirror.gcr.io", expected: RegistryMirror{Host: "mirror.gcr.io"}},
+		{value: "https://mirror.gcr.io/", expected: RegistryMirror{Host: "mirror.gcr.io"}},
+		{value: "cache.example.com:5000", expected: RegistryMirror{Host: "cache.example.com:5000"}},
+		{value: "harbor.example.com/dockerhub-proxy", expected: RegistryMirror{Host: "harbor.example.com", Prefix: "dockerhub-proxy"}},
+		{value: "", wantErr: true},
+		{value: "localhost:5000", wantErr: true},
+		{value: "169.254.169.254", wantErr: true},
+		{value: "harbor.example.com/Invalid Prefix", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseRegistryMirror(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRegistryMirror(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("ParseRegistryMirror(%q) = %+v, want %+v", tt.value, got, tt.expected)
+			}
+		})
+	}
+}
+
+// fakeMirroredRegistry answers blob and manifest requests per host, recording
+// the order in which hosts were asked
+type fakeMirroredRegistry struct {
+	mu       sync.Mutex
+	serve    map[string]func(r *http.Request) (*http.Response, error)
+	requests []string
+}
+
+func (f *fakeMirroredRegistry) roundTrip(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.URL.Host+r.URL.Path)
+	f.mu.Unlock()
+
+	if r.URL.Path == "/v2/" {
+		return newTestResponse(http.StatusOK, nil), nil
+	}
+	if serve, ok := f.serve[r.URL.Host]; ok {
+		return serve(r)
+	}
+	return newTestResponse(http.StatusNotFound, nil), nil
+}
+
+func (f *fakeMirroredRegistry) requested(hostPath string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, request := range f.requests {
+		if request == hostPath {
+			return true
+		}
+	}
+	return false
+}
+
+func useMirrors(t *testing.T, registry string, mirrors ...string) {
+	t.Helper()
+	settings := RegistrySettings{Retry: RetryConfig{MaxAttempts: 1}}
+	for _, value := range mirrors {
+		mirror, err := ParseRegistryMirror(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings.Mirrors = append(settings.Mirrors, mirror)
+	}
+	SetRegistrySettings(registry, settings)
+	t.Cleanup(func() {
+		globalRegistrySettings.mu.Lock()
+		defer globalRegistrySettings.mu.Unlock()
+		delete(globalRegistrySettings.registries, normalizeRegistry(registry))
+	})
+}
+
+func TestDownloadBlob_Mirrors(t *testing.T) {
+	blob := []byte("mirrored blob content")
+	digest := sha256Digest(blob)
+	ok := func(*http.Request) (*http.Response, error) { return newTestResponse(http.StatusOK, blob), nil }
+	notFound := func(*http.Request) (*http.Response, error) { return newTestResponse(http.StatusNotFound, nil), nil }
+	unavailable := func(*http.Request) (*http.Response, error) {
+		return newTestResponse(http.StatusServiceUnavailable, nil), nil
+	}
+	corrupt := func(*http.Request) (*http.Response, error) {
+		return newTestResponse(http.StatusOK, []byte("tampered")), nil
+	}
+
+	tests := []struct {
+		name       string
+		serve      map[string]func(*http.Request) (*http.Response, error)
+		wantSource string
+		wantErr    bool
+	}{
+		{
+			name: "first mirror serves the blob",
+			serve: map[string]func(*http.Request) (*http.Response, error){
+				"mirror-a.example.com": ok,
+				"registry.example.com": ok,
+			},
+			wantSource: "mirror-a.example.com",
+		},
+		{
+			name: "falls back to second mirror on 404",
+			serve: map[string]func(*http.Request) (*http.Response, error){
+				"mirror-a.example.com": notFound,
+				"mirror-b.example.com": ok,
+			},
+			wantSource: "mirror-b.example.com",
+		},
+		{
+			name: "falls back to upstream on errors",
+			serve: map[string]func(*http.Request) (*http.Response, error){
+				"mirror-a.example.com": unavailable,
+				"mirror-b.example.com": corrupt,
+				"registry.example.com": ok,
+			},
+			wantSource: "registry.example.com",
+		},
+		{
+			name: "fails when no source has the blob",
+			serve: map[string]func(*http.Request) (*http.Response, error){
+				"mirror-a.example.com": notFound,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "test-mirrors-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupTempDir(t, tempDir)
+
+			useMirrors(t, "registry.example.com", "mirror-a.example.com", "mirror-b.example.com")
+			registry := &fakeMirroredRegistry{serve: tt.serve}
+			client := NewRegistryClient()
+			client.httpClient.Transport = roundTripFunc(registry.roundTrip)
+
+			ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+			destPath := filepath.Join(tempDir, "blob")
+			err = client.DownloadBlob(context.Background(), ref, digest, destPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DownloadBlob() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			data, err := os.ReadFile(destPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(blob) {
+				t.Errorf("expected blob content %q, got %q", blob, data)
+			}
+			if !registry.requested(tt.wantSource + "/v2/team/app/blobs/" + digest) {
+				t.Errorf("expected blob to be requested from %s, requests: %v", tt.wantSource, registry.requests)
+			}
+		})
+	}
+}
+
+func TestMirrors_TriedOnce(t *testing.T) {
+	blob := []byte("mirrored blob content")
+	digest := sha256Digest(blob)
+	manifest := []byte(`{"schemaVersion":2}`)
+
+	tempDir, err := os.MkdirTemp("", "test-mirrors-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	useMirrors(t, "registry.example.com", "mirror-a.example.com")
+	// Retries configured for the mirror's own host don't apply to it as a mirror
+	useFastRetries(t, "mirror-a.example.com", 5)
+	registry := &fakeMirroredRegistry{serve: map[string]func(*http.Request) (*http.Response, error){
+		"mirror-a.example.com": func(*http.Request) (*http.Response, error) {
+			return newTestResponse(http.StatusServiceUnavailable, nil), nil
+		},
+		"registry.example.com": func(r *http.Request) (*http.Response, error) {
+			if strings.Contains(r.URL.Path, "/manifests/") {
+				return newTestResponse(http.StatusOK, manifest), nil
+			}
+			return newTestResponse(http.StatusOK, blob), nil
+		},
+	}}
+	client := NewRegistryClient()
+	client.httpClient.Transport = roundTripFunc(registry.roundTrip)
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	resp, err := client.fetchManifestResponse(ref, ref.Reference())
+	if err != nil {
+		t.Fatalf("fetchManifestResponse failed: %v", err)
+	}
+	closeWithLog(resp.Body, "test response")
+	if err := client.DownloadBlob(context.Background(), ref, digest, filepath.Join(tempDir, "blob")); err != nil {
+		t.Fatalf("DownloadBlob() error: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, request := range registry.requests {
+		counts[request]++
+	}
+	for _, path := range []string{"/v2/team/app/manifests/latest", "/v2/team/app/blobs/" + digest} {
+		if got := counts["mirror-a.example.com"+path]; got != 1 {
+			t.Errorf("expected the mirror to be asked for %s once, got %d", path, got)
+		}
+		if got := counts["registry.example.com"+path]; got != 1 {
+			t.Errorf("expected the registry to be asked for %s once, got %d", path, got)
+		}
+	}
+}
+
+func TestFetchManifest_MirrorWithPrefix(t *testing.T) {
+	useMirrors(t, "registry-1.docker.io", "harbor.example.com/dockerhub-proxy")
+	registry := &fakeMirroredRegistry{serve: map[string]func(*http.Request) (*http.Response, error){
+		"harbor.example.com": func(r *http.Request) (*http.Response, error) {
+			if r.URL.Path != "/v2/dockerhub-proxy/library/alpine/manifests/3.20" {
+				return newTestResponse(http.StatusNotFound, nil), nil
+			}
+			return newTestResponse(http.StatusOK, []byte(`{"schemaVersion":2}`)), nil
+		},
+	}}
+	client := NewRegistryClient()
+	client.httpClient.Transport = roundTripFunc(registry.roundTrip)
+
+	ref := ParseImageReference("alpine:3.20")
+	resp, err := client.fetchManifestResponse(ref, ref.Reference())
+	if err != nil {
+		t.Fatalf("fetchManifestResponse failed: %v", err)
+	}
+	defer closeWithLog(resp.Body, "test response")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected manifest from mirror, got status %d", resp.StatusCode)
+	}
+	for _, request := range registry.requests {
+		if strings.HasPrefix(request, "registry-1.docker.io/v2/library") {
+			t.Errorf("expected upstream registry not to be asked for the manifest, got %s", request)
+		}
+	}
+}
+
+func TestMirrorClient_RemembersAuthFailure(t *testing.T) {
+	var pings int
+	client := NewRegistryClient()
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		pings++
+		return newTestResponse(http.StatusInternalServerError, nil), nil
+	})
+
+	mirror := RegistryMirror{Host: "mirror.example.com"}
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	for range 3 {
+		if _, err := client.mirrorClient(mirror, ref); err == nil {
+			t.Fatal("expected mirror authentication to fail")
+		}
+	}
+	if pings != 1 {
+		t.Errorf("expected the mirror to be contacted once, got %d", pings)
+	}
+}
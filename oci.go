@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ociLayoutVersion       = "1.0.0"
+	ociIndexMediaType      = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType   = "application/vnd.oci.image.manifest.v1+json"
+	annotationRefName      = "org.opencontainers.image.ref.name"
+	annotationImageName    = "io.containerd.image.name"
+	dockerHubRegistry      = "registry-1.docker.io"
+	dockerHubCanonicalHost = "docker.io"
+)
+
+// ociDescriptor describes a blob in an OCI image layout
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociIndex is the index.json at the root of an OCI image layout
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociBlobPath returns the path of a blob inside an OCI layout directory
+func ociBlobPath(layoutDir, digest string) string {
+	algorithm, encoded, _ := strings.Cut(digest, ":")
+	return filepath.Join(layoutDir, "blobs", algorithm, encoded)
+}
+
+// canonicalImageName returns the fully qualified image name, e.g. docker.io/library/alpine:3.20
+func canonicalImageName(ref ImageReference) string {
+	return canonicalRegistry(ref.Registry) + "/" + ref.String()
+}
+
+// canonicalRegistry returns the name users know a registry by, docker.io for Docker Hub
+func canonicalRegistry(registry string) string {
+	registry = normalizeRegistry(registry)
+	if registry == dockerHubRegistry {
+		return dockerHubCanonicalHost
+	}
+	return registry
+}
+
+// assembleOCILayout downloads the image into an OCI image layout in layoutDir,
+// keeping the registry's manifest bytes and compressed layers unchanged
+func assembleOCILayout(client *RegistryClient, ref ImageReference, manifest *ManifestV2, platform Platform, layoutDir string) error {
+	descriptor, err := writeOCIImage(client, ref, manifest, layoutDir)
+	if err != nil {
+		return err
+	}
+	descriptor.Platform = &platform
+	descriptor.Annotations = ociRefAnnotations(ref)
+
+	return writeOCILayoutFiles(layoutDir, []ociDescriptor{descriptor})
+}
+
+// writeOCIImage stores the manifest, config and layers of one image as blobs
+// and returns the descriptor of the manifest
+func writeOCIImage(client *RegistryClient, ref ImageReference, manifest *ManifestV2, layoutDir string) (ociDescriptor, error) {
+	if len(manifest.raw) == 0 {
+		return ociDescriptor{}, fmt.Errorf("manifest content not available")
+	}
+	if err := os.MkdirAll(filepath.Join(layoutDir, "blobs", "sha256"), 0755); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	if err := validateDigest(manifest.Config.Digest); err != nil {
+		return ociDescriptor{}, fmt.Errorf("invalid config digest: %w", err)
+	}
+	log.Info("Downloading image config")
+	configPath := ociBlobPath(layoutDir, manifest.Config.Digest)
+	if err := client.DownloadBlob(context.Background(), ref, manifest.Config.Digest, configPath); err != nil {
+		return ociDescriptor{}, fmt.Errorf("failed to download config: %w", err)
+	}
+	imageConfig, err := readImageConfig(configPath)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	if err := downloadOCILayers(client, ref, manifest, imageConfig, layoutDir); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	return writeOCIBlob(layoutDir, manifest.MediaType, manifest.raw)
+}
+
+// downloadOCILayers downloads the compressed layers as blobs, checking each
+// layer's uncompressed content against the diff IDs in the image config
+func downloadOCILayers(client *RegistryClient, ref ImageReference, manifest *ManifestV2, imageConfig *ImageConfig, layoutDir string) error {
+	if err := checkLayerCount(manifest, imageConfig); err != nil {
+		return err
+	}
+	if err := checkLayerMediaTypes(manifest); err != nil {
+		return err
+	}
+	if err := checkLayerDigests(manifest); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(manifest.Layers))
+	var pending []int
+	for i, layer := range manifest.Layers {
+		if seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+		pending = append(pending, i)
+	}
+
+	return downloadConcurrently(pending, func(ctx context.Context, i int) error {
+		layer := manifest.Layers[i]
+		log.WithFields(log.Fields{
+			"layer_index":  i + 1,
+			"total_layers": len(manifest.Layers),
+			"digest":       layer.Digest,
+		}).Info("Downloading layer")
+
+		blobPath := ociBlobPath(layoutDir, layer.Digest)
+		if _, err := os.Stat(blobPath); err == nil {
+			// Already present from another image in the same layout
+			return nil
+		}
+		if err := client.DownloadBlob(ctx, ref, layer.Digest, blobPath); err != nil {
+			return fmt.Errorf("failed to download layer: %w", err)
+		}
+
+		diffID, err := layerDiffID(blobPath, layer.MediaType)
+		if err != nil {
+			return fmt.Errorf("failed to decompress layer: %w", err)
+		}
+		if diffID != imageConfig.RootFS.DiffIDs[i] {
+			verificationFailuresMetric.Inc()
+			removeWithLog(blobPath)
+			return fmt.Errorf("layer %s failed verification: %w", layer.Digest,
+				&ErrDigestMismatch{Expected: imageConfig.RootFS.DiffIDs[i], Actual: diffID})
+		}
+		return nil
+	})
+}
+
+// writeOCIBlob stores content in the layout under its sha256 digest
+func writeOCIBlob(layoutDir, mediaType string, content []byte) (ociDescriptor, error) {
+	digest := sha256Digest(content)
+	if err := os.WriteFile(ociBlobPath(layoutDir, digest), content, 0644); err != nil {
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(content))}, nil
+}
+
+// ociRefAnnotations returns the annotations that name an image in index.json.
+// These follow what docker save writes so podman, ctr and skopeo tag the image on import.
+func ociRefAnnotations(ref ImageReference) map[string]string {
+	annotations := map[string]string{annotationImageName: canonicalImageName(ref)}
+	if ref.Tag != "" {
+		annotations[annotationRefName] = ref.Tag
+	}
+	return annotations
+}
+
+// writeOCILayoutFiles writes the oci-layout marker and index.json
+func writeOCILayoutFiles(layoutDir string, manifests []ociDescriptor) error {
+	layout := map[string]string{"imageLayoutVersion": ociLayoutVersion}
+	if err := marshalJSONToFile(layout, layoutDir, "oci-layout"); err != nil {
+		return err
+	}
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMediaType,
+		Manifests:     manifests,
+	}
+	return marshalJSONToFile(index, layoutDir, "index.json")
+}
+
+// fetchPlatformManifests returns the indices in list of the platforms in
+// selection and their manifests
+func fetchPlatformManifests(client *RegistryClient, ref ImageReference, list *ManifestList, selection PlatformSelection) ([]int, []*ManifestV2, error) {
+	selected, err := selectPlatformManifests(list, selection)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifests := make([]*ManifestV2, 0, len(selected))
+	for _, i := range selected {
+		entry := list.Manifests[i]
+		manifest, err := client.getManifestByDigest(ref, entry.Digest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get manifest for %s: %w", entry.platform(), err)
+		}
+		manifests = append(manifests, manifest)
+	}
+	return selected, manifests, nil
+}
+
+// assembleMultiPlatformOCILayout downloads the selected platforms of an image,
+// as returned by fetchPlatformManifests, into one OCI image layout. Blobs
+// shared between platforms are stored once.
+func assembleMultiPlatformOCILayout(client *RegistryClient, ref ImageReference, list *ManifestList, selected []int, manifests []*ManifestV2, layoutDir string) error {
+	for n, i := range selected {
+		entry := list.Manifests[i]
+		log.WithFields(log.Fields{
+			"platform": entry.platform(),
+			"digest":   entry.Digest,
+		}).Info("Downloading platform image")
+		if _, err := writeOCIImage(client, ref, manifests[n], layoutDir); err != nil {
+			return err
+		}
+	}
+
+	descriptor, err := writeOCIImageIndex(layoutDir, list, selected)
+	if err != nil {
+		return err
+	}
+	descriptor.Annotations = ociRefAnnotations(ref)
+
+	return writeOCILayoutFiles(layoutDir, []ociDescriptor{descriptor})
+}
+
+// writeOCIImageIndex stores the image index for the selected manifests. The
+// registry's own list is kept byte for byte when every entry was downloaded;
+// otherwise a new OCI index listing only the downloaded platforms is written.
+func writeOCIImageIndex(layoutDir string, list *ManifestList, selected []int) (ociDescriptor, error) {
+	if len(selected) == len(list.Manifests) && len(list.raw) > 0 {
+		return writeOCIBlob(layoutDir, list.MediaType, list.raw)
+	}
+
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType}
+	for _, i := range selected {
+		entry := list.Manifests[i]
+		platform := entry.platform()
+		index.Manifests = append(index.Manifests, ociDescriptor{
+			MediaType: entry.MediaType,
+			Digest:    entry.Digest,
+			Size:      entry.Size,
+			Platform:  &platform,
+		})
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return ociDescriptor{}, fmt.Errorf("failed to marshal image index: %w", err)
+	}
+	return writeOCIBlob(layoutDir, ociIndexMediaType, data)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeOCIImage extends fakeLayeredImage with a served config blob and raw manifest bytes
+func fakeOCIImage(t *testing.T, contents []string) (*RegistryClient, *ManifestV2) {
+	t.Helper()
+	client, manifest, imageConfig := fakeLayeredImage(t, contents, func(_ string, blob []byte) (*http.Response, error) {
+		return newTestResponse(http.StatusOK, blob), nil
+	})
+
+	configBlob, err := json.Marshal(imageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.MediaType = ociManifestMediaType
+	manifest.Config.MediaType = "application/vnd.oci.image.config.v1+json"
+	manifest.Config.Digest = sha256Digest(configBlob)
+	manifest.Config.Size = int64(len(configBlob))
+	manifest.raw, err = json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers := client.httpClient.Transport
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(r.URL.Path, manifest.Config.Digest) {
+			return newTestResponse(http.StatusOK, configBlob), nil
+		}
+		return layers.RoundTrip(r)
+	})
+	return client, manifest
+}
+
+func TestAssembleOCILayout(t *testing.T) {
+	layoutDir, err := os.MkdirTemp("", "test-oci-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, layoutDir)
+
+	client, manifest := fakeOCIImage(t, []string{"layer-a", "layer-b", "layer-a"})
+	ref := ImageReference{Registry: "registry-1.docker.io", Repository: "library/alpine", Tag: "3.20"}
+	platform := Platform{OS: "linux", Architecture: "amd64"}
+
+	if err := assembleOCILayout(client, ref, manifest, platform, layoutDir); err != nil {
+		t.Fatalf("assembleOCILayout failed: %v", err)
+	}
+
+	layout, err := os.ReadFile(filepath.Join(layoutDir, "oci-layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(layout) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Errorf("unexpected oci-layout content: %s", layout)
+	}
+
+	var index ociIndex
+	data, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("expected 1 manifest in index, got %d", len(index.Manifests))
+	}
+	descriptor := index.Manifests[0]
+	if descriptor.Digest != sha256Digest(manifest.raw) {
+		t.Errorf("index digest %s does not match manifest content", descriptor.Digest)
+	}
+	if descriptor.MediaType != ociManifestMediaType {
+		t.Errorf("expected media type %s, got %s", ociManifestMediaType, descriptor.MediaType)
+	}
+	if got := descriptor.Annotations[annotationRefName]; got != "3.20" {
+		t.Errorf("expected ref name annotation 3.20, got %q", got)
+	}
+	if got := descriptor.Annotations[annotationImageName]; got != "docker.io/library/alpine:3.20" {
+		t.Errorf("expected image name annotation docker.io/library/alpine:3.20, got %q", got)
+	}
+	if descriptor.Platform == nil || *descriptor.Platform != platform {
+		t.Errorf("expected platform %v, got %v", platform, descriptor.Platform)
+	}
+
+	for _, digest := range []string{descriptor.Digest, manifest.Config.Digest, manifest.Layers[0].Digest, manifest.Layers[1].Digest} {
+		blob, err := os.ReadFile(ociBlobPath(layoutDir, digest))
+		if err != nil {
+			t.Fatalf("missing blob %s: %v", digest, err)
+		}
+		if err := verifyContentDigest(blob, digest); err != nil {
+			t.Errorf("blob %s: %v", digest, err)
+		}
+	}
+}
+
+func TestAssembleOCILayout_DiffIDMismatch(t *testing.T) {
+	layoutDir, err := os.MkdirTemp("", "test-oci-mismatch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, layoutDir)
+
+	client, manifest := fakeOCIImage(t, []string{"layer-a"})
+
+	// Serve a config whose diff ID does not match the layer content
+	_, _, wrongDiffID := gzipLayer(t, "tampered")
+	var imageConfig ImageConfig
+	imageConfig.RootFS.DiffIDs = []string{wrongDiffID}
+	configBlob, err := json.Marshal(imageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config.Digest = sha256Digest(configBlob)
+	layers := client.httpClient.Transport
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(r.URL.Path, manifest.Config.Digest) {
+			return newTestResponse(http.StatusOK, configBlob), nil
+		}
+		return layers.RoundTrip(r)
+	})
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	err = assembleOCILayout(client, ref, manifest, DefaultPlatform(), layoutDir)
+	if _, ok := errors.AsType[*ErrDigestMismatch](err); !ok {
+		t.Fatalf("expected ErrDigestMismatch, got %v", err)
+	}
+	if _, statErr := os.Stat(ociBlobPath(layoutDir, manifest.Layers[0].Digest)); !os.IsNotExist(statErr) {
+		t.Error("expected mismatched layer blob to be removed")
+	}
+}
+
+func TestParseImageFormat(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected ImageFormat
+		wantErr  bool
+	}{
+		{value: "", expected: FormatDocker},
+		{value: "docker", expected: FormatDocker},
+		{value: "oci", expected: FormatOCI},
+		{value: "OCI", wantErr: true},
+		{value: "tar", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseImageFormat(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseImageFormat(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("ParseImageFormat(%q) = %q, want %q", tt.value, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAssembleMultiPlatformOCILayout(t *testing.T) {
+	amd64 := Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := Platform{OS: "linux", Architecture: "arm64"}
+	armv7 := Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+
+	tests := []struct {
+		name          string
+		selection     PlatformSelection
+		wantPlatforms []Platform
+		wantRawIndex  bool
+	}{
+		{
+			name:          "all platforms keeps the registry index",
+			selection:     PlatformSelection{All: true},
+			wantPlatforms: []Platform{amd64, arm64, armv7},
+			wantRawIndex:  true,
+		},
+		{
+			name:          "subset writes a filtered index",
+			selection:     PlatformSelection{Platforms: []Platform{amd64, arm64}},
+			wantPlatforms: []Platform{amd64, arm64},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layoutDir, err := os.MkdirTemp("", "test-oci-multi-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupTempDir(t, layoutDir)
+
+			registry := newFakeRegistry()
+			_, sharedDigest, _ := gzipLayer(t, "shared-base")
+			rawIndex := registry.addIndex(t, "1.0",
+				registry.addImage(t, amd64, "shared-base", "amd64-app"),
+				registry.addImage(t, arm64, "shared-base", "arm64-app"),
+				registry.addImage(t, armv7, "shared-base", "armv7-app"),
+			)
+			client := registry.client()
+			ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "1.0"}
+
+			list, _, _, err := client.getImageIndex(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selected, manifests, err := fetchPlatformManifests(client, ref, list, tt.selection)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := assembleMultiPlatformOCILayout(client, ref, list, selected, manifests, layoutDir); err != nil {
+				t.Fatalf("assembleMultiPlatformOCILayout failed: %v", err)
+			}
+
+			if got := registry.requestCount(sharedDigest); got != 1 {
+				t.Errorf("expected shared layer to be downloaded once, got %d", got)
+			}
+
+			var layoutIndex ociIndex
+			data, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(data, &layoutIndex); err != nil {
+				t.Fatal(err)
+			}
+			if len(layoutIndex.Manifests) != 1 {
+				t.Fatalf("expected index.json to reference one image index, got %d", len(layoutIndex.Manifests))
+			}
+			top := layoutIndex.Manifests[0]
+			if got := top.Annotations[annotationRefName]; got != "1.0" {
+				t.Errorf("expected ref name annotation 1.0, got %q", got)
+			}
+
+			indexBlob, err := os.ReadFile(ociBlobPath(layoutDir, top.Digest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantRawIndex != bytes.Equal(indexBlob, rawIndex) {
+				t.Errorf("raw index preserved = %v, want %v", !tt.wantRawIndex, tt.wantRawIndex)
+			}
+
+			var nested ManifestList
+			if err := json.Unmarshal(indexBlob, &nested); err != nil {
+				t.Fatal(err)
+			}
+			if len(nested.Manifests) != len(tt.wantPlatforms) {
+				t.Fatalf("expected %d manifests in image index, got %d", len(tt.wantPlatforms), len(nested.Manifests))
+			}
+			for i, entry := range nested.Manifests {
+				if entry.platform() != tt.wantPlatforms[i] {
+					t.Errorf("manifest %d: expected platform %s, got %s", i, tt.wantPlatforms[i], entry.platform())
+				}
+				if _, err := os.Stat(ociBlobPath(layoutDir, entry.Digest)); err != nil {
+					t.Errorf("missing manifest blob for %s: %v", entry.platform(), err)
+				}
+			}
+		})
+	}
+}
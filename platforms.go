@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	allPlatforms = "all"
+	// maxRequestedPlatforms bounds the platforms parameter, which also names the cache file
+	maxRequestedPlatforms = 16
+	unknownPlatform       = "unknown"
+)
+
+// PlatformSelection is the set of platforms requested for a multi-platform archive
+type PlatformSelection struct {
+	All       bool
+	Platforms []Platform
+}
+
+// ParsePlatform parses an "os/arch" or "os/arch/variant" string
+func ParsePlatform(value string) (Platform, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q (expected os/arch or os/arch/variant)", value)
+	}
+
+	platform := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	for _, field := range []struct{ name, value string }{
+		{"os", platform.OS},
+		{"arch", platform.Architecture},
+		{"variant", platform.Variant},
+	} {
+		if err := validatePlatformParam(field.name, field.value); err != nil {
+			return Platform{}, err
+		}
+	}
+	return platform, nil
+}
+
+// ParsePlatformSelection parses the platforms query parameter: either "all" or a
+// comma-separated list of platforms such as "linux/amd64,linux/arm64"
+func ParsePlatformSelection(value string) (PlatformSelection, error) {
+	if value == allPlatforms {
+		return PlatformSelection{All: true}, nil
+	}
+
+	var selection PlatformSelection
+	seen := make(map[Platform]bool)
+	for _, item := range strings.Split(value, ",") {
+		platform, err := ParsePlatform(strings.TrimSpace(item))
+		if err != nil {
+			return PlatformSelection{}, err
+		}
+		if seen[platform] {
+			continue
+		}
+		seen[platform] = true
+		selection.Platforms = append(selection.Platforms, platform)
+	}
+	if len(selection.Platforms) > maxRequestedPlatforms {
+		return PlatformSelection{}, fmt.Errorf("too many platforms requested (maximum %d)", maxRequestedPlatforms)
+	}
+
+	// Sort so the same set always maps to the same cache entry
+	sort.Slice(selection.Platforms, func(i, j int) bool {
+		return selection.Platforms[i].String() < selection.Platforms[j].String()
+	})
+	return selection, nil
+}
+
+// String returns "all" or the comma-separated list of selected platforms
+func (s PlatformSelection) String() string {
+	if s.All {
+		return allPlatforms
+	}
+	names := make([]string, len(s.Platforms))
+	for i, p := range s.Platforms {
+		names[i] = p.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// matches reports whether a manifest list entry for platform is selected.
+// "all" skips entries without a platform, such as attestation manifests.
+func (s PlatformSelection) matches(platform Platform) bool {
+	if s.All {
+		return platform.OS != unknownPlatform && platform.Architecture != unknownPlatform
+	}
+	for _, want := range s.Platforms {
+		if want.matches(platform) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether other satisfies p. An empty variant accepts any variant.
+func (p Platform) matches(other Platform) bool {
+	return p.OS == other.OS && p.Architecture == other.Architecture &&
+		(p.Variant == "" || p.Variant == other.Variant)
+}
+
+// selectPlatformManifests returns the indices of the manifest list entries in
+// selection, failing if a requested platform is not in the list
+func selectPlatformManifests(list *ManifestList, selection PlatformSelection) ([]int, error) {
+	var selected []int
+	for i := range list.Manifests {
+		if selection.matches(list.Manifests[i].platform()) {
+			selected = append(selected, i)
+		}
+	}
+
+	for _, want := range selection.Platforms {
+		found := false
+		for _, i := range selected {
+			if want.matches(list.Manifests[i].platform()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no manifest found for platform %s; available: %s", want, strings.Join(availablePlatforms(list), ", "))
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("image has no platform manifests")
+	}
+	return selected, nil
+}
+
+// availablePlatforms lists the platforms in a manifest list for error messages
+func availablePlatforms(list *ManifestList) []string {
+	available := make([]string, 0, len(list.Manifests))
+	for _, m := range list.Manifests {
+		available = append(available, m.platform().String())
+	}
+	return available
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePlatformSelection(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		wantErr  bool
+	}{
+		{value: "all", expected: "all"},
+		{value: "linux/amd64", expected: "linux/amd64"},
+		{value: "linux/arm64,linux/amd64", expected: "linux/amd64,linux/arm64"},
+		{value: "linux/amd64, linux/arm/v7", expected: "linux/amd64,linux/arm/v7"},
+		{value: "linux/amd64,linux/amd64", expected: "linux/amd64"},
+		{value: "", wantErr: true},
+		{value: "linux", wantErr: true},
+		{value: "linux/", wantErr: true},
+		{value: "linux/arm/v7/extra", wantErr: true},
+		{value: "LINUX/amd64", wantErr: true},
+		{value: "linux/amd64,", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParsePlatformSelection(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePlatformSelection(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.expected {
+				t.Errorf("ParsePlatformSelection(%q) = %q, want %q", tt.value, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsePlatformSelection_TooMany(t *testing.T) {
+	var platforms []string
+	for i := 0; i <= maxRequestedPlatforms; i++ {
+		platforms = append(platforms, "linux/arch"+strings.Repeat("x", i))
+	}
+	if _, err := ParsePlatformSelection(strings.Join(platforms, ",")); err == nil {
+		t.Fatal("expected error for too many platforms")
+	}
+}
+
+func TestSelectPlatformManifests(t *testing.T) {
+	list := makeManifestList(
+		Platform{OS: "linux", Architecture: "amd64"},
+		Platform{OS: "linux", Architecture: "arm", Variant: "v6"},
+		Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+		Platform{OS: "unknown", Architecture: "unknown"},
+	)
+
+	tests := []struct {
+		name      string
+		selection PlatformSelection
+		expected  []int
+		wantErr   bool
+	}{
+		{
+			name:      "all skips attestations",
+			selection: PlatformSelection{All: true},
+			expected:  []int{0, 1, 2},
+		},
+		{
+			name:      "exact variant",
+			selection: PlatformSelection{Platforms: []Platform{{OS: "linux", Architecture: "arm", Variant: "v7"}}},
+			expected:  []int{2},
+		},
+		{
+			name:      "no variant selects every variant",
+			selection: PlatformSelection{Platforms: []Platform{{OS: "linux", Architecture: "arm"}}},
+			expected:  []int{1, 2},
+		},
+		{
+			name: "missing platform",
+			selection: PlatformSelection{Platforms: []Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "s390x"},
+			}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectPlatformManifests(&list, tt.selection)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectPlatformManifests() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), "linux/s390x") {
+					t.Errorf("expected error to name the missing platform, got %v", err)
+				}
+				return
+			}
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Errorf("expected %v, got %v", tt.expected, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	policyActionAllow = "allow"
+	policyActionDeny  = "deny"
+)
+
+// policyPatternChars are the characters allowed in a policy rule
+var policyPatternChars = regexp.MustCompile(`^[a-z0-9._\-/:*?]+$`)
+
+// policyRule is a glob over "registry/repository". A * matches any run of
+// characters including slashes and a ? matches a single character.
+type policyRule struct {
+	action  string
+	pattern string
+	re      *regexp.Regexp
+}
+
+// ImagePolicy restricts which registries and repositories can be requested.
+// Deny rules win over allow rules; when allow rules are present, anything not
+// matching one of them is denied. A nil policy allows everything.
+type ImagePolicy struct {
+	allow []policyRule
+	deny  []policyRule
+}
+
+// ErrPolicyDenied is returned when an image is rejected by the image policy
+type ErrPolicyDenied struct {
+	Image string
+	// Action and Rule identify the rule that decided; Rule is empty when the
+	// image matched no allow rule
+	Action string
+	Rule   string
+}
+
+func (e *ErrPolicyDenied) Error() string {
+	if e.Rule == "" {
+		return fmt.Sprintf("image %s is not allowed: it matches no allow rule", e.Image)
+	}
+	return fmt.Sprintf("image %s is denied by %s rule %q", e.Image, e.Action, e.Rule)
+}
+
+// NewImagePolicy compiles allow and deny rules
+func NewImagePolicy(allow, deny []string) (*ImagePolicy, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	policy := &ImagePolicy{}
+	var err error
+	if policy.allow, err = compilePolicyRules(policyActionAllow, allow); err != nil {
+		return nil, err
+	}
+	if policy.deny, err = compilePolicyRules(policyActionDeny, deny); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func compilePolicyRules(action string, patterns []string) ([]policyRule, error) {
+	rules := make([]policyRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := compileRepositoryGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s rule: %w", action, err)
+		}
+		rules = append(rules, policyRule{action: action, pattern: pattern, re: re})
+	}
+	return rules, nil
+}
+
+// compileRepositoryGlob compiles a glob over "registry/repository" matched
+// against repositorySubject
+func compileRepositoryGlob(pattern string) (*regexp.Regexp, error) {
+	if !policyPatternChars.MatchString(pattern) {
+		return nil, fmt.Errorf("invalid pattern %q", pattern)
+	}
+	re, err := regexp.Compile("^" + globToRegexp(normalizePolicyPattern(pattern)) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+// repositorySubject returns the "registry/repository" string rules are matched against
+func repositorySubject(ref ImageReference) string {
+	return canonicalRegistry(ref.Registry) + "/" + ref.Repository
+}
+
+// normalizePolicyPattern rewrites Docker Hub aliases in a rule's registry so
+// that docker.io, index.docker.io and registry-1.docker.io are interchangeable
+func normalizePolicyPattern(pattern string) string {
+	registry, rest, found := strings.Cut(pattern, "/")
+	if !found || strings.ContainsAny(registry, "*?") {
+		return pattern
+	}
+	return canonicalRegistry(registry) + "/" + rest
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// Check returns an *ErrPolicyDenied if ref may not be requested
+func (p *ImagePolicy) Check(ref ImageReference) error {
+	if p == nil {
+		return nil
+	}
+	subject := repositorySubject(ref)
+	for _, rule := range p.deny {
+		if rule.re.MatchString(subject) {
+			return &ErrPolicyDenied{Image: subject, Action: rule.action, Rule: rule.pattern}
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.allow {
+		if rule.re.MatchString(subject) {
+			return nil
+		}
+	}
+	return &ErrPolicyDenied{Image: subject, Action: policyActionAllow}
+}
+
+// imagePolicyStore holds the image policy applied from the configuration
+type imagePolicyStore struct {
+	policy *ImagePolicy
+	mu     sync.RWMutex
+}
+
+var globalImagePolicy = &imagePolicyStore{}
+
+// SetImagePolicy sets the policy requests are checked against
+func SetImagePolicy(policy *ImagePolicy) {
+	globalImagePolicy.mu.Lock()
+	defer globalImagePolicy.mu.Unlock()
+	globalImagePolicy.policy = policy
+}
+
+// CheckImagePolicy checks ref against the configured image policy
+func CheckImagePolicy(ref ImageReference) error {
+	globalImagePolicy.mu.RLock()
+	defer globalImagePolicy.mu.RUnlock()
+	return globalImagePolicy.policy.Check(ref)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestImagePolicy_Check(t *testing.T) {
+	policy, err := NewImagePolicy(
+		[]string{"docker.io/library/*", "ghcr.io/our-org/*", "quay.io/*"},
+		[]string{"docker.io/library/abused", "quay.io/*/miner?"},
+	)
+	if err != nil {
+		t.Fatalf("NewImagePolicy() error: %v", err)
+	}
+
+	tests := []struct {
+		image      string
+		wantAction string
+		wantRule   string
+		wantDenied bool
+	}{
+		{image: "nginx:latest", wantDenied: false},
+		{image: "docker.io/library/alpine:3.19", wantDenied: false},
+		{image: "ghcr.io/our-org/app:v1", wantDenied: false},
+		{image: "ghcr.io/our-org/team/app:v1", wantDenied: false},
+		{image: "quay.io/prometheus/node-exporter:latest", wantDenied: false},
+		{image: "abused:latest", wantDenied: true, wantAction: "deny", wantRule: "docker.io/library/abused"},
+		{image: "quay.io/evil/miners:latest", wantDenied: true, wantAction: "deny", wantRule: "quay.io/*/miner?"},
+		{image: "someuser/app:latest", wantDenied: true, wantAction: "allow"},
+		{image: "ghcr.io/other-org/app:v1", wantDenied: true, wantAction: "allow"},
+		{image: "ghcr.io/our-org-fork/app:v1", wantDenied: true, wantAction: "allow"},
+		{image: "GHCR.IO/our-org/app:v1", wantDenied: false},
+		{image: "ghcr.io:443/our-org/app:v1", wantDenied: false},
+		{image: "DOCKER.IO/abused:latest", wantDenied: true, wantAction: "deny", wantRule: "docker.io/library/abused"},
+		{image: "Quay.io:443/evil/miners:latest", wantDenied: true, wantAction: "deny", wantRule: "quay.io/*/miner?"},
+		{image: "ghcr.io:5000/our-org/app:v1", wantDenied: true, wantAction: "allow"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			err := policy.Check(ParseImageReference(tt.image))
+			if !tt.wantDenied {
+				if err != nil {
+					t.Errorf("Check(%q) unexpected error: %v", tt.image, err)
+				}
+				return
+			}
+			denied, ok := errors.AsType[*ErrPolicyDenied](err)
+			if !ok {
+				t.Fatalf("Check(%q) = %v, want ErrPolicyDenied", tt.image, err)
+			}
+			if denied.Action != tt.wantAction || denied.Rule != tt.wantRule {
+				t.Errorf("Check(%q) denied by %s %q, want %s %q", tt.image, denied.Action, denied.Rule, tt.wantAction, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestImagePolicy_DockerHubAliases(t *testing.T) {
+	for _, pattern := range []string{"docker.io/library/nginx", "index.docker.io/library/nginx", "registry-1.docker.io/library/nginx"} {
+		policy, err := NewImagePolicy(nil, []string{pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := policy.Check(ParseImageReference("nginx")); err == nil {
+			t.Errorf("expected deny rule %q to match nginx", pattern)
+		}
+	}
+}
+
+func TestImagePolicy_RegistrySpellings(t *testing.T) {
+	policy, err := NewImagePolicy(nil, []string{"ghcr.io/abused/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range []string{"ghcr.io/abused/x", "GHCR.IO/abused/x", "Ghcr.Io/abused/x", "ghcr.io:443/abused/x", "GHCR.IO:443/abused/x"} {
+		if err := policy.Check(ParseImageReference(image)); err == nil {
+			t.Errorf("expected deny rule to match %s", image)
+		}
+	}
+}
+
+func TestImagePolicy_DenyOnlyAllowsEverythingElse(t *testing.T) {
+	policy, err := NewImagePolicy(nil, []string{"docker.io/library/abused"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Check(ParseImageReference("ghcr.io/anyone/app")); err != nil {
+		t.Errorf("expected image without matching deny rule to be allowed, got %v", err)
+	}
+
+	var none *ImagePolicy
+	if err := none.Check(ParseImageReference("abused")); err != nil {
+		t.Errorf("expected nil policy to allow everything, got %v", err)
+	}
+}
+
+func TestNewImagePolicy_InvalidRule(t *testing.T) {
+	for _, pattern := range []string{"", "Docker.io/library/*", "docker.io/library/[a-z]*", "quay.io/ space"} {
+		if _, err := NewImagePolicy([]string{pattern}, nil); err == nil {
+			t.Errorf("expected error for rule %q", pattern)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheLowWatermark is the share of max_cache_size that eviction brings the
+// cache down to, so that the next build doesn't trigger another round at once
+const cacheLowWatermark = 0.9
+
+// cacheSizeLimit holds the maximum size of the cache directory
+var cacheSizeLimit = struct {
+	mu       sync.RWMutex
+	maxBytes int64
+}{}
+
+// SetMaxCacheSize sets the disk space the cache may use; 0 removes the limit
+func SetMaxCacheSize(maxBytes int64) {
+	cacheSizeLimit.mu.Lock()
+	defer cacheSizeLimit.mu.Unlock()
+	cacheSizeLimit.maxBytes = maxBytes
+}
+
+// currentMaxCacheSize returns the configured cache size limit
+func currentMaxCacheSize() int64 {
+	cacheSizeLimit.mu.RLock()
+	defer cacheSizeLimit.mu.RUnlock()
+	return cacheSizeLimit.maxBytes
+}
+
+// cachedArchive is an archive in the cache directory that can be evicted
+type cachedArchive struct {
+	path       string
+	size       int64
+	lastServed time.Time
+	// stored are the paths of the stored blobs and layers it was built from
+	stored []string
+}
+
+// cacheUsage is the disk space used by the cache directory
+type cacheUsage struct {
+	total    int64
+	archives []cachedArchive
+	// storedSizes holds the size of each stored blob and layer, storedRefs
+	// how many cached archives reference it
+	storedSizes map[string]int64
+	storedRefs  map[string]int
+}
+
+// measureUsage adds up the archives recorded in the cache index and the blob
+// store. Archives still being written are not counted.
+func (c *CacheManager) measureUsage() (*cacheUsage, error) {
+	usage := &cacheUsage{storedSizes: make(map[string]int64), storedRefs: make(map[string]int)}
+	for name, entry := range c.index.snapshot() {
+		archive := cachedArchive{
+			path:       filepath.Join(c.dir, name),
+			size:       entry.Size,
+			lastServed: entry.LastAccess,
+			stored:     c.storedPaths(entry.Blobs, entry.Layers),
+		}
+		for _, path := range archive.stored {
+			usage.storedRefs[path]++
+		}
+		usage.total += archive.size
+		usage.archives = append(usage.archives, archive)
+	}
+
+	for _, kind := range []string{blobsDirName, layersDirName} {
+		err := filepath.WalkDir(filepath.Join(c.dir, kind), func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			usage.storedSizes[path] = info.Size()
+			usage.total += info.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+// EnforceMaxSize evicts the least recently served archives, and the stored
+// blobs only they used, once the cache grows beyond max_cache_size. The
+// archive at keep, which is about to be served, is never evicted.
+func (c *CacheManager) EnforceMaxSize(keep string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enforceMaxSize(keep)
+}
+
+// enforceMaxSize is EnforceMaxSize for callers holding c.mu
+func (c *CacheManager) enforceMaxSize(keep string) {
+	limit := currentMaxCacheSize()
+	if limit <= 0 {
+		return
+	}
+	usage, err := c.measureUsage()
+	if err != nil {
+		log.WithError(err).Error("Failed to measure cache size")
+		return
+	}
+	if usage.total > limit {
+		log.WithFields(log.Fields{
+			"size":  humanizeBytes(usage.total),
+			"limit": humanizeBytes(limit),
+		}).Info("Cache is over its size limit")
+		c.evictLeastRecentlyServed(usage, int64(float64(limit)*cacheLowWatermark), keep)
+	}
+	cacheSizeMetric.Set(float64(usage.total))
+}
+
+// FreeSpace evicts the least recently served archives until the filesystem
+// holding the cache has required bytes available, reporting whether it does
+func (c *CacheManager) FreeSpace(required int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	available, ok := availableSpace(c.dir)
+	if !ok || available >= required {
+		return true
+	}
+	usage, err := c.measureUsage()
+	if err != nil {
+		log.WithError(err).Error("Failed to measure cache size")
+		return false
+	}
+	if usage.total < required-available {
+		// Emptying the cache would not be enough, so keep it
+		return false
+	}
+	log.WithFields(log.Fields{
+		"required":  humanizeBytes(required),
+		"available": humanizeBytes(available),
+	}).Info("Evicting cached files to make room for a build")
+	c.evictLeastRecentlyServed(usage, usage.total-(required-available), "")
+	cacheSizeMetric.Set(float64(usage.total))
+
+	available, ok = availableSpace(c.dir)
+	return !ok || available >= required
+}
+
+// evictLeastRecentlyServed removes archives, least recently served first,
+// until usage drops to target, and then the stored blobs no longer referenced
+func (c *CacheManager) evictLeastRecentlyServed(usage *cacheUsage, target int64, keep string) {
+	archives := slices.Clone(usage.archives)
+	slices.SortFunc(archives, func(a, b cachedArchive) int {
+		return a.lastServed.Compare(b.lastServed)
+	})
+
+	for _, archive := range archives {
+		if usage.total <= target {
+			break
+		}
+		if archive.path == keep {
+			continue
+		}
+		if err := os.Remove(archive.path); err != nil && !os.IsNotExist(err) {
+			log.WithField("file", archive.path).WithError(err).Error("Failed to evict cached file")
+			continue
+		}
+		removeWithLog(metadataPath(archive.path))
+		c.index.remove(archive.path)
+
+		freed := archive.size
+		for _, path := range archive.stored {
+			if usage.storedRefs[path]--; usage.storedRefs[path] == 0 {
+				freed += usage.storedSizes[path]
+			}
+		}
+		usage.total -= freed
+		cacheEvictionsMetric.Inc()
+		cacheEvictedBytesMetric.Add(float64(freed))
+		log.WithFields(log.Fields{
+			"file":        filepath.Base(archive.path),
+			"last_served": archive.lastServed,
+			"freed":       humanizeBytes(freed),
+		}).Info("Evicted cached file")
+	}
+
+	referenced := make(map[string]bool, len(usage.storedRefs))
+	for path, refs := range usage.storedRefs {
+		if refs > 0 {
+			referenced[path] = true
+		}
+	}
+	c.blobs.evict(referenced)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCachedArchive creates an archive of the given size last served at lastServed
+func writeCachedArchive(t *testing.T, dir, name string, size int, lastServed time.Time) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, lastServed, lastServed); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnforceMaxSize(t *testing.T) {
+	now := time.Now()
+	names := []string{"a.tar.gz", "b.tar.gz", "c.tar.gz", "d.tar.gz", "e.tar.gz"}
+
+	tests := []struct {
+		name    string
+		limit   int64
+		keep    string
+		served  string
+		evicted []string
+	}{
+		{name: "no limit", limit: 0},
+		{name: "within limit", limit: 1500},
+		// 1500 bytes against a 1000 byte limit: down to the 900 byte watermark
+		{name: "evicts least recently served", limit: 1000, evicted: []string{"a.tar.gz", "b.tar.gz"}},
+		{name: "keeps the archive being served", limit: 1000, keep: "a.tar.gz", evicted: []string{"b.tar.gz", "c.tar.gz"}},
+		// Hits recorded in the cache index count as serving the archive
+		{name: "goes by the cache index", limit: 1000, served: "a.tar.gz", evicted: []string{"b.tar.gz", "c.tar.gz"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "test-quota-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupTempDir(t, tempDir)
+
+			// a.tar.gz was served longest ago, e.tar.gz most recently
+			for i, name := range names {
+				writeCachedArchive(t, tempDir, name, 300, now.Add(-time.Duration(len(names)-i)*time.Hour))
+			}
+
+			SetMaxCacheSize(tt.limit)
+			t.Cleanup(func() { SetMaxCacheSize(0) })
+
+			cache, _ := NewCacheManager(tempDir, 48*time.Hour)
+			if tt.served != "" {
+				cache.RecordHit(filepath.Join(tempDir, tt.served))
+			}
+			keep := ""
+			if tt.keep != "" {
+				keep = filepath.Join(tempDir, tt.keep)
+			}
+			cache.EnforceMaxSize(keep)
+
+			for _, name := range names {
+				_, err := os.Stat(filepath.Join(tempDir, name))
+				wantEvicted := slices.Contains(tt.evicted, name)
+				if wantEvicted && !os.IsNotExist(err) {
+					t.Errorf("%s was not evicted", name)
+				}
+				if !wantEvicted && err != nil {
+					t.Errorf("%s was evicted: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEnforceMaxSize_EvictsUnsharedBlobs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-quota-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+
+	cache, _ := NewCacheManager(tempDir, 48*time.Hour)
+	shared := "sha256:" + strings.Repeat("a", 64)
+	exclusive := "sha256:" + strings.Repeat("b", 64)
+	for _, digest := range []string{shared, exclusive} {
+		path, err := cache.blobs.blobPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	oldest := writeCachedArchive(t, tempDir, "old.tar.gz", 100, now.Add(-2*time.Hour))
+	newest := writeCachedArchive(t, tempDir, "new.tar.gz", 100, now.Add(-time.Hour))
+	if err := writeArchiveMetadata(oldest, archiveMetadata{Blobs: []string{shared, exclusive}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeArchiveMetadata(newest, archiveMetadata{Blobs: []string{shared}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.index.sync()
+
+	// Evicting old.tar.gz and the blob only it used brings the cache under 1800 bytes
+	SetMaxCacheSize(2000)
+	t.Cleanup(func() { SetMaxCacheSize(0) })
+	cache.EnforceMaxSize("")
+
+	if _, err := os.Stat(oldest); !os.IsNotExist(err) {
+		t.Error("least recently served archive was not evicted")
+	}
+	if _, err := os.Stat(newest); err != nil {
+		t.Errorf("recently served archive was evicted: %v", err)
+	}
+	exclusivePath, _ := cache.blobs.blobPath(exclusive)
+	if _, err := os.Stat(exclusivePath); !os.IsNotExist(err) {
+		t.Error("blob used only by the evicted archive was kept")
+	}
+	sharedPath, _ := cache.blobs.blobPath(shared)
+	if _, err := os.Stat(sharedPath); err != nil {
+		t.Errorf("blob still used by a cached archive was evicted: %v", err)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	names := []string{"a.tar.gz", "b.tar.gz", "c.tar.gz"}
+
+	tests := []struct {
+		name     string
+		required int64
+		want     bool
+		evicted  []string
+	}{
+		{name: "already available", required: 500, want: true},
+		// 1000 bytes available, so 1500 more are needed
+		{name: "evicts least recently served", required: 2500, want: true, evicted: []string{"a.tar.gz", "b.tar.gz"}},
+		// Emptying the cache would leave 4000 bytes, so nothing is evicted
+		{name: "not enough even when empty", required: 5000, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "test-quota-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupTempDir(t, tempDir)
+
+			cache, _ := NewCacheManager(tempDir, 48*time.Hour)
+			now := time.Now()
+			for i, name := range names {
+				writeCachedArchive(t, tempDir, name, 1000, now.Add(-time.Duration(len(names)-i)*time.Hour))
+			}
+			cache.index.sync()
+			cache.SaveIndex()
+			// Leave 1000 bytes free on top of the index file
+			indexInfo, err := os.Stat(filepath.Join(tempDir, cacheIndexName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			useFakeDisk(t, tempDir, 4000+indexInfo.Size())
+
+			if got := cache.FreeSpace(tt.required); got != tt.want {
+				t.Errorf("FreeSpace(%d) = %v, want %v", tt.required, got, tt.want)
+			}
+			for _, name := range names {
+				_, err := os.Stat(filepath.Join(tempDir, name))
+				wantEvicted := slices.Contains(tt.evicted, name)
+				if wantEvicted && !os.IsNotExist(err) {
+					t.Errorf("%s was not evicted", name)
+				}
+				if !wantEvicted && err != nil {
+					t.Errorf("%s was evicted: %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -33,13 +35,97 @@ type ImageReference struct {
 	Registry   string
 	Repository string
 	Tag        string
+	Digest     string // set when the image is pinned with @sha256:...
 }
 
+// Reference returns the manifest reference to request from the registry:
+// the digest for pinned images, the tag otherwise.
+func (r ImageReference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// String returns the reference as repository[:tag][@digest]
+func (r ImageReference) String() string {
+	s := r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// tokenRefreshMargin is how long before expiry a bearer token is renewed
+const tokenRefreshMargin = 30 * time.Second
+
+// defaultTokenLifetime is assumed when a token response has no expires_in,
+// as specified by the distribution token authentication spec
+const defaultTokenLifetime = 60 * time.Second
+
 // RegistryClient handles communication with Docker registries
 type RegistryClient struct {
-	httpClient *http.Client
-	token      string
-	username   string // Track authenticated user for logging
+	httpClient  *http.Client
+	token       string
+	tokenExpiry time.Time
+	username    string // Track authenticated user for logging
+
+	// credentials resolves registry credentials; nil means anonymous access
+	credentials *CredentialStore
+	// tokens shares tokens with other clients; nil disables caching
+	tokens   *tokenCache
+	tokenKey tokenCacheKey
+
+	// tokenSource holds what is needed to obtain a new token once the current one expires
+	tokenSource *tokenSource
+	// basicAuth is the Authorization header for registries that use Basic
+	// authentication instead of tokens
+	basicAuth string
+	mu        sync.Mutex
+
+	// mirrors holds a client per configured mirror of the registry, created on first use
+	mirrors   map[string]mirrorState
+	mirrorsMu sync.Mutex
+
+	// blobs keeps downloaded blobs in the cache's blob store for reuse; nil
+	// downloads them straight to their destination
+	blobs *blobLease
+
+	// singleAttempt disables the registry's retry policy, for requests that
+	// are better given up on than delayed
+	singleAttempt bool
+}
+
+// ErrAuthenticationFailed is returned when the token endpoint refuses to issue a token
+type ErrAuthenticationFailed struct {
+	StatusCode int
+}
+
+func (e *ErrAuthenticationFailed) Error() string {
+	return fmt.Sprintf("authentication failed (status %d): check credentials or verify the image exists", e.StatusCode)
+}
+
+// tokenSource describes how a bearer token was obtained so it can be renewed
+type tokenSource struct {
+	realm          string
+	service        string
+	scope          string
+	creds          RegistryCredentials
+	hasCredentials bool
+	// oauth2 selects the OAuth2 POST flow instead of GET with Basic credentials
+	oauth2 bool
+	// refreshToken is an identity token or a refresh token issued by the
+	// OAuth2 endpoint, used instead of the password once known
+	refreshToken string
+}
+
+// bearerToken is a registry token and the time it stops being valid
+type bearerToken struct {
+	value     string
+	expiresAt time.Time
 }
 
 // ManifestV2 represents a Docker manifest schema v2
@@ -56,6 +142,9 @@ type ManifestV2 struct {
 		Size      int64  `json:"size"`
 		Digest    string `json:"digest"`
 	} `json:"layers"`
+
+	// raw holds the manifest exactly as served so it can be stored byte for byte
+	raw []byte
 }
 
 // Platform represents a target OS/architecture combination
@@ -80,18 +169,29 @@ func (p Platform) String() string {
 
 // ManifestList represents a multi-platform manifest list
 type ManifestList struct {
-	SchemaVersion int    `json:"schemaVersion"`
-	MediaType     string `json:"mediaType"`
-	Manifests     []struct {
-		MediaType string `json:"mediaType"`
-		Size      int64  `json:"size"`
-		Digest    string `json:"digest"`
-		Platform  struct {
-			Architecture string `json:"architecture"`
-			OS           string `json:"os"`
-			Variant      string `json:"variant"`
-		} `json:"platform"`
-	} `json:"manifests"`
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Manifests     []ManifestDescriptor `json:"manifests"`
+
+	// raw holds the manifest list exactly as served so it can be stored byte for byte
+	raw []byte
+}
+
+// ManifestDescriptor is a platform-specific entry in a manifest list
+type ManifestDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+	Platform  struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform"`
+}
+
+// platform returns the entry's platform
+func (d ManifestDescriptor) platform() Platform {
+	return Platform{OS: d.Platform.OS, Architecture: d.Platform.Architecture, Variant: d.Platform.Variant}
 }
 
 // ImageConfig represents the image configuration
@@ -110,13 +210,21 @@ type ImageConfig struct {
 	} `json:"rootfs"`
 }
 
-// ParseImageReference parses an image reference string
+// ParseImageReference parses an image reference string. Digest-pinned
+// references (name@sha256:... or name:tag@sha256:...) keep the digest in
+// Digest; a digest without an explicit tag leaves Tag empty.
 func ParseImageReference(ref string) ImageReference {
 	result := ImageReference{
 		Registry: "registry-1.docker.io",
 		Tag:      "latest",
 	}
 
+	if idx := strings.Index(ref, "@"); idx != -1 {
+		result.Digest = ref[idx+1:]
+		result.Tag = ""
+		ref = ref[:idx]
+	}
+
 	if idx := strings.LastIndex(ref, ":"); idx != -1 && !strings.Contains(ref[idx:], "/") {
 		result.Tag = ref[idx+1:]
 		ref = ref[:idx]
@@ -136,18 +244,21 @@ func ParseImageReference(ref string) ImageReference {
 	return result
 }
 
-// NewRegistryClient creates a new registry client
+// NewRegistryClient creates a new registry client using the default transport
 func NewRegistryClient() *RegistryClient {
-	return &RegistryClient{
-		httpClient: &http.Client{
-			Timeout: 300 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					MinVersion: tls.VersionTLS12,
-				},
-			},
-		},
+	return &RegistryClient{httpClient: newHTTPClient(newSafeTransport())}
+}
+
+// newRegistryClientFor creates a client using the transport configured for
+// registry, the process-wide token cache and the given credentials
+func newRegistryClientFor(registry string, credentials *CredentialStore) *RegistryClient {
+	client := NewRegistryClient()
+	client.credentials = credentials
+	if transport := GetRegistrySettings(registry).Transport; transport != nil {
+		client.httpClient = newHTTPClient(transport)
 	}
+	client.tokens = globalTokenCache
+	return client
 }
 
 // Authenticate obtains a token for the given image
@@ -156,12 +267,38 @@ func (c *RegistryClient) Authenticate(ref ImageReference) error {
 		return fmt.Errorf(invalidImageReferenceFormat, err)
 	}
 
-	creds, hasCredentials := GetCredentials(ref.Registry)
+	scoped, hasCredentials, err := c.credentials.Lookup(ref.Registry, ref.Repository)
+	if err != nil {
+		return err
+	}
+	creds := scoped.RegistryCredentials
 	c.username = "anonymous"
 	if hasCredentials {
 		c.username = creds.Username
 	}
 
+	c.tokenKey = tokenCacheKey{
+		registry: normalizeRegistry(ref.Registry),
+		scope:    repositoryPullScope(ref.Repository),
+		identity: credentialIdentity(creds, hasCredentials),
+	}
+	if c.tokens != nil {
+		if token, source, ok := c.tokens.get(c.tokenKey); ok {
+			tokenCacheHitsMetric.Inc()
+			log.WithField("registry", ref.Registry).Debug("Using cached registry token")
+			if !source.hasCredentials {
+				c.username = "anonymous"
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.tokenSource = source
+			c.token = token.value
+			c.tokenExpiry = token.expiresAt
+			return nil
+		}
+		tokenCacheMissesMetric.Inc()
+	}
+
 	registryURL, err := buildRegistryURL(ref.Registry, "/v2/")
 	if err != nil {
 		return err
@@ -181,22 +318,103 @@ func (c *RegistryClient) Authenticate(ref ImageReference) error {
 		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
 	}
 
-	authHeader := resp.Header.Get("WWW-Authenticate")
-	if authHeader == "" {
+	authHeaders := resp.Header.Values("WWW-Authenticate")
+	if len(authHeaders) == 0 {
 		return fmt.Errorf("no WWW-Authenticate header")
 	}
+	challenges := parseAuthChallenges(authHeaders)
+	bearer, ok := findAuthChallenge(challenges, "bearer")
+	if !ok {
+		if _, ok := findAuthChallenge(challenges, "basic"); ok {
+			return c.authenticateBasic(context.Background(), registryURL, creds, hasCredentials)
+		}
+		return fmt.Errorf("unsupported authentication scheme: %s", strings.Join(authHeaders, ", "))
+	}
 
-	realm, service, scope := parseAuthHeader(authHeader, ref.Repository)
-
+	realm, service := bearer.params["realm"], bearer.params["service"]
+	scope := repositoryPullScope(ref.Repository)
 	if err := validateAuthRealm(realm); err != nil {
 		return err
 	}
 
-	token, err := c.fetchToken(realm, service, scope, creds, hasCredentials)
+	source := &tokenSource{
+		realm:          realm,
+		service:        service,
+		scope:          scope,
+		creds:          creds,
+		hasCredentials: hasCredentials,
+		// Identity tokens can only be exchanged with the OAuth2 flow
+		oauth2:       creds.IdentityToken != "" || GetRegistrySettings(ref.Registry).OAuth2,
+		refreshToken: creds.IdentityToken,
+	}
+	token, err := c.fetchToken(context.Background(), source)
+	if _, rejected := errors.AsType[*ErrAuthenticationFailed](err); rejected && hasCredentials && scoped.AnonymousFallback {
+		log.WithFields(log.Fields{
+			"registry": ref.Registry,
+			"scope":    scoped.Scope,
+		}).Warn("Credentials rejected, retrying anonymously")
+		source = &tokenSource{realm: realm, service: service, scope: scope}
+		c.username = "anonymous"
+		token, err = c.fetchToken(context.Background(), source)
+	}
 	if err != nil {
 		return err
 	}
-	c.token = token
+	if c.tokens != nil {
+		c.tokens.put(c.tokenKey, token, source)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokenSource = source
+	c.token = token.value
+	c.tokenExpiry = token.expiresAt
+	return nil
+}
+
+// currentToken returns the bearer token to use for a request, renewing it
+// first if it is about to expire.
+func (c *RegistryClient) currentToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	token, expiry, source := c.token, c.tokenExpiry, c.tokenSource
+	c.mu.Unlock()
+
+	if source == nil || token == "" || time.Until(expiry) > tokenRefreshMargin {
+		return token, nil
+	}
+
+	log.WithField("expires_at", expiry).Debug("Registry token about to expire, renewing")
+	if err := c.renewToken(ctx, token); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token, nil
+}
+
+// renewToken obtains a new bearer token unless another request already
+// replaced staleToken in the meantime.
+func (c *RegistryClient) renewToken(ctx context.Context, staleToken string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokenSource == nil {
+		return fmt.Errorf("no token source to renew the registry token")
+	}
+	if c.token != staleToken {
+		return nil
+	}
+
+	token, err := c.fetchToken(ctx, c.tokenSource)
+	if err != nil {
+		return fmt.Errorf("failed to renew registry token: %w", err)
+	}
+	if c.tokens != nil {
+		c.tokens.put(c.tokenKey, token, c.tokenSource)
+	}
+	c.token = token.value
+	c.tokenExpiry = token.expiresAt
 	return nil
 }
 
@@ -215,44 +433,67 @@ func validateAuthRealm(realm string) error {
 	return nil
 }
 
-// fetchToken requests a Bearer token from the auth realm and returns it.
-func (c *RegistryClient) fetchToken(realm, service, scope string, creds RegistryCredentials, hasCredentials bool) (string, error) {
-	tokenURL := fmt.Sprintf("%s?service=%s&scope=%s", realm, url.QueryEscape(service), url.QueryEscape(scope))
+// fetchToken requests a Bearer token from the auth realm and returns it along with its expiry.
+func (c *RegistryClient) fetchToken(ctx context.Context, source *tokenSource) (bearerToken, error) {
+	if source.oauth2 && source.hasCredentials {
+		return c.fetchOAuth2Token(ctx, source)
+	}
+	tokenURL := fmt.Sprintf("%s?service=%s&scope=%s", source.realm, url.QueryEscape(source.service), url.QueryEscape(source.scope))
 
-	req, err := http.NewRequest("GET", tokenURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", tokenURL, nil)
 	if err != nil {
-		return "", err
+		return bearerToken{}, err
 	}
-	if hasCredentials {
-		auth := base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
-		req.Header.Set("Authorization", "Basic "+auth)
+	if source.hasCredentials {
+		req.Header.Set("Authorization", basicAuthorization(source.creds))
 	}
 
+	requestedAt := time.Now()
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return "", err
+		return bearerToken{}, err
 	}
 	defer closeWithLog(resp.Body, responseBodyStr)
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
 		log.WithField("response_body", string(body)).WithField("status_code", resp.StatusCode).Debug("Authentication request failed")
-		return "", fmt.Errorf("authentication failed (status %d): check credentials or verify the image exists", resp.StatusCode)
+		return bearerToken{}, &ErrAuthenticationFailed{StatusCode: resp.StatusCode}
 	}
 
 	var tokenResp struct {
 		Token       string `json:"token"`
 		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		IssuedAt    string `json:"issued_at"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return "", err
+		return bearerToken{}, err
 	}
 
 	token := tokenResp.Token
 	if token == "" {
 		token = tokenResp.AccessToken
 	}
-	return token, nil
+	return bearerToken{
+		value:     token,
+		expiresAt: tokenExpiry(requestedAt, tokenResp.IssuedAt, tokenResp.ExpiresIn),
+	}, nil
+}
+
+// tokenExpiry computes when a token expires from its issued_at and expires_in
+// fields. The issue time is never taken to be later than when we asked for the
+// token, so a registry clock running ahead cannot extend a token's lifetime.
+func tokenExpiry(requestedAt time.Time, issuedAt string, expiresIn int) time.Time {
+	lifetime := defaultTokenLifetime
+	if expiresIn > 0 {
+		lifetime = time.Duration(expiresIn) * time.Second
+	}
+	issued := requestedAt
+	if t, err := time.Parse(time.RFC3339, issuedAt); err == nil && t.Before(requestedAt) {
+		issued = t
+	}
+	return issued.Add(lifetime)
 }
 
 // GetAuthenticatedUser returns the username used for authentication
@@ -260,28 +501,18 @@ func (c *RegistryClient) GetAuthenticatedUser() string {
 	return c.username
 }
 
+// parseAuthHeader returns the realm and service of the Bearer challenge in
+// header and the pull scope for repo
 func parseAuthHeader(header, repo string) (realm, service, scope string) {
-	header = strings.TrimPrefix(header, bearerPrefix)
-	parts := strings.Split(header, ",")
-
-	for _, part := range parts {
-		kv := strings.SplitN(part, "=", 2)
-		if len(kv) != 2 {
-			continue
-		}
-		key := strings.TrimSpace(kv[0])
-		value := strings.Trim(kv[1], "\"")
-
-		switch key {
-		case "realm":
-			realm = value
-		case "service":
-			service = value
-		}
+	if bearer, ok := findAuthChallenge(parseAuthChallenges([]string{header}), "bearer"); ok {
+		realm, service = bearer.params["realm"], bearer.params["service"]
 	}
+	return realm, service, repositoryPullScope(repo)
+}
 
-	scope = fmt.Sprintf("repository:%s:pull", repo)
-	return
+// repositoryPullScope is the token scope needed to pull from repo
+func repositoryPullScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull", repo)
 }
 
 const manifestAcceptHeader = "application/vnd.docker.distribution.manifest.v2+json, application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.list.v2+json, application/vnd.oci.image.index.v1+json"
@@ -294,21 +525,13 @@ func isManifestList(contentType string) bool {
 // selectManifestDigest selects the manifest matching the given platform from a manifest list
 func (c *RegistryClient) selectManifestDigest(ref ImageReference, list *ManifestList, platform Platform) (*ManifestV2, error) {
 	for _, m := range list.Manifests {
-		osMatch := m.Platform.OS == platform.OS
-		archMatch := m.Platform.Architecture == platform.Architecture
 		// When no variant is requested, accept any variant (picks first match)
-		variantMatch := platform.Variant == "" || m.Platform.Variant == platform.Variant
-		if osMatch && archMatch && variantMatch {
+		if platform.matches(m.platform()) {
 			return c.getManifestByDigest(ref, m.Digest)
 		}
 	}
 
-	available := make([]string, 0, len(list.Manifests))
-	for _, m := range list.Manifests {
-		p := Platform{OS: m.Platform.OS, Architecture: m.Platform.Architecture, Variant: m.Platform.Variant}
-		available = append(available, p.String())
-	}
-	return nil, fmt.Errorf("no manifest found for platform %s; available: %s", platform, strings.Join(available, ", "))
+	return nil, fmt.Errorf("no manifest found for platform %s; available: %s", platform, strings.Join(availablePlatforms(list), ", "))
 }
 
 // parseManifestResponse parses the manifest response body based on content type
@@ -321,62 +544,78 @@ func (c *RegistryClient) parseManifestResponse(ref ImageReference, contentType s
 		return c.selectManifestDigest(ref, &list, platform)
 	}
 
+	return decodeManifest(contentType, body)
+}
+
+// decodeManifest unmarshals a single-image manifest and keeps its raw bytes.
+// The media type falls back to the Content-Type for manifests that omit it.
+func decodeManifest(contentType string, body []byte) (*ManifestV2, error) {
 	var manifest ManifestV2
 	if err := json.Unmarshal(body, &manifest); err != nil {
 		return nil, err
 	}
+	if manifest.MediaType == "" {
+		mediaType, _, _ := strings.Cut(contentType, ";")
+		manifest.MediaType = strings.TrimSpace(mediaType)
+	}
+	manifest.raw = body
 	return &manifest, nil
 }
 
 // GetPlatforms returns the list of available platforms for a multi-arch image.
 // Returns nil, nil if the image is single-arch.
 func (c *RegistryClient) GetPlatforms(ref ImageReference) ([]Platform, error) {
-	resp, err := c.fetchManifestResponse(ref, ref.Tag)
-	if err != nil {
+	list, _, _, err := c.getImageIndex(ref)
+	if err != nil || list == nil {
 		return nil, err
 	}
-	defer closeWithLog(resp.Body, responseBodyStr)
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		// handled below
-	case http.StatusNotFound:
-		return nil, &ErrImageNotFound{Image: ref.Repository + ":" + ref.Tag}
-	case http.StatusUnauthorized, http.StatusForbidden:
-		return nil, fmt.Errorf("access denied (status %d): check credentials or verify the image exists", resp.StatusCode)
-	default:
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to get manifest: %d - %s", resp.StatusCode, string(body))
-	}
-
-	contentType := resp.Header.Get("Content-Type")
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	platforms := make([]Platform, 0, len(list.Manifests))
+	for _, m := range list.Manifests {
+		platforms = append(platforms, m.platform())
 	}
+	return platforms, nil
+}
 
-	if !isManifestList(contentType) {
-		return nil, nil
+// doSafeRegistryRequest executes a registry GET or HEAD request, retrying transient
+// failures (network errors, 429 and 5xx) according to the registry's retry policy.
+func (c *RegistryClient) doSafeRegistryRequest(ctx context.Context, method, registry, pathFormat string, headers map[string]string, args ...interface{}) (*http.Response, error) {
+	policy := GetRegistrySettings(registry).Retry
+	if c.singleAttempt {
+		policy.MaxAttempts = 1
 	}
+	for attempt := 1; ; attempt++ {
+		resp, err := c.doSafeRegistryRequestOnce(ctx, method, registry, pathFormat, headers, args...)
+
+		var retryAfter time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || !isTransportError(err) {
+				return nil, err
+			}
+		case isRetryableStatus(resp.StatusCode):
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		default:
+			return resp, nil
+		}
 
-	var list ManifestList
-	if err := json.Unmarshal(body, &list); err != nil {
-		return nil, err
-	}
+		if attempt >= policy.MaxAttempts {
+			return resp, err
+		}
+		if resp != nil {
+			drainAndClose(resp.Body)
+		}
 
-	platforms := make([]Platform, 0, len(list.Manifests))
-	for _, m := range list.Manifests {
-		platforms = append(platforms, Platform{
-			OS:           m.Platform.OS,
-			Architecture: m.Platform.Architecture,
-			Variant:      m.Platform.Variant,
-		})
+		delay := policy.backoff(attempt, retryAfter)
+		logRetry(registry, attempt, policy.MaxAttempts, delay, resp, err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
 	}
-	return platforms, nil
 }
 
-// doSafeRegistryRequest constructs a validated URL from registry components and executes an HTTP GET request.
-func (c *RegistryClient) doSafeRegistryRequest(registry, pathFormat string, headers map[string]string, args ...interface{}) (*http.Response, error) {
+// doSafeRegistryRequestOnce constructs a validated URL from registry components and executes a single HTTP request.
+func (c *RegistryClient) doSafeRegistryRequestOnce(ctx context.Context, method, registry, pathFormat string, headers map[string]string, args ...interface{}) (*http.Response, error) {
 	requestURL, err := buildRegistryURL(registry, pathFormat, args...)
 	if err != nil {
 		return nil, err
@@ -396,7 +635,43 @@ func (c *RegistryClient) doSafeRegistryRequest(registry, pathFormat string, head
 		Path:   parsedURL.Path,
 	}
 
-	req, err := http.NewRequest("GET", sanitizedURL.String(), nil)
+	token, err := c.currentToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.sendRegistryRequest(ctx, method, sanitizedURL.String(), headers, c.authorization(token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || token == "" {
+		return resp, err
+	}
+
+	// The token was rejected (typically expired mid-pull): renew it once and replay
+	drainAndClose(resp.Body)
+	log.WithField("registry", registry).Info("Registry token rejected, re-authenticating")
+	if err := c.renewToken(ctx, token); err != nil {
+		return nil, err
+	}
+	token, err = c.currentToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.sendRegistryRequest(ctx, method, sanitizedURL.String(), headers, c.authorization(token))
+}
+
+// authorization returns the Authorization header for a request: the bearer
+// token if there is one, otherwise Basic credentials if the registry uses them
+func (c *RegistryClient) authorization(token string) string {
+	if token != "" {
+		return bearerPrefix + token
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.basicAuth
+}
+
+// sendRegistryRequest sends a request with the given headers and Authorization value
+func (c *RegistryClient) sendRegistryRequest(ctx context.Context, method, requestURL string, headers map[string]string, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -405,8 +680,8 @@ func (c *RegistryClient) doSafeRegistryRequest(registry, pathFormat string, head
 		req.Header.Set(key, value)
 	}
 
-	if c.token != "" {
-		req.Header.Set("Authorization", bearerPrefix+c.token)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
 	}
 
 	return c.httpClient.Do(req)
@@ -419,14 +694,55 @@ func (c *RegistryClient) fetchManifestResponse(ref ImageReference, reference str
 	}
 
 	headers := map[string]string{"Accept": manifestAcceptHeader}
-	return c.doSafeRegistryRequest(ref.Registry, "/v2/%s/manifests/%s", headers, ref.Repository, reference)
+	return c.requestManifest(context.Background(), http.MethodGet, ref, reference, headers)
 }
 
-// getManifest retrieves the image manifest for the given platform
-func (c *RegistryClient) getManifest(ref ImageReference, platform Platform) (*ManifestV2, error) {
-	resp, err := c.fetchManifestResponse(ref, ref.Tag)
+// getManifest retrieves the image manifest for the given platform, along with
+// the digest of the manifest (or index) ref points to
+func (c *RegistryClient) getManifest(ref ImageReference, platform Platform) (*ManifestV2, string, error) {
+	contentType, body, digest, err := c.fetchManifestBody(ref)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	manifest, err := c.parseManifestResponse(ref, contentType, body, platform)
+	return manifest, digest, err
+}
+
+// getImageIndex retrieves the manifest list or image index for ref, along
+// with its digest. For a single-platform image the list is nil and its
+// manifest is returned instead.
+func (c *RegistryClient) getImageIndex(ref ImageReference) (*ManifestList, *ManifestV2, string, error) {
+	contentType, body, digest, err := c.fetchManifestBody(ref)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if !isManifestList(contentType) {
+		manifest, err := decodeManifest(contentType, body)
+		return nil, manifest, digest, err
+	}
+
+	var list ManifestList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, nil, "", err
+	}
+	if list.MediaType == "" {
+		mediaType, _, _ := strings.Cut(contentType, ";")
+		list.MediaType = strings.TrimSpace(mediaType)
+	}
+	list.raw = body
+	return &list, nil, digest, nil
+}
+
+// fetchManifestBody fetches the manifest for ref.Reference() and returns its
+// content type, body and digest, verified against ref.Digest when the image is
+// pinned. The digest of a tag is taken from the Docker-Content-Digest header,
+// as a HEAD request would report it, or hashed from the body without one, so
+// that it always describes the manifest that was fetched.
+func (c *RegistryClient) fetchManifestBody(ref ImageReference) (string, []byte, string, error) {
+	resp, err := c.fetchManifestResponse(ref, ref.Reference())
+	if err != nil {
+		return "", nil, "", err
 	}
 	defer closeWithLog(resp.Body, responseBodyStr)
 
@@ -434,21 +750,83 @@ func (c *RegistryClient) getManifest(ref ImageReference, platform Platform) (*Ma
 	case http.StatusOK:
 		// handled below
 	case http.StatusNotFound:
-		return nil, &ErrImageNotFound{Image: ref.Repository + ":" + ref.Tag}
+		return "", nil, "", &ErrImageNotFound{Image: ref.String()}
 	case http.StatusUnauthorized, http.StatusForbidden:
-		return nil, fmt.Errorf("access denied (status %d): check credentials or verify the image exists", resp.StatusCode)
+		return "", nil, "", fmt.Errorf("access denied (status %d): check credentials or verify the image exists", resp.StatusCode)
 	default:
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return nil, fmt.Errorf("failed to get manifest: %d - %s", resp.StatusCode, string(body))
+		return "", nil, "", fmt.Errorf("failed to get manifest: %d - %s", resp.StatusCode, string(body))
 	}
 
 	contentType := resp.Header.Get("Content-Type")
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return "", nil, "", err
+	}
+
+	if ref.Digest != "" {
+		if err := verifyContentDigest(body, ref.Digest); err != nil {
+			return "", nil, "", fmt.Errorf("manifest verification failed: %w", err)
+		}
+		return contentType, body, ref.Digest, nil
+	}
+
+	digest, err := responseManifestDigest(resp)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if digest == "" {
+		digest = sha256Digest(body)
+	} else if err := verifyContentDigest(body, digest); err != nil {
+		// The recorded digest must name the manifest that was actually used
+		return "", nil, "", fmt.Errorf("manifest verification failed: %w", err)
 	}
+	return contentType, body, digest, nil
+}
 
-	return c.parseManifestResponse(ref, contentType, body, platform)
+// responseManifestDigest returns the validated Docker-Content-Digest header of
+// a manifest response, or "" if the registry left it out
+func responseManifestDigest(resp *http.Response) (string, error) {
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", nil
+	}
+	if err := validateDigest(digest); err != nil {
+		return "", fmt.Errorf("invalid Docker-Content-Digest header: %w", err)
+	}
+	return digest, nil
+}
+
+// resolveManifestDigest returns the digest of the manifest ref currently points
+// to. Tags are resolved with a HEAD request, which registries answer without
+// sending the manifest or counting it as a pull; registries that leave out the
+// Docker-Content-Digest header get a GET and the body is hashed instead.
+func (c *RegistryClient) resolveManifestDigest(ref ImageReference) (string, error) {
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+
+	resp, err := c.requestManifest(context.Background(), http.MethodHead, ref, ref.Tag, map[string]string{"Accept": manifestAcceptHeader})
+	if err != nil {
+		return "", err
+	}
+	closeWithLog(resp.Body, responseBodyStr)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// handled below
+	case http.StatusNotFound:
+		return "", &ErrImageNotFound{Image: ref.String()}
+	default:
+		return "", fmt.Errorf("failed to resolve manifest digest: status %d", resp.StatusCode)
+	}
+
+	if digest, err := responseManifestDigest(resp); err != nil || digest != "" {
+		return digest, err
+	}
+
+	_, _, digest, err := c.fetchManifestBody(ref)
+	return digest, err
 }
 
 func (c *RegistryClient) getManifestByDigest(ref ImageReference, digest string) (*ManifestV2, error) {
@@ -463,7 +841,7 @@ func (c *RegistryClient) getManifestByDigest(ref ImageReference, digest string)
 	headers := map[string]string{
 		"Accept": "application/vnd.docker.distribution.manifest.v2+json, application/vnd.oci.image.manifest.v1+json",
 	}
-	resp, err := c.doSafeRegistryRequest(ref.Registry, "/v2/%s/manifests/%s", headers, ref.Repository, digest)
+	resp, err := c.requestManifest(context.Background(), http.MethodGet, ref, digest, headers)
 	if err != nil {
 		return nil, err
 	}
@@ -473,16 +851,24 @@ func (c *RegistryClient) getManifestByDigest(ref ImageReference, digest string)
 		return nil, fmt.Errorf("failed to get manifest by digest: %d", resp.StatusCode)
 	}
 
-	var manifest ManifestV2
-	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
 		return nil, err
 	}
+	if err := verifyContentDigest(body, digest); err != nil {
+		return nil, fmt.Errorf("manifest verification failed: %w", err)
+	}
 
-	return &manifest, nil
+	return decodeManifest(resp.Header.Get("Content-Type"), body)
 }
 
-// DownloadBlob downloads a blob to a file
-func (c *RegistryClient) DownloadBlob(ref ImageReference, digest, destPath string) error {
+// DownloadBlob downloads a blob to a file, hashing it while it streams.
+// Blobs already in the blob store are taken from there. Otherwise the
+// registry's mirrors are tried first, in order, once each. Transient failures
+// of the registry are retried with backoff, resuming partially downloaded
+// blobs with HTTP Range requests. The file is removed and an error returned if the content cannot
+// be downloaded or does not match digest.
+func (c *RegistryClient) DownloadBlob(ctx context.Context, ref ImageReference, digest, destPath string) error {
 	if err := ValidateImageReference(ref); err != nil {
 		return fmt.Errorf(invalidImageReferenceFormat, err)
 	}
@@ -491,22 +877,209 @@ func (c *RegistryClient) DownloadBlob(ref ImageReference, digest, destPath strin
 		return fmt.Errorf("invalid digest: %w", err)
 	}
 
-	resp, err := c.doSafeRegistryRequest(ref.Registry, "/v2/%s/blobs/%s", nil, ref.Repository, digest)
+	if c.blobs != nil {
+		return c.blobs.fetchBlob(digest, destPath, func(path string) error {
+			return c.downloadBlobFromSources(ctx, ref, digest, path)
+		})
+	}
+	return c.downloadBlobFromSources(ctx, ref, digest, destPath)
+}
+
+// downloadBlobFromSources downloads a blob from the registry's mirrors or the registry itself
+func (c *RegistryClient) downloadBlobFromSources(ctx context.Context, ref ImageReference, digest, destPath string) error {
+	mirrors := GetRegistrySettings(ref.Registry).Mirrors
+	for _, mirror := range mirrors {
+		err := c.downloadBlobFromMirror(ctx, mirror, ref, digest, destPath)
+		if err == nil {
+			log.WithFields(log.Fields{"digest": digest, "source": mirror.String()}).Info("Blob served by mirror")
+			return nil
+		}
+		if ctx.Err() != nil {
+			removeWithLog(destPath)
+			return err
+		}
+		logMirrorFallback(mirror, "blob "+digest, err)
+	}
+
+	if err := c.downloadBlob(ctx, ref, digest, destPath); err != nil {
+		return err
+	}
+	if len(mirrors) > 0 {
+		log.WithFields(log.Fields{"digest": digest, "source": ref.Registry}).Info("Blob served by upstream registry")
+	}
+	return nil
+}
+
+// downloadBlob downloads a blob from ref.Registry, retrying with the registry's policy
+func (c *RegistryClient) downloadBlob(ctx context.Context, ref ImageReference, digest, destPath string) error {
+	policy := GetRegistrySettings(ref.Registry).Retry
+	for attempt := 1; ; attempt++ {
+		err := c.downloadBlobAttempt(ctx, ref, digest, destPath)
+		if err == nil {
+			return nil
+		}
+
+		_, retryable := errors.AsType[*retryableError](err)
+		if !retryable || attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			removeWithLog(destPath)
+			return err
+		}
+
+		delay := policy.backoff(attempt, retryAfterFromError(err))
+		log.WithFields(log.Fields{
+			"digest":  digest,
+			"attempt": attempt,
+			"delay":   delay,
+		}).WithError(err).Warn("Blob download failed, retrying")
+		if err := sleepContext(ctx, delay); err != nil {
+			removeWithLog(destPath)
+			return err
+		}
+	}
+}
+
+// downloadBlobAttempt makes a single attempt to download a blob, resuming from
+// whatever is already in destPath. Failures worth retrying are returned as *retryableError.
+func (c *RegistryClient) downloadBlobAttempt(ctx context.Context, ref ImageReference, digest, destPath string) error {
+	var offset int64
+	if info, err := os.Stat(destPath); err == nil {
+		offset = info.Size()
+	}
+
+	var headers map[string]string
+	if offset > 0 {
+		headers = map[string]string{"Range": fmt.Sprintf("bytes=%d-", offset)}
+	}
+
+	resp, err := c.doSafeRegistryRequestOnce(ctx, http.MethodGet, ref.Registry, "/v2/%s/blobs/%s", headers, ref.Repository, digest)
 	if err != nil {
+		if isTransportError(err) {
+			return &retryableError{err: err}
+		}
 		return err
 	}
 	defer closeWithLog(resp.Body, responseBodyStr)
 
-	if resp.StatusCode != http.StatusOK {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+	case resp.StatusCode == http.StatusPartialContent:
+		if start, ok := parseContentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			return &retryableError{err: fmt.Errorf("unexpected Content-Range %q when resuming at %d", resp.Header.Get("Content-Range"), offset)}
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is no longer usable; start over
+		removeWithLog(destPath)
+		return &retryableError{err: fmt.Errorf("failed to resume blob download: %d", resp.StatusCode)}
+	case isRetryableStatus(resp.StatusCode):
+		return &retryableError{
+			err:        fmt.Errorf("failed to download blob: %d", resp.StatusCode),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	default:
 		return fmt.Errorf("failed to download blob: %d", resp.StatusCode)
 	}
 
-	file, err := os.Create(destPath)
+	verifier, err := newDigestVerifier(digest)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		if err := hashFilePrefix(destPath, offset, verifier); err != nil {
+			return err
+		}
+		flags = os.O_WRONLY | os.O_APPEND
+		log.WithFields(log.Fields{
+			"digest": digest,
+			"offset": offset,
+		}).Info("Resuming blob download")
+	}
+
+	file, err := os.OpenFile(destPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, copyErr := io.Copy(io.MultiWriter(file, verifier), resp.Body)
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if copyErr != nil {
+		if ctx.Err() != nil {
+			return copyErr
+		}
+		// Keep what we have so the next attempt can resume
+		return &retryableError{err: fmt.Errorf("blob download interrupted: %w", copyErr)}
+	}
+
+	if err := verifier.Verify(); err != nil {
+		verificationFailuresMetric.Inc()
+		removeWithLog(destPath)
+		return &retryableError{err: fmt.Errorf("blob %s failed verification: %w", digest, err)}
+	}
+	return nil
+}
+
+// hashFilePrefix feeds the first n bytes of a file into w
+func hashFilePrefix(path string, n int64, w io.Writer) error {
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	defer closeWithLog(file, "blob file")
+	defer closeWithLog(file, "partial blob file")
 
-	_, err = io.Copy(file, resp.Body)
+	_, err = io.CopyN(w, file, n)
 	return err
 }
+
+// parseContentRangeStart returns the first byte position of a "bytes start-end/total" header
+func parseContentRangeStart(header string) (int64, bool) {
+	rangeSpec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	startStr, _, ok := strings.Cut(rangeSpec, "-")
+	if !ok {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+// isTransportError reports whether err came from the network rather than from
+// request validation or the SSRF guards, so that the request is worth retrying.
+func isTransportError(err error) bool {
+	if isBlockedAddressError(err) {
+		return false
+	}
+	_, isURLError := errors.AsType[*url.Error](err)
+	return isURLError || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// drainAndClose discards what is left of a response body so the connection can be reused
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, 64*1024))
+	closeWithLog(body, responseBodyStr)
+}
+
+// logRetry logs a retried registry request
+func logRetry(registry string, attempt, maxAttempts int, delay time.Duration, resp *http.Response, err error) {
+	entry := log.WithFields(log.Fields{
+		"registry":     registry,
+		"attempt":      attempt,
+		"max_attempts": maxAttempts,
+		"delay":        delay,
+	})
+	if resp != nil {
+		entry = entry.WithField("status_code", resp.StatusCode)
+	}
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Warn("Registry request failed, retrying")
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestParseImageReference_Simple(t *testing.T) {
@@ -62,6 +72,29 @@ func TestParseImageReference_FullPath(t *testing.T) {
 	}
 }
 
+func TestParseImageReference_NormalizesRegistry(t *testing.T) {
+	tests := []struct {
+		image          string
+		wantRegistry   string
+		wantRepository string
+	}{
+		{"GHCR.IO/org/app", "ghcr.io", "org/app"},
+		{"ghcr.io:443/org/app", "ghcr.io", "org/app"},
+		{"DOCKER.IO/alpine", "registry-1.docker.io", "library/alpine"},
+		{"docker.io:443/alpine", "registry-1.docker.io", "library/alpine"},
+		{"ghcr.io:5000/org/app", "ghcr.io:5000", "org/app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref := ParseImageReference(tt.image)
+			if ref.Registry != tt.wantRegistry || ref.Repository != tt.wantRepository {
+				t.Errorf("ParseImageReference(%q) = %s/%s, want %s/%s", tt.image, ref.Registry, ref.Repository, tt.wantRegistry, tt.wantRepository)
+			}
+		})
+	}
+}
+
 func TestParseImageReference_RegistryWithPort(t *testing.T) {
 	ref := ParseImageReference("localhost:5000/myimage:test")
 
@@ -104,6 +137,45 @@ func TestParseImageReference_IndexDockerIO(t *testing.T) {
 	}
 }
 
+func TestParseImageReference_Digest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	ref := ParseImageReference("alpine@" + digest)
+
+	if ref.Repository != "library/alpine" {
+		t.Errorf("expected repository 'library/alpine', got '%s'", ref.Repository)
+	}
+	if ref.Tag != "" {
+		t.Errorf("expected empty tag, got '%s'", ref.Tag)
+	}
+	if ref.Digest != digest {
+		t.Errorf("expected digest '%s', got '%s'", digest, ref.Digest)
+	}
+	if ref.Reference() != digest {
+		t.Errorf("expected reference '%s', got '%s'", digest, ref.Reference())
+	}
+}
+
+func TestParseImageReference_TagAndDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("b", 64)
+	ref := ParseImageReference("localhost:5000/team/app:1.2@" + digest)
+
+	if ref.Registry != "localhost:5000" {
+		t.Errorf("expected registry 'localhost:5000', got '%s'", ref.Registry)
+	}
+	if ref.Repository != "team/app" {
+		t.Errorf("expected repository 'team/app', got '%s'", ref.Repository)
+	}
+	if ref.Tag != "1.2" {
+		t.Errorf("expected tag '1.2', got '%s'", ref.Tag)
+	}
+	if ref.Digest != digest {
+		t.Errorf("expected digest '%s', got '%s'", digest, ref.Digest)
+	}
+	if ref.String() != "team/app:1.2@"+digest {
+		t.Errorf("unexpected String(): %s", ref.String())
+	}
+}
+
 func TestParseAuthHeader(t *testing.T) {
 	header := `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`
 
@@ -388,3 +460,534 @@ func TestPlatformJSON(t *testing.T) {
 		}
 	})
 }
+
+func TestDownloadBlob_VerifiesDigest(t *testing.T) {
+	content := []byte("layer content")
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		body    []byte
+		wantErr bool
+	}{
+		{name: "matching content", body: content, wantErr: false},
+		{name: "corrupted content", body: []byte("layer c0ntent"), wantErr: true},
+		{name: "truncated content", body: content[:5], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "test-blob-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupTempDir(t, tempDir)
+			destPath := filepath.Join(tempDir, "blob")
+
+			useFastRetries(t, "registry.example.com", 2)
+			client := NewRegistryClient()
+			client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				return newTestResponse(http.StatusOK, tt.body), nil
+			})
+
+			ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+			err = client.DownloadBlob(context.Background(), ref, digest, destPath)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected verification error")
+				}
+				if _, match := errors.AsType[*ErrDigestMismatch](err); !match {
+					t.Errorf("expected ErrDigestMismatch, got %v", err)
+				}
+				if _, statErr := os.Stat(destPath); !os.IsNotExist(statErr) {
+					t.Error("expected corrupted blob to be removed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			data, err := os.ReadFile(destPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(content) {
+				t.Errorf("unexpected blob content %q", data)
+			}
+		})
+	}
+}
+
+// failingReader returns data and then an error, simulating a dropped connection
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDownloadBlob_ResumesInterruptedDownload(t *testing.T) {
+	useFastRetries(t, "registry.example.com", 3)
+
+	content := []byte(strings.Repeat("0123456789", 100))
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	half := len(content) / 2
+
+	var rangeHeaders []string
+	client := NewRegistryClient()
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		rangeHeaders = append(rangeHeaders, r.Header.Get("Range"))
+		if r.Header.Get("Range") == "" {
+			resp := newTestResponse(http.StatusOK, nil)
+			resp.Body = io.NopCloser(&failingReader{data: content[:half]})
+			return resp, nil
+		}
+		resp := newTestResponse(http.StatusPartialContent, content[half:])
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(content)-1, len(content)))
+		return resp, nil
+	})
+
+	tempDir, err := os.MkdirTemp("", "test-blob-resume-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, tempDir)
+	destPath := filepath.Join(tempDir, "blob")
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	if err := client.DownloadBlob(context.Background(), ref, digest, destPath); err != nil {
+		t.Fatalf("DownloadBlob failed: %v", err)
+	}
+
+	if len(rangeHeaders) != 2 || rangeHeaders[1] != fmt.Sprintf("bytes=%d-", half) {
+		t.Errorf("expected a resumed request with Range bytes=%d-, got %v", half, rangeHeaders)
+	}
+	data, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(content) {
+		t.Error("resumed blob does not match original content")
+	}
+}
+
+func TestDownloadBlob_RetryPolicy(t *testing.T) {
+	content := []byte("blob")
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "retries 503 then succeeds", statuses: []int{503, 200}, wantErr: false, wantCalls: 2},
+		{name: "retries 429 then succeeds", statuses: []int{429, 429, 200}, wantErr: false, wantCalls: 3},
+		{name: "gives up after max attempts", statuses: []int{500, 502, 503, 200}, wantErr: true, wantCalls: 3},
+		{name: "does not retry 404", statuses: []int{404, 200}, wantErr: true, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFastRetries(t, "registry.example.com", 3)
+
+			calls := 0
+			client := NewRegistryClient()
+			client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				status := tt.statuses[calls]
+				calls++
+				if status != http.StatusOK {
+					return newTestResponse(status, nil), nil
+				}
+				return newTestResponse(http.StatusOK, content), nil
+			})
+
+			tempDir, err := os.MkdirTemp("", "test-blob-retry-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupTempDir(t, tempDir)
+
+			ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+			err = client.DownloadBlob(context.Background(), ref, digest, filepath.Join(tempDir, "blob"))
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d requests, got %d", tt.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestDoSafeRegistryRequest_RetriesTransientFailures(t *testing.T) {
+	useFastRetries(t, "registry.example.com", 3)
+
+	calls := 0
+	client := NewRegistryClient()
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("connection reset by peer")
+		}
+		if calls == 2 {
+			return newTestResponse(http.StatusBadGateway, nil), nil
+		}
+		return newTestResponse(http.StatusOK, []byte("{}")), nil
+	})
+
+	resp, err := client.doSafeRegistryRequest(context.Background(), http.MethodGet, "registry.example.com", "/v2/%s/manifests/%s", nil, "team/app", "latest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeWithLog(resp.Body, "test response")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 requests, got %d", calls)
+	}
+}
+
+func TestResolveManifestDigest(t *testing.T) {
+	registry := newFakeRegistry()
+	image := registry.addImage(t, DefaultPlatform(), "layer")
+	registry.addTag("latest", image)
+	pinned := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		name       string
+		ref        ImageReference
+		transport  http.RoundTripper
+		wantDigest string
+		wantErr    bool
+	}{
+		{"tag resolved with HEAD", ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}, registry.transport(), image.Digest, false},
+		{"pinned digest needs no request", ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest", Digest: pinned}, nil, pinned, false},
+		{"missing tag", ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "missing"}, registry.transport(), "", true},
+		{"no digest header falls back to hashing the manifest", ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"},
+			roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				resp, err := registry.transport().RoundTrip(r)
+				resp.Header.Del("Docker-Content-Digest")
+				return resp, err
+			}), image.Digest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewRegistryClient()
+			client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				if tt.transport == nil {
+					t.Fatalf("unexpected request: %s %s", r.Method, r.URL)
+				}
+				return tt.transport.RoundTrip(r)
+			})
+
+			digest, err := client.resolveManifestDigest(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveManifestDigest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if digest != tt.wantDigest {
+				t.Errorf("expected digest %s, got %s", tt.wantDigest, digest)
+			}
+		})
+	}
+
+	_, err := registry.client().resolveManifestDigest(ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "missing"})
+	if _, match := errors.AsType[*ErrImageNotFound](err); !match {
+		t.Errorf("expected ErrImageNotFound for a missing tag, got %v", err)
+	}
+}
+
+func TestGetManifest_ReturnsDigestOfFetchedManifest(t *testing.T) {
+	registry := newFakeRegistry()
+	image := registry.addImage(t, DefaultPlatform(), "layer")
+	registry.addTag("single", image)
+	index := registry.addIndex(t, "multi", image)
+
+	tests := []struct {
+		name       string
+		tag        string
+		noHeader   bool
+		wantDigest string
+	}{
+		{"image", "single", false, image.Digest},
+		{"index", "multi", false, sha256Digest(index)},
+		{"no digest header", "single", true, image.Digest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewRegistryClient()
+			client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				if r.Method != http.MethodGet {
+					t.Errorf("unexpected %s request", r.Method)
+				}
+				resp, err := registry.transport().RoundTrip(r)
+				if tt.noHeader {
+					resp.Header.Del("Docker-Content-Digest")
+				}
+				return resp, err
+			})
+			ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: tt.tag}
+
+			_, digest, err := client.getManifest(ref, DefaultPlatform())
+			if err != nil {
+				t.Fatalf("getManifest() error: %v", err)
+			}
+			if digest != tt.wantDigest {
+				t.Errorf("expected digest %s, got %s", tt.wantDigest, digest)
+			}
+		})
+	}
+}
+
+func TestGetManifest_RejectsMismatchedDigestHeader(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addTag("latest", registry.addImage(t, DefaultPlatform(), "layer"))
+
+	client := NewRegistryClient()
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		resp, err := registry.transport().RoundTrip(r)
+		resp.Header.Set("Docker-Content-Digest", sha256Digest([]byte("another manifest")))
+		return resp, err
+	})
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+
+	_, _, err := client.getManifest(ref, DefaultPlatform())
+	if _, match := errors.AsType[*ErrDigestMismatch](err); !match {
+		t.Errorf("expected ErrDigestMismatch for a header not matching the manifest, got %v", err)
+	}
+}
+
+func TestParseContentRangeStart(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int64
+		ok     bool
+	}{
+		{"bytes 100-199/200", 100, true},
+		{"bytes 0-9/*", 0, true},
+		{"bytes */200", 0, false},
+		{"items 1-2/3", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, ok := parseContentRangeStart(tt.header)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("parseContentRangeStart(%q) = %d, %v; want %d, %v", tt.header, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	requestedAt := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		issuedAt  string
+		expiresIn int
+		want      time.Time
+	}{
+		{name: "expires_in only", expiresIn: 300, want: requestedAt.Add(300 * time.Second)},
+		{name: "default lifetime", want: requestedAt.Add(defaultTokenLifetime)},
+		{name: "issued earlier", issuedAt: "2025-01-01T11:59:00Z", expiresIn: 300, want: requestedAt.Add(240 * time.Second)},
+		{name: "registry clock ahead", issuedAt: "2025-01-01T12:10:00Z", expiresIn: 300, want: requestedAt.Add(300 * time.Second)},
+		{name: "invalid issued_at", issuedAt: "yesterday", expiresIn: 300, want: requestedAt.Add(300 * time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenExpiry(requestedAt, tt.issuedAt, tt.expiresIn); !got.Equal(tt.want) {
+				t.Errorf("tokenExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeTokenRegistry serves a Bearer challenge and hands out numbered tokens.
+// Manifest requests succeed only with the most recently issued token.
+type fakeTokenRegistry struct {
+	mu        sync.Mutex
+	issued    int
+	expiresIn int
+}
+
+func (f *fakeTokenRegistry) roundTrip(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Host == "auth.example.com":
+		f.issued++
+		body := fmt.Sprintf(`{"token":"token-%d","expires_in":%d}`, f.issued, f.expiresIn)
+		return newTestResponse(http.StatusOK, []byte(body)), nil
+	case r.URL.Path == "/v2/":
+		resp := newTestResponse(http.StatusUnauthorized, nil)
+		resp.Header.Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com"`)
+		return resp, nil
+	case r.Header.Get("Authorization") == fmt.Sprintf("Bearer token-%d", f.issued):
+		return newTestResponse(http.StatusOK, []byte("{}")), nil
+	default:
+		return newTestResponse(http.StatusUnauthorized, nil), nil
+	}
+}
+
+func (f *fakeTokenRegistry) tokensIssued() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issued
+}
+
+func TestRegistryClient_RenewsRejectedToken(t *testing.T) {
+	registry := &fakeTokenRegistry{expiresIn: 300}
+	client := NewRegistryClient()
+	client.httpClient.Transport = roundTripFunc(registry.roundTrip)
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	if err := client.Authenticate(ref); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	// Simulate the registry revoking the token mid-pull
+	registry.mu.Lock()
+	registry.issued++
+	registry.mu.Unlock()
+
+	resp, err := client.fetchManifestResponse(ref, ref.Reference())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeWithLog(resp.Body, "test response")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected request to be replayed with a new token, got status %d", resp.StatusCode)
+	}
+	if registry.tokensIssued() != 3 {
+		t.Errorf("expected one token renewal, got %d tokens issued", registry.tokensIssued())
+	}
+}
+
+func TestRegistryClient_RenewsTokenBeforeExpiry(t *testing.T) {
+	// Tokens that expire within the refresh margin are renewed before use
+	registry := &fakeTokenRegistry{expiresIn: 1}
+	client := NewRegistryClient()
+	client.httpClient.Transport = roundTripFunc(registry.roundTrip)
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	if err := client.Authenticate(ref); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	resp, err := client.fetchManifestResponse(ref, ref.Reference())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeWithLog(resp.Body, "test response")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+	if registry.tokensIssued() != 2 {
+		t.Errorf("expected token to be renewed proactively, got %d tokens issued", registry.tokensIssued())
+	}
+}
+
+func TestRegistryClient_UsesOwnCredentialStore(t *testing.T) {
+	store := NewCredentialStore()
+	store.Set("registry.example.com", StaticCredentials{Username: "scoped-user", Password: "secret"}, false)
+
+	var authorization string
+	client := NewRegistryClient()
+	client.credentials = store
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "auth.example.com" {
+			authorization = r.Header.Get("Authorization")
+			return newTestResponse(http.StatusOK, []byte(`{"token":"t"}`)), nil
+		}
+		resp := newTestResponse(http.StatusUnauthorized, nil)
+		resp.Header.Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com"`)
+		return resp, nil
+	})
+
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+	if err := client.Authenticate(ref); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("scoped-user:secret"))
+	if authorization != want {
+		t.Errorf("expected token request with credentials from the client's store, got %q", authorization)
+	}
+	if client.username != "scoped-user" {
+		t.Errorf("expected username scoped-user, got %q", client.username)
+	}
+}
+
+func TestRegistryClient_AnonymousFallback(t *testing.T) {
+	tests := []struct {
+		name              string
+		anonymousFallback bool
+		wantErr           bool
+	}{
+		{name: "fallback enabled", anonymousFallback: true, wantErr: false},
+		{name: "fallback disabled", anonymousFallback: false, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewCredentialStore()
+			store.Set("ghcr.io/org-a", StaticCredentials{Username: "revoked", Password: "secret"}, tt.anonymousFallback)
+
+			var tokenRequests []string
+			client := NewRegistryClient()
+			client.credentials = store
+			client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				if r.URL.Host == "auth.example.com" {
+					tokenRequests = append(tokenRequests, r.Header.Get("Authorization"))
+					if r.Header.Get("Authorization") != "" {
+						return newTestResponse(http.StatusUnauthorized, nil), nil
+					}
+					return newTestResponse(http.StatusOK, []byte(`{"token":"anonymous-token"}`)), nil
+				}
+				resp := newTestResponse(http.StatusUnauthorized, nil)
+				resp.Header.Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="ghcr.io"`)
+				return resp, nil
+			})
+
+			err := client.Authenticate(ImageReference{Registry: "ghcr.io", Repository: "org-a/app", Tag: "latest"})
+			if tt.wantErr {
+				if _, ok := errors.AsType[*ErrAuthenticationFailed](err); !ok {
+					t.Errorf("expected ErrAuthenticationFailed, got %v", err)
+				}
+				if len(tokenRequests) != 1 {
+					t.Errorf("expected no anonymous retry, got %d token requests", len(tokenRequests))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate failed: %v", err)
+			}
+			if len(tokenRequests) != 2 || tokenRequests[1] != "" {
+				t.Errorf("expected a rejected attempt followed by an anonymous one, got %q", tokenRequests)
+			}
+			if client.token != "anonymous-token" || client.username != "anonymous" {
+				t.Errorf("expected anonymous token, got %q as %q", client.token, client.username)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter caps how long a registry can make us wait through Retry-After
+const maxRetryAfter = 5 * time.Minute
+
+// retryableError marks a failure that is worth retrying, optionally with a
+// server-requested delay from a Retry-After header.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// DefaultRetryConfig returns the retry policy used when none is configured
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:    4,
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// isRetryableStatus reports whether an HTTP status is a transient upstream failure
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+// It returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := date.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// backoff returns how long to wait before the given retry attempt (1-based).
+// It uses exponential backoff with jitter, or the server's Retry-After if that is longer.
+func (r RetryConfig) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	delay := r.InitialBackoff
+	for i := 1; i < attempt && delay < r.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, r.MaxBackoff)
+	if delay > 0 {
+		// Equal jitter: keep half the delay and randomize the other half
+		delay = delay/2 + rand.N(delay/2+1)
+	}
+	if retryAfter > delay {
+		delay = min(retryAfter, maxRetryAfter)
+	}
+	return delay
+}
+
+// retryAfterFromError extracts the server-requested delay from a retryable error
+func retryAfterFromError(err error) time.Duration {
+	if retryable, ok := errors.AsType[*retryableError](err); ok {
+		return retryable.retryAfter
+	}
+	return 0
+}
+
+// sleepContext waits for d or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
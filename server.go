@@ -9,6 +9,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -20,12 +22,33 @@ import (
 //go:embed index.html logo.png
 var staticFiles embed.FS
 
-const contentTypeHeader = "Content-Type"
+const (
+	contentTypeHeader = "Content-Type"
+	// maxBundleBodySize limits the JSON body accepted by POST /bundle
+	maxBundleBodySize = 64 * 1024
+	// cacheStatusHeader tells clients how the archive was served
+	cacheStatusHeader = "X-Cache-Status"
+)
+
+// Values of the X-Cache-Status header
+const (
+	// cacheStatusMiss: the archive was not cached and has been built
+	cacheStatusMiss = "miss"
+	// cacheStatusFresh: served from the cache within the revalidation interval
+	cacheStatusFresh = "fresh"
+	// cacheStatusRevalidated: the registry confirmed the cached archive is current
+	cacheStatusRevalidated = "revalidated"
+	// cacheStatusUpdated: a tag had moved, so the archive was rebuilt
+	cacheStatusUpdated = "updated"
+	// cacheStatusStale: the registry could not be reached, the cached archive was served anyway
+	cacheStatusStale = "stale"
+)
 
 // Server represents the HTTP server for the Docker image service
 type Server struct {
 	addr          string
 	cache         *CacheManager
+	credentials   *CredentialStore
 	downloadGroup singleflight.Group
 }
 
@@ -44,9 +67,24 @@ func NewServerWithCache(addr string, cache *CacheManager) *Server {
 	return &Server{addr: addr, cache: cache}
 }
 
+// SetCredentialStore sets where the server's registry clients get their
+// credentials from. Without one, registries are accessed anonymously.
+func (s *Server) SetCredentialStore(store *CredentialStore) {
+	s.credentials = store
+}
+
+// Close saves the state the server writes lazily, such as the cache index
+func (s *Server) Close() {
+	s.cache.SaveIndex()
+}
+
 // Start starts the HTTP server and returns the *http.Server for shutdown control.
 // It begins accepting connections immediately in a background goroutine.
 func (s *Server) Start(ctx context.Context) (*http.Server, error) {
+	// Nothing is being built yet, so anything half written was left by an earlier run
+	s.cache.RemovePartialWrites()
+	RemoveOrphanedBuildDirs(buildTempDir())
+
 	// Start background cache cleanup
 	go s.cache.StartCleanup(ctx)
 
@@ -55,6 +93,8 @@ func (s *Server) Start(ctx context.Context) (*http.Server, error) {
 	mux.HandleFunc("GET /health", s.healthHandler)
 	mux.HandleFunc("GET /image", s.imageHandler)
 	mux.HandleFunc("GET /platforms", s.platformsHandler)
+	mux.HandleFunc("GET /bundle", s.bundleHandler)
+	mux.HandleFunc("POST /bundle", s.bundleHandler)
 	mux.HandleFunc("GET /logo.png", s.logoHandler)
 	mux.Handle("GET /metrics", promhttp.Handler())
 
@@ -121,7 +161,12 @@ func (s *Server) logoHandler(w http.ResponseWriter, _ *http.Request) {
 // imageHandler handles the /image endpoint
 func (s *Server) imageHandler(w http.ResponseWriter, r *http.Request) {
 	imageName, ok := extractImageName(w, r)
-	if !ok {
+	if !ok || !checkImagePolicy(w, imageName) {
+		return
+	}
+
+	if r.URL.Query().Has("platforms") {
+		s.multiPlatformImageHandler(w, r, imageName)
 		return
 	}
 
@@ -130,9 +175,14 @@ func (s *Server) imageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cachePath := s.cache.GetCachePath(imageName, platform)
+	format, ok := formatFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	cachePath := s.cache.GetCachePath(imageName, platform, format)
 
-	if _, err := os.Stat(cachePath); err == nil {
+	if s.cacheHit(w, cachePath) {
 		log.WithFields(log.Fields{
 			"image":    imageName,
 			"platform": platform,
@@ -144,36 +194,274 @@ func (s *Server) imageHandler(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(log.Fields{
 		"image":    imageName,
 		"platform": platform,
+		"format":   format,
 	}).Info("Downloading image")
-	sfKey := imageName + "_" + platform.String()
-	result, err, _ := s.downloadGroup.Do(sfKey, func() (interface{}, error) {
-		return DownloadImage(imageName, s.cache.Dir(), platform)
+	sfKey := imageName + "_" + platform.String() + "_" + string(format)
+	imagePath, err := s.download(sfKey, func() (string, error) {
+		return DownloadImage(imageName, s.cache.Dir(), platform, format, s.credentials)
 	})
 	if err != nil {
-		log.WithFields(log.Fields{
-			"image": imageName,
-		}).WithError(err).Error("Failed to download image")
-		errorsTotalMetric.Inc()
-		if notFound, match := errors.AsType[*ErrImageNotFound](err); match {
-			writeJSONError(w, notFound.Error(), http.StatusNotFound)
-		} else {
-			writeJSONError(w, fmt.Sprintf("failed to download image: %v", err), http.StatusInternalServerError)
-		}
+		writeDownloadError(w, imageName, err)
 		return
 	}
-	imagePath := result.(string)
 
 	s.serveImageFile(w, r, imagePath, imageName, platform)
 }
 
+// multiPlatformImageHandler serves an OCI archive holding several platforms of
+// an image, selected with the platforms query parameter
+func (s *Server) multiPlatformImageHandler(w http.ResponseWriter, r *http.Request, imageName string) {
+	query := r.URL.Query()
+	for _, param := range []string{"os", "arch", "variant"} {
+		if query.Has(param) {
+			writeJSONError(w, fmt.Sprintf("the platforms parameter cannot be combined with %s", param), http.StatusBadRequest)
+			return
+		}
+	}
+	format, ok := formatFromRequest(w, r)
+	if !ok {
+		return
+	}
+	// Only the OCI layout can hold several platforms of the same image
+	if format != FormatOCI && query.Get("format") != "" {
+		writeJSONError(w, "multi-platform archives are only available with format=oci", http.StatusBadRequest)
+		return
+	}
+
+	selection, err := ParsePlatformSelection(query.Get("platforms"))
+	if err != nil {
+		writeJSONError(w, fmt.Sprintf("invalid platforms parameter: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	cachePath := s.cache.GetMultiPlatformCachePath(imageName, selection)
+
+	if s.cacheHit(w, cachePath) {
+		log.WithFields(log.Fields{
+			"image":     imageName,
+			"platforms": selection,
+		}).Info("Serving cached image")
+		s.serveImageFile(w, r, cachePath, imageName, selection)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"image":     imageName,
+		"platforms": selection,
+	}).Info("Downloading multi-platform image")
+	sfKey := imageName + "_" + selection.String() + "_" + string(FormatOCI)
+	imagePath, err := s.download(sfKey, func() (string, error) {
+		return DownloadMultiPlatformImage(imageName, s.cache.Dir(), selection, s.credentials)
+	})
+	if err != nil {
+		writeDownloadError(w, imageName, err)
+		return
+	}
+
+	s.serveImageFile(w, r, imagePath, imageName, selection)
+}
+
+// bundleHandler handles the /bundle endpoint, serving several images as one
+// docker-save archive. Images are given as repeated name parameters or, for
+// POST, as a JSON body of the form {"images": ["postgres:16", "redis:7"]}.
+func (s *Server) bundleHandler(w http.ResponseWriter, r *http.Request) {
+	imageNames, ok := bundleImagesFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	platform, ok := platformFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	cachePath := s.cache.GetBundleCachePath(imageNames, platform)
+	label := strings.Join(imageNames, ",")
+
+	if s.cacheHit(w, cachePath) {
+		log.WithFields(log.Fields{
+			"images":   label,
+			"platform": platform,
+		}).Info("Serving cached bundle")
+		s.serveImageFile(w, r, cachePath, label, platform)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"images":   label,
+		"platform": platform,
+	}).Info("Downloading bundle")
+	imagePath, err := s.download(filepath.Base(cachePath), func() (string, error) {
+		return DownloadBundle(imageNames, s.cache.Dir(), platform, s.credentials)
+	})
+	if err != nil {
+		writeDownloadError(w, label, err)
+		return
+	}
+
+	s.serveImageFile(w, r, imagePath, label, platform)
+}
+
+// download builds an archive once for all concurrent requests with the same
+// key, then evicts older archives if the cache has grown beyond its size limit.
+// A build refused for lack of space on the filesystem holding the cache
+// directory is retried once after evicting enough archives to make room.
+func (s *Server) download(key string, build func() (string, error)) (string, error) {
+	result, err, _ := s.downloadGroup.Do(key, func() (interface{}, error) {
+		path, err := build()
+		if insufficient, match := errors.AsType[*ErrInsufficientStorage](err); match && sameFilesystem(insufficient.Dir, s.cache.Dir()) {
+			if s.cache.FreeSpace(insufficient.Required) {
+				path, err = build()
+			}
+		}
+		if err == nil {
+			s.cache.RecordBuild(path)
+			s.cache.EnforceMaxSize(path)
+		}
+		return path, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.(string), nil
+}
+
+// cacheHit reports whether the archive at cachePath can be served from the
+// cache and sets the X-Cache-Status header accordingly. Once the revalidation
+// interval has passed, the tags the archive was built from are checked against
+// the registry; if one has moved, the archive is removed to be rebuilt.
+func (s *Server) cacheHit(w http.ResponseWriter, cachePath string) bool {
+	status := s.revalidateArchive(cachePath)
+	w.Header().Set(cacheStatusHeader, status)
+	switch status {
+	case cacheStatusMiss:
+		return false
+	case cacheStatusUpdated:
+		s.cache.RecordRemoval(cachePath)
+		return false
+	}
+	s.cache.RecordHit(cachePath)
+	return true
+}
+
+// revalidateArchive returns the cache status of the archive at cachePath,
+// revalidating it if it is due
+func (s *Server) revalidateArchive(cachePath string) string {
+	if _, err := os.Stat(cachePath); err != nil {
+		return cacheStatusMiss
+	}
+	metadata, ok := s.cache.lookupMetadata(cachePath)
+	if !ok {
+		return cacheStatusMiss
+	}
+	// Archives built without recording their digests have none to check
+	if !metadata.needsRevalidation(time.Now()) {
+		return cacheStatusFresh
+	}
+
+	result, _, _ := s.downloadGroup.Do("revalidate_"+filepath.Base(cachePath), func() (interface{}, error) {
+		return s.revalidateManifests(cachePath, metadata), nil
+	})
+	return result.(string)
+}
+
+// revalidateManifests compares the manifest digests an archive was built from
+// with those its tags resolve to now
+func (s *Server) revalidateManifests(cachePath string, metadata archiveMetadata) string {
+	for image, digest := range metadata.Manifests {
+		if ParseImageReference(image).Digest != "" {
+			continue
+		}
+		current, err := resolveImageDigest(image, s.credentials)
+		if err != nil {
+			log.WithField("image", image).WithError(err).Warn("Failed to revalidate cached image, serving cached copy")
+			s.recordValidation(cachePath, metadata.deferRevalidation(time.Now()))
+			return cacheStatusStale
+		}
+		if current != digest {
+			log.WithFields(log.Fields{
+				"image":    image,
+				"cached":   digest,
+				"upstream": current,
+			}).Info("Image changed upstream, rebuilding cached archive")
+			removeWithLog(cachePath)
+			removeWithLog(metadataPath(cachePath))
+			return cacheStatusUpdated
+		}
+	}
+
+	metadata.ValidatedAt = time.Now()
+	s.recordValidation(cachePath, metadata)
+	return cacheStatusRevalidated
+}
+
+// recordValidation stores the ValidatedAt of an archive's metadata
+func (s *Server) recordValidation(cachePath string, metadata archiveMetadata) {
+	if err := writeArchiveMetadata(cachePath, metadata); err != nil {
+		log.WithField("path", cachePath).WithError(err).Warn("Failed to update archive metadata")
+	}
+	s.cache.RecordValidation(cachePath, metadata.ValidatedAt)
+}
+
+// bundleImagesFromRequest reads, sanitizes and normalizes the images of a bundle
+// request, writing an error response and returning false if any is invalid.
+func bundleImagesFromRequest(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	imageNames := r.URL.Query()["name"]
+	if r.Method == http.MethodPost {
+		var body struct {
+			Images []string `json:"images"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBundleBodySize)).Decode(&body); err != nil {
+			writeJSONError(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return nil, false
+		}
+		imageNames = append(imageNames, body.Images...)
+	}
+
+	sanitized := make([]string, 0, len(imageNames))
+	for _, name := range imageNames {
+		name, err := sanitizeImageName(name)
+		if err != nil {
+			writeJSONError(w, fmt.Sprintf("invalid image name: %v", err), http.StatusBadRequest)
+			return nil, false
+		}
+		if !checkImagePolicy(w, name) {
+			return nil, false
+		}
+		sanitized = append(sanitized, name)
+	}
+
+	normalized, err := normalizeBundle(sanitized)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return normalized, true
+}
+
+// writeDownloadError logs a failed download and writes the matching error response
+func writeDownloadError(w http.ResponseWriter, imageName string, err error) {
+	log.WithFields(log.Fields{
+		"image": imageName,
+	}).WithError(err).Error("Failed to download image")
+	errorsTotalMetric.Inc()
+	if notFound, match := errors.AsType[*ErrImageNotFound](err); match {
+		writeJSONError(w, notFound.Error(), http.StatusNotFound)
+	} else if insufficient, match := errors.AsType[*ErrInsufficientStorage](err); match {
+		writeJSONError(w, insufficient.Error(), http.StatusInsufficientStorage)
+	} else {
+		writeJSONError(w, fmt.Sprintf("failed to download image: %v", err), http.StatusInternalServerError)
+	}
+}
+
 // platformsHandler handles the /platforms endpoint
 func (s *Server) platformsHandler(w http.ResponseWriter, r *http.Request) {
 	imageName, ok := extractImageName(w, r)
-	if !ok {
+	if !ok || !checkImagePolicy(w, imageName) {
 		return
 	}
 
-	platforms, err := GetImagePlatforms(imageName)
+	platforms, err := GetImagePlatforms(imageName, s.credentials)
 	if err != nil {
 		log.WithField("image", imageName).WithError(err).Error("Failed to get platforms")
 		if notFound, match := errors.AsType[*ErrImageNotFound](err); match {
@@ -206,6 +494,42 @@ func extractImageName(w http.ResponseWriter, r *http.Request) (string, bool) {
 	return imageName, true
 }
 
+// policyErrorResponse is the body of a 403 response for an image denied by policy
+type policyErrorResponse struct {
+	Error  string `json:"error"`
+	Image  string `json:"image"`
+	Action string `json:"action"`
+	Rule   string `json:"rule,omitempty"`
+}
+
+// checkImagePolicy checks a sanitized image name against the image policy,
+// writing a 403 response and returning false if it is denied, or a 500 if
+// the policy could not be checked.
+func checkImagePolicy(w http.ResponseWriter, imageName string) bool {
+	err := CheckImagePolicy(ParseImageReference(imageName))
+	if err == nil {
+		return true
+	}
+	denied, ok := errors.AsType[*ErrPolicyDenied](err)
+	if !ok {
+		log.WithField("image", imageName).WithError(err).Error("Failed to check image policy")
+		errorsTotalMetric.Inc()
+		writeJSONError(w, "internal server error", http.StatusInternalServerError)
+		return false
+	}
+	log.WithFields(log.Fields{
+		"image": imageName,
+		"rule":  denied.Rule,
+	}).Warn("Image denied by policy")
+	writeJSON(w, http.StatusForbidden, policyErrorResponse{
+		Error:  denied.Error(),
+		Image:  denied.Image,
+		Action: denied.Action,
+		Rule:   denied.Rule,
+	})
+	return false
+}
+
 // platformFromRequest parses and validates the os/arch/variant query parameters,
 // writing an error response and returning false if any value is invalid.
 func platformFromRequest(w http.ResponseWriter, r *http.Request) (Platform, bool) {
@@ -229,8 +553,19 @@ func platformFromRequest(w http.ResponseWriter, r *http.Request) (Platform, bool
 	return platform, true
 }
 
+// formatFromRequest parses the format query parameter, writing an error
+// response and returning false if it is invalid.
+func formatFromRequest(w http.ResponseWriter, r *http.Request) (ImageFormat, bool) {
+	format, err := ParseImageFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return format, true
+}
+
 // serveImageFile streams an image tar file to the response with Range request support
-func (s *Server) serveImageFile(w http.ResponseWriter, r *http.Request, imagePath, imageName string, platform Platform) {
+func (s *Server) serveImageFile(w http.ResponseWriter, r *http.Request, imagePath, imageName string, platform fmt.Stringer) {
 	file, err := os.Open(imagePath)
 	if err != nil {
 		log.WithError(err).Error("Failed to open image file")
@@ -259,9 +594,13 @@ func (s *Server) serveImageFile(w http.ResponseWriter, r *http.Request, imagePat
 		return
 	}
 
-	filename := s.cache.GetCacheFilename(imageName, platform)
+	filename := filepath.Base(imagePath)
 
-	w.Header().Set(contentTypeHeader, "application/gzip")
+	contentType := "application/gzip"
+	if strings.HasSuffix(filename, ".tar") {
+		contentType = "application/x-tar"
+	}
+	w.Header().Set(contentTypeHeader, contentType)
 	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
 
 	http.ServeContent(w, r, filename, fileInfo.ModTime(), file)
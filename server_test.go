@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -115,6 +117,57 @@ func TestImageHandler_SSRFProtection(t *testing.T) {
 	}
 }
 
+func TestHandlers_ImagePolicy(t *testing.T) {
+	policy, err := NewImagePolicy([]string{"docker.io/library/*"}, []string{"docker.io/library/abused"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetImagePolicy(policy)
+	defer SetImagePolicy(nil)
+
+	server := NewServer(":8080", "", 1*time.Hour)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		handler    http.HandlerFunc
+		wantAction string
+		wantRule   string
+	}{
+		{name: "image deny rule", method: http.MethodGet, target: "/image?name=abused:latest", handler: server.imageHandler, wantAction: "deny", wantRule: "docker.io/library/abused"},
+		{name: "image not allowed", method: http.MethodGet, target: "/image?name=ghcr.io/evil/app:latest", handler: server.imageHandler, wantAction: "allow"},
+		{name: "multi-platform image", method: http.MethodGet, target: "/image?name=abused&platforms=all&format=oci", handler: server.imageHandler, wantAction: "deny", wantRule: "docker.io/library/abused"},
+		{name: "platforms", method: http.MethodGet, target: "/platforms?name=quay.io/evil/app", handler: server.platformsHandler, wantAction: "allow"},
+		{name: "bundle", method: http.MethodPost, target: "/bundle", body: `{"images": ["alpine:3.19", "abused:1"]}`, handler: server.bundleHandler, wantAction: "deny", wantRule: "docker.io/library/abused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			tt.handler(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected status 403, got %d", resp.StatusCode)
+			}
+			var body map[string]string
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if body["action"] != tt.wantAction || body["rule"] != tt.wantRule {
+				t.Errorf("expected %s rule %q, got %s rule %q", tt.wantAction, tt.wantRule, body["action"], body["rule"])
+			}
+			if body["error"] == "" || body["image"] == "" {
+				t.Errorf("expected error and image in response, got %v", body)
+			}
+		})
+	}
+}
+
 func TestImageHandler_DownloadImage(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test")
@@ -147,6 +200,245 @@ func TestImageHandler_DownloadImage(t *testing.T) {
 	}
 }
 
+func TestImageHandler_RevalidatesCachedTag(t *testing.T) {
+	defer SetRevalidateInterval(defaultRevalidateInterval)
+	SetRevalidateInterval(time.Hour)
+
+	registry := newFakeRegistry()
+	first := registry.addImage(t, DefaultPlatform(), "first")
+	second := registry.addImage(t, DefaultPlatform(), "second")
+	registry.addTag("latest", first)
+	registry.install(t, "registry.example.com")
+
+	cacheDir, err := os.MkdirTemp("", "test-revalidate-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+	server := NewServer(":8080", cacheDir, time.Hour)
+	imageName := "registry.example.com/team/app:latest"
+	cachePath := server.cache.GetCachePath(imageName, DefaultPlatform(), FormatDocker)
+
+	request := func(wantStatus string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.imageHandler(w, httptest.NewRequest(http.MethodGet, "/image?name="+imageName, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get(cacheStatusHeader); got != wantStatus {
+			t.Errorf("expected cache status %q, got %q", wantStatus, got)
+		}
+	}
+	cachedDigest := func() string {
+		t.Helper()
+		metadata, err := readArchiveMetadata(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metadata.Manifests[imageName]
+	}
+
+	request(cacheStatusMiss)
+	if got := cachedDigest(); got != first.Digest {
+		t.Errorf("expected cached digest %s, got %s", first.Digest, got)
+	}
+	request(cacheStatusFresh)
+
+	SetRevalidateInterval(0)
+	request(cacheStatusRevalidated)
+	// A single GET when building, then a single HEAD to revalidate
+	if got := registry.requestCount("latest"); got != 2 {
+		t.Errorf("expected 2 manifest requests, got %d", got)
+	}
+	if entry := server.cache.index.entries[filepath.Base(cachePath)]; entry == nil || entry.Hits != 2 {
+		t.Errorf("expected the cache index to count 2 hits, got %+v", entry)
+	}
+
+	registry.addTag("latest", second)
+	request(cacheStatusUpdated)
+	if got := cachedDigest(); got != second.Digest {
+		t.Errorf("expected cached digest %s after the tag moved, got %s", second.Digest, got)
+	}
+}
+
+func TestImageHandler_FailedRevalidationServesStale(t *testing.T) {
+	defer SetRevalidateInterval(defaultRevalidateInterval)
+	SetRevalidateInterval(10 * time.Minute)
+
+	registry := newFakeRegistry()
+	registry.addTag("latest", registry.addImage(t, DefaultPlatform(), "layer"))
+	registry.install(t, "registry.example.com")
+
+	cacheDir, err := os.MkdirTemp("", "test-revalidate-fail-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+	server := NewServer(":8080", cacheDir, time.Hour)
+	imageName := "registry.example.com/team/app:latest"
+	cachePath := server.cache.GetCachePath(imageName, DefaultPlatform(), FormatDocker)
+
+	request := func(wantStatus string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.imageHandler(w, httptest.NewRequest(http.MethodGet, "/image?name="+imageName, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get(cacheStatusHeader); got != wantStatus {
+			t.Errorf("expected cache status %q, got %q", wantStatus, got)
+		}
+	}
+	request(cacheStatusMiss)
+
+	// The registry now fails every manifest request, with retries configured
+	var manifestRequests atomic.Int32
+	useFastRetries(t, "registry.example.com", 4)
+	settings := GetRegistrySettings("registry.example.com")
+	settings.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/v2/" {
+			return newTestResponse(http.StatusOK, nil), nil
+		}
+		manifestRequests.Add(1)
+		return newTestResponse(http.StatusServiceUnavailable, nil), nil
+	})
+	SetRegistrySettings("registry.example.com", settings)
+
+	metadata, err := readArchiveMetadata(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.ValidatedAt = time.Now().Add(-time.Hour)
+	server.recordValidation(cachePath, metadata)
+
+	request(cacheStatusStale)
+	if got := manifestRequests.Load(); got != 1 {
+		t.Errorf("expected a single revalidation attempt, got %d", got)
+	}
+	// The failure is recorded, so the next request does not wait on the registry
+	request(cacheStatusFresh)
+	if got := manifestRequests.Load(); got != 1 {
+		t.Errorf("expected no revalidation until the retry delay passed, got %d requests", got)
+	}
+}
+
+func TestImageHandler_InsufficientStorage(t *testing.T) {
+	cacheDir, err := os.MkdirTemp("", "test-diskspace-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+	if _, ok := availableSpace(cacheDir); !ok {
+		t.Skip("free space is not available on this platform")
+	}
+
+	// A manifest claiming a layer far larger than any disk
+	registry := newFakeRegistry()
+	manifest := ManifestV2{SchemaVersion: 2, MediaType: ociManifestMediaType}
+	layerDigest := sha256Digest([]byte("huge"))
+	manifest.Layers = append(manifest.Layers, struct {
+		MediaType string `json:"mediaType"`
+		Size      int64  `json:"size"`
+		Digest    string `json:"digest"`
+	}{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Size: 1 << 50, Digest: layerDigest})
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.addManifest("latest", ociManifestMediaType, body)
+	registry.install(t, "registry.example.com")
+
+	server := NewServer(":8080", cacheDir, time.Hour)
+	w := httptest.NewRecorder()
+	server.imageHandler(w, httptest.NewRequest(http.MethodGet, "/image?name=registry.example.com/team/app:latest", nil))
+
+	if w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected status 507, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "insufficient storage") {
+		t.Errorf("expected an insufficient storage message, got %s", w.Body.String())
+	}
+	if got := registry.requestCount(layerDigest); got != 0 {
+		t.Errorf("expected no layer download, got %d requests", got)
+	}
+}
+
+func TestImageHandler_EvictsToMakeRoom(t *testing.T) {
+	cacheDir, err := os.MkdirTemp("", "test-diskspace-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+	if !sameFilesystem(cacheDir, buildTempDir()) {
+		t.Skip("the temporary directory is on another filesystem")
+	}
+
+	registry := newFakeRegistry()
+	registry.addTag("latest", registry.addImage(t, DefaultPlatform(), "layer"))
+	registry.install(t, "registry.example.com")
+
+	// The disk is full until the old archive is evicted
+	old := writeCachedArchive(t, cacheDir, "old.tar.gz", 1<<20, time.Now().Add(-time.Hour))
+	useFakeDisk(t, cacheDir, 1<<20+100)
+
+	server := NewServer(":8080", cacheDir, time.Hour)
+	imageName := "registry.example.com/team/app:latest"
+	w := httptest.NewRecorder()
+	server.imageHandler(w, httptest.NewRequest(http.MethodGet, "/image?name="+imageName, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("expected the old archive to be evicted to make room")
+	}
+	if _, err := os.Stat(server.cache.GetCachePath(imageName, DefaultPlatform(), FormatDocker)); err != nil {
+		t.Errorf("expected the image to be cached: %v", err)
+	}
+}
+
+func TestImageHandler_UsesServerCredentials(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addTag("latest", registry.addImage(t, DefaultPlatform(), "layer"))
+	registry.install(t, "registry.example.com")
+
+	// Token requests are answered only for the credentials given to the server
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("server-user:secret"))
+	fake := registry.transport()
+	settings := GetRegistrySettings("registry.example.com")
+	settings.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		switch {
+		case r.URL.Host == "auth.example.com" && r.Header.Get("Authorization") == want:
+			return newTestResponse(http.StatusOK, []byte(`{"token":"t"}`)), nil
+		case r.URL.Host == "auth.example.com":
+			return newTestResponse(http.StatusUnauthorized, nil), nil
+		case r.Header.Get("Authorization") != "Bearer t":
+			resp := newTestResponse(http.StatusUnauthorized, nil)
+			resp.Header.Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com"`)
+			return resp, nil
+		}
+		return fake.RoundTrip(r)
+	})
+	SetRegistrySettings("registry.example.com", settings)
+
+	cacheDir, err := os.MkdirTemp("", "test-credentials-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTempDir(t, cacheDir)
+	server := NewServer(":8080", cacheDir, time.Hour)
+	store := NewCredentialStore()
+	store.Set("registry.example.com", StaticCredentials{Username: "server-user", Password: "secret"}, false)
+	server.SetCredentialStore(store)
+
+	w := httptest.NewRecorder()
+	server.imageHandler(w, httptest.NewRequest(http.MethodGet, "/image?name=registry.example.com/team/app:latest", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
 func TestServeImageFile_RangeRequest(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "test-range-*")
 	if err != nil {
@@ -458,6 +750,26 @@ func TestImageHandler_InvalidPlatformParams(t *testing.T) {
 			query:   "/image?name=alpine:latest&os=" + strings.Repeat("a", 65),
 			wantErr: "os parameter too long",
 		},
+		{
+			name:    "invalid format param",
+			query:   "/image?name=alpine:latest&format=zip",
+			wantErr: "invalid format parameter",
+		},
+		{
+			name:    "invalid platforms param",
+			query:   "/image?name=alpine:latest&platforms=linux",
+			wantErr: "invalid platforms parameter",
+		},
+		{
+			name:    "platforms combined with arch",
+			query:   "/image?name=alpine:latest&platforms=all&arch=arm64",
+			wantErr: "cannot be combined with arch",
+		},
+		{
+			name:    "platforms with docker format",
+			query:   "/image?name=alpine:latest&platforms=all&format=docker",
+			wantErr: "only available with format=oci",
+		},
 	}
 
 	for _, tt := range tests {
@@ -485,3 +797,71 @@ func TestImageHandler_InvalidPlatformParams(t *testing.T) {
 }
 
 var _ = fmt.Sprintf
+
+func TestBundleHandler_InvalidRequests(t *testing.T) {
+	server := NewServer(":8080", "", 1*time.Hour)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		wantErr string
+	}{
+		{
+			name:    "no images",
+			method:  http.MethodGet,
+			target:  "/bundle",
+			wantErr: "no images requested",
+		},
+		{
+			name:    "invalid image name",
+			method:  http.MethodGet,
+			target:  "/bundle?name=alpine:latest&name=127.0.0.1:5000/evil:latest",
+			wantErr: "invalid image name",
+		},
+		{
+			name:    "malformed JSON body",
+			method:  http.MethodPost,
+			target:  "/bundle",
+			body:    `{"images": "alpine"`,
+			wantErr: "invalid request body",
+		},
+		{
+			name:    "empty JSON list",
+			method:  http.MethodPost,
+			target:  "/bundle",
+			body:    `{"images": []}`,
+			wantErr: "no images requested",
+		},
+		{
+			name:    "invalid platform",
+			method:  http.MethodPost,
+			target:  "/bundle?arch=amd64!",
+			body:    `{"images": ["alpine:latest"]}`,
+			wantErr: "invalid arch parameter",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			server.bundleHandler(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", resp.StatusCode)
+			}
+
+			var body map[string]string
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !strings.Contains(body["error"], tt.wantErr) {
+				t.Errorf("expected error containing %q, got %q", tt.wantErr, body["error"])
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// RegistrySettings holds the per-registry client behaviour resolved from the configuration
+type RegistrySettings struct {
+	Retry RetryConfig
+	// Mirrors are tried in order before the registry itself
+	Mirrors []RegistryMirror
+	// Transport is used for requests to the registry; nil selects the default transport
+	Transport http.RoundTripper
+	// PlainHTTP makes requests to the registry over http instead of https
+	PlainHTTP bool
+	// OAuth2 obtains tokens with the OAuth2 POST flow instead of GET with Basic credentials
+	OAuth2 bool
+}
+
+// registrySettingsStore holds the default settings and per-registry overrides
+type registrySettingsStore struct {
+	defaults   RegistrySettings
+	registries map[string]RegistrySettings
+	mu         sync.RWMutex
+}
+
+var globalRegistrySettings = &registrySettingsStore{
+	defaults:   RegistrySettings{Retry: DefaultRetryConfig()},
+	registries: make(map[string]RegistrySettings),
+}
+
+// SetDefaultRegistrySettings sets the settings used for registries without an override
+func SetDefaultRegistrySettings(settings RegistrySettings) {
+	globalRegistrySettings.mu.Lock()
+	defer globalRegistrySettings.mu.Unlock()
+	globalRegistrySettings.defaults = settings
+}
+
+// SetRegistrySettings sets the settings for a specific registry
+func SetRegistrySettings(registry string, settings RegistrySettings) {
+	globalRegistrySettings.mu.Lock()
+	defer globalRegistrySettings.mu.Unlock()
+	globalRegistrySettings.registries[normalizeRegistry(registry)] = settings
+}
+
+// GetRegistrySettings returns the settings for a registry, falling back to the defaults
+func GetRegistrySettings(registry string) RegistrySettings {
+	globalRegistrySettings.mu.RLock()
+	defer globalRegistrySettings.mu.RUnlock()
+	if settings, ok := globalRegistrySettings.registries[normalizeRegistry(registry)]; ok {
+		return settings
+	}
+	return globalRegistrySettings.defaults
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func cleanupTempDir(t *testing.T, path string) {
@@ -11,3 +19,187 @@ func cleanupTempDir(t *testing.T, path string) {
 		t.Fatalf("failed to remove temp dir: %v", err)
 	}
 }
+
+// roundTripFunc lets tests stand in for a registry without opening sockets
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// newTestResponse builds a minimal HTTP response with the given status and body
+func newTestResponse(statusCode int, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+// useFastRetries installs a quick retry policy for registry for the duration of the test
+func useFastRetries(t *testing.T, registry string, attempts int) {
+	t.Helper()
+	SetRegistrySettings(registry, RegistrySettings{Retry: RetryConfig{
+		MaxAttempts:    attempts,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}})
+	t.Cleanup(func() {
+		globalRegistrySettings.mu.Lock()
+		defer globalRegistrySettings.mu.Unlock()
+		delete(globalRegistrySettings.registries, normalizeRegistry(registry))
+	})
+}
+
+// useFakeDisk makes the filesystem holding dir report capacity bytes minus
+// the size of the files under dir as available for the duration of the test
+func useFakeDisk(t *testing.T, dir string, capacity int64) {
+	t.Helper()
+	availableSpace = func(string) (int64, bool) {
+		var used int64
+		_ = filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() {
+				if info, err := entry.Info(); err == nil {
+					used += info.Size()
+				}
+			}
+			return nil
+		})
+		return capacity - used, true
+	}
+	t.Cleanup(func() { availableSpace = filesystemAvailableSpace })
+}
+
+// fakeRegistry serves manifests and blobs from memory for a RegistryClient
+type fakeRegistry struct {
+	mu        sync.Mutex
+	manifests map[string][]byte // keyed by tag or digest
+	types     map[string]string // content type per manifest key
+	blobs     map[string][]byte
+	requests  map[string]int // requests per manifest key or blob digest
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+		blobs:     make(map[string][]byte),
+		requests:  make(map[string]int),
+	}
+}
+
+// addImage stores a single-platform image with one gzip layer per content
+// string and returns the descriptor of its manifest
+func (f *fakeRegistry) addImage(t *testing.T, platform Platform, layers ...string) ManifestDescriptor {
+	t.Helper()
+	manifest := ManifestV2{SchemaVersion: 2, MediaType: ociManifestMediaType}
+	imageConfig := ImageConfig{OS: platform.OS, Architecture: platform.Architecture}
+	for _, content := range layers {
+		blob, digest, diffID := gzipLayer(t, content)
+		f.blobs[digest] = blob
+		manifest.Layers = append(manifest.Layers, struct {
+			MediaType string `json:"mediaType"`
+			Size      int64  `json:"size"`
+			Digest    string `json:"digest"`
+		}{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Size: int64(len(blob)), Digest: digest})
+		imageConfig.RootFS.DiffIDs = append(imageConfig.RootFS.DiffIDs, diffID)
+	}
+
+	configBlob, err := json.Marshal(imageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config.MediaType = "application/vnd.oci.image.config.v1+json"
+	manifest.Config.Digest = sha256Digest(configBlob)
+	manifest.Config.Size = int64(len(configBlob))
+	f.blobs[manifest.Config.Digest] = configBlob
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := ManifestDescriptor{MediaType: ociManifestMediaType, Size: int64(len(body)), Digest: sha256Digest(body)}
+	descriptor.Platform.OS = platform.OS
+	descriptor.Platform.Architecture = platform.Architecture
+	descriptor.Platform.Variant = platform.Variant
+	f.addManifest(descriptor.Digest, ociManifestMediaType, body)
+	return descriptor
+}
+
+// addIndex stores an image index for tag listing the given manifests
+func (f *fakeRegistry) addIndex(t *testing.T, tag string, manifests ...ManifestDescriptor) []byte {
+	t.Helper()
+	body, err := json.Marshal(ManifestList{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: manifests})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.addManifest(tag, ociIndexMediaType, body)
+	return body
+}
+
+// addTag points tag at an image added with addImage
+func (f *fakeRegistry) addTag(tag string, image ManifestDescriptor) {
+	f.addManifest(tag, f.types[image.Digest], f.manifests[image.Digest])
+}
+
+func (f *fakeRegistry) addManifest(key, contentType string, body []byte) {
+	f.manifests[key] = body
+	f.types[key] = contentType
+}
+
+// requestCount returns how many times a manifest or blob was requested
+func (f *fakeRegistry) requestCount(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[key]
+}
+
+// client returns a RegistryClient whose requests are answered by the fake registry
+func (f *fakeRegistry) client() *RegistryClient {
+	client := NewRegistryClient()
+	client.httpClient.Transport = f.transport()
+	return client
+}
+
+// install answers all requests to registry with the fake for the duration of the test
+func (f *fakeRegistry) install(t *testing.T, registry string) {
+	t.Helper()
+	useFastRetries(t, registry, 1)
+	settings := GetRegistrySettings(registry)
+	settings.Transport = f.transport()
+	SetRegistrySettings(registry, settings)
+}
+
+// transport answers the /v2/ ping anonymously and serves manifests and blobs.
+// Manifest responses carry a Docker-Content-Digest header and HEAD requests get no body.
+func (f *fakeRegistry) transport() http.RoundTripper {
+	return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/v2/" {
+			return newTestResponse(http.StatusOK, nil), nil
+		}
+		key := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.requests[key]++
+
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			body, ok := f.manifests[key]
+			if !ok {
+				return newTestResponse(http.StatusNotFound, nil), nil
+			}
+			digest := sha256Digest(body)
+			if r.Method == http.MethodHead {
+				body = nil
+			}
+			resp := newTestResponse(http.StatusOK, body)
+			resp.Header.Set("Content-Type", f.types[key])
+			resp.Header.Set("Docker-Content-Digest", digest)
+			return resp, nil
+		}
+		blob, ok := f.blobs[key]
+		if !ok {
+			return newTestResponse(http.StatusNotFound, nil), nil
+		}
+		return newTestResponse(http.StatusOK, blob), nil
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// maxCachedTokens bounds the token cache; expired tokens are dropped first,
+// then those closest to expiry
+const maxCachedTokens = 1024
+
+// tokenCacheKey identifies a token by what it grants and to whom
+type tokenCacheKey struct {
+	registry string
+	scope    string
+	// identity is a hash of the credentials the token was requested with
+	identity string
+}
+
+// cachedToken is a token together with how to renew it
+type cachedToken struct {
+	token  bearerToken
+	source tokenSource
+}
+
+// tokenCache shares registry tokens between clients so that repeated requests
+// for the same repository skip the /v2/ ping and the token exchange
+type tokenCache struct {
+	entries map[tokenCacheKey]cachedToken
+	mu      sync.Mutex
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{entries: make(map[tokenCacheKey]cachedToken)}
+}
+
+// globalTokenCache is shared by all clients created for image requests
+var globalTokenCache = newTokenCache()
+
+// credentialIdentity returns a hash identifying creds without keeping them in the key
+func credentialIdentity(creds RegistryCredentials, hasCredentials bool) string {
+	if !hasCredentials {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(creds.Username + "\x00" + creds.Password + "\x00" + creds.IdentityToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns a token that stays valid beyond the refresh margin. The
+// returned source is a copy the caller may modify.
+func (tc *tokenCache) get(key tokenCacheKey) (bearerToken, *tokenSource, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	entry, ok := tc.entries[key]
+	if !ok {
+		return bearerToken{}, nil, false
+	}
+	if time.Until(entry.token.expiresAt) <= tokenRefreshMargin {
+		delete(tc.entries, key)
+		return bearerToken{}, nil, false
+	}
+	source := entry.source
+	return entry.token, &source, true
+}
+
+// put stores a token, copying source so later changes by the client don't leak in
+func (tc *tokenCache) put(key tokenCacheKey, token bearerToken, source *tokenSource) {
+	if token.value == "" {
+		return
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if _, exists := tc.entries[key]; !exists && len(tc.entries) >= maxCachedTokens {
+		tc.evict()
+	}
+	tc.entries[key] = cachedToken{token: token, source: *source}
+}
+
+// evict drops expired tokens, or the one closest to expiry if none are. Must
+// be called with tc.mu held.
+func (tc *tokenCache) evict() {
+	now := time.Now()
+	var soonest tokenCacheKey
+	var soonestExpiry time.Time
+	for key, entry := range tc.entries {
+		if entry.token.expiresAt.Before(now) {
+			delete(tc.entries, key)
+			continue
+		}
+		if soonestExpiry.IsZero() || entry.token.expiresAt.Before(soonestExpiry) {
+			soonest, soonestExpiry = key, entry.token.expiresAt
+		}
+	}
+	if len(tc.entries) >= maxCachedTokens {
+		delete(tc.entries, soonest)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCachingClient returns a client for the fake registry that shares cache and
+// counts /v2/ pings
+func newCachingClient(registry *fakeTokenRegistry, cache *tokenCache, store *CredentialStore, pings *atomic.Int32) *RegistryClient {
+	client := NewRegistryClient()
+	client.tokens = cache
+	client.credentials = store
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/v2/" {
+			pings.Add(1)
+		}
+		return registry.roundTrip(r)
+	})
+	return client
+}
+
+func TestTokenCache_ReusesTokenAcrossClients(t *testing.T) {
+	registry := &fakeTokenRegistry{expiresIn: 300}
+	cache := newTokenCache()
+	store := NewCredentialStore()
+	var pings atomic.Int32
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+
+	first := newCachingClient(registry, cache, store, &pings)
+	if err := first.Authenticate(ref); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	second := newCachingClient(registry, cache, store, &pings)
+	if err := second.Authenticate(ref); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	if registry.tokensIssued() != 1 || pings.Load() != 1 {
+		t.Errorf("expected one ping and one token, got %d pings and %d tokens", pings.Load(), registry.tokensIssued())
+	}
+	if second.token != first.token {
+		t.Errorf("expected the cached token to be reused, got %q and %q", first.token, second.token)
+	}
+
+	// Another repository needs another scope and therefore another token
+	other := newCachingClient(registry, cache, store, &pings)
+	if err := other.Authenticate(ImageReference{Registry: "registry.example.com", Repository: "team/other", Tag: "latest"}); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if registry.tokensIssued() != 2 {
+		t.Errorf("expected a new token for another scope, got %d tokens", registry.tokensIssued())
+	}
+}
+
+func TestTokenCache_SeparatesCredentialIdentities(t *testing.T) {
+	registry := &fakeTokenRegistry{expiresIn: 300}
+	cache := newTokenCache()
+	var pings atomic.Int32
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+
+	for _, password := range []string{"first", "second", "first"} {
+		store := NewCredentialStore()
+		store.Set("registry.example.com", StaticCredentials{Username: "user", Password: password}, false)
+		if err := newCachingClient(registry, cache, store, &pings).Authenticate(ref); err != nil {
+			t.Fatalf("Authenticate failed: %v", err)
+		}
+	}
+	if registry.tokensIssued() != 2 {
+		t.Errorf("expected one token per credential identity, got %d", registry.tokensIssued())
+	}
+}
+
+func TestTokenCache_SkipsExpiringTokens(t *testing.T) {
+	// Tokens that expire within the refresh margin are not handed out again
+	registry := &fakeTokenRegistry{expiresIn: 1}
+	cache := newTokenCache()
+	store := NewCredentialStore()
+	var pings atomic.Int32
+	ref := ImageReference{Registry: "registry.example.com", Repository: "team/app", Tag: "latest"}
+
+	for range 2 {
+		if err := newCachingClient(registry, cache, store, &pings).Authenticate(ref); err != nil {
+			t.Fatalf("Authenticate failed: %v", err)
+		}
+	}
+	if registry.tokensIssued() != 2 {
+		t.Errorf("expected expiring token to be replaced, got %d tokens", registry.tokensIssued())
+	}
+}
+
+func TestTokenCache_ConcurrentClients(t *testing.T) {
+	registry := &fakeTokenRegistry{expiresIn: 300}
+	cache := newTokenCache()
+	store := NewCredentialStore()
+	var pings atomic.Int32
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ref := ImageReference{Registry: "registry.example.com", Repository: fmt.Sprintf("team/app%d", i%4), Tag: "latest"}
+			if err := newCachingClient(registry, cache, store, &pings).Authenticate(ref); err != nil {
+				t.Errorf("Authenticate failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if issued := registry.tokensIssued(); issued < 4 || issued > 20 {
+		t.Errorf("unexpected number of tokens issued: %d", issued)
+	}
+}
+
+func TestTokenCache_Eviction(t *testing.T) {
+	cache := newTokenCache()
+	source := &tokenSource{}
+	for i := range maxCachedTokens {
+		key := tokenCacheKey{registry: "registry.example.com", scope: fmt.Sprintf("repository:app%d:pull", i)}
+		cache.put(key, bearerToken{value: "t", expiresAt: time.Now().Add(time.Hour + time.Duration(i)*time.Second)}, source)
+	}
+
+	extra := tokenCacheKey{registry: "registry.example.com", scope: "repository:extra:pull"}
+	cache.put(extra, bearerToken{value: "t", expiresAt: time.Now().Add(2 * time.Hour)}, source)
+
+	if len(cache.entries) != maxCachedTokens {
+		t.Errorf("expected cache to stay at %d entries, got %d", maxCachedTokens, len(cache.entries))
+	}
+	if _, _, ok := cache.get(tokenCacheKey{registry: "registry.example.com", scope: "repository:app0:pull"}); ok {
+		t.Error("expected the token closest to expiry to be evicted")
+	}
+	if _, _, ok := cache.get(extra); !ok {
+		t.Error("expected the new token to be cached")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// maxRedirects caps how many redirects a registry request may follow.
+// Blob downloads usually need one hop to a CDN.
+const maxRedirects = 5
+
+// ErrBlockedAddress is returned when a connection or redirect targets a
+// private, loopback or otherwise disallowed address (SSRF protection).
+type ErrBlockedAddress struct {
+	Address string
+	Reason  string
+}
+
+func (e *ErrBlockedAddress) Error() string {
+	return fmt.Sprintf("address not allowed: %s (%s)", e.Address, e.Reason)
+}
+
+// TransportOptions customize how a registry is reached
+type TransportOptions struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string
+	// InsecureSkipVerify disables TLS certificate verification
+	InsecureSkipVerify bool
+	// Proxy is an http, https, socks5 or socks5h proxy URL
+	Proxy string
+}
+
+// newHTTPClient creates the HTTP client used for registry requests
+func newHTTPClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Timeout:       300 * time.Second,
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// newRegistryTransport builds a transport from a registry's options on top of
+// the SSRF-safe defaults
+func newRegistryTransport(opts TransportOptions) (*http.Transport, error) {
+	transport := newSafeTransport()
+
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig.InsecureSkipVerify = opts.InsecureSkipVerify
+
+	if opts.Proxy != "" {
+		proxyURL, err := parseProxyURL(opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			// The dial check below only sees the proxy, so every target,
+			// redirected or not, is resolved here before being handed to it
+			if err := checkProxiedHost(req); err != nil {
+				return nil, err
+			}
+			return proxyURL, nil
+		}
+
+		// The proxy typically lives on an internal network, so dialing it is
+		// exempt from the private address check. Targets are checked by
+		// checkProxiedHost instead, except names only the proxy can resolve.
+		proxyAddr := proxyAddress(proxyURL)
+		proxyDialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		safeDial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address == proxyAddr {
+				return proxyDialer.DialContext(ctx, network, address)
+			}
+			return safeDial(ctx, network, address)
+		}
+	}
+
+	return transport, nil
+}
+
+// loadCertPool returns the system roots plus the certificates in caFile
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca_file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in ca_file %s", caFile)
+	}
+	return pool, nil
+}
+
+// parseProxyURL parses and checks a proxy URL
+func parseProxyURL(value string) (*url.URL, error) {
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (must be http, https, socks5 or socks5h)", proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("proxy URL has no host: %s", value)
+	}
+	return proxyURL, nil
+}
+
+// proxyAddress returns the host:port the transport dials to reach the proxy
+func proxyAddress(proxyURL *url.URL) string {
+	if port := proxyURL.Port(); port != "" {
+		return net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	defaultPorts := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}
+	return net.JoinHostPort(proxyURL.Hostname(), defaultPorts[proxyURL.Scheme])
+}
+
+// newSafeTransport creates an HTTP transport that refuses to connect to private
+// addresses, unless the host or its network is trusted
+func newSafeTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkDialAddress,
+	}
+	trustedDialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// The dial check only sees resolved IPs, so trusted hostnames are exempted here
+			if host, _, err := net.SplitHostPort(address); err == nil && getTrustedRegistries().trustsHost(host) {
+				return trustedDialer.DialContext(ctx, network, address)
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// checkDialAddress runs after DNS resolution, right before connecting, so it
+// sees the IP actually being dialed. Checking here rather than on the hostname
+// closes DNS rebinding and names that resolve to internal addresses.
+func checkDialAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return &ErrBlockedAddress{Address: address, Reason: "unparseable address"}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &ErrBlockedAddress{Address: address, Reason: "not an IP address"}
+	}
+	if isPrivateIP(ip) && !getTrustedRegistries().trustsIP(ip) {
+		return &ErrBlockedAddress{Address: address, Reason: "resolves to a private or reserved IP"}
+	}
+	return nil
+}
+
+// checkRedirect validates every redirect hop a registry response asks us to follow
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if req.URL.Scheme != "https" && req.URL.Scheme != "http" {
+		return &ErrBlockedAddress{Address: req.URL.String(), Reason: "unsupported redirect scheme"}
+	}
+	if len(via) > 0 && via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return &ErrBlockedAddress{Address: req.URL.Host, Reason: "redirect downgrades https to http"}
+	}
+	if err := validateRegistry(req.URL.Host); err != nil {
+		return &ErrBlockedAddress{Address: req.URL.Host, Reason: err.Error()}
+	}
+	return nil
+}
+
+// lookupIPAddr resolves hostnames for checkProxiedHost
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// checkProxiedHost refuses a request sent through a proxy when its host
+// resolves to a private or reserved address. Names that can't be resolved
+// locally are left to the proxy, having passed the registry and redirect
+// name checks.
+func checkProxiedHost(req *http.Request) error {
+	host := req.URL.Hostname()
+	trusted := getTrustedRegistries()
+	if trusted.trustsHost(host) {
+		return nil
+	}
+	addrs, err := lookupIPAddr(req.Context(), host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if isPrivateIP(addr.IP) && !trusted.trustsIP(addr.IP) {
+			return &ErrBlockedAddress{Address: req.URL.Host, Reason: "resolves to a private or reserved IP"}
+		}
+	}
+	return nil
+}
+
+// isBlockedAddressError reports whether err was caused by the SSRF guards
+func isBlockedAddressError(err error) bool {
+	_, blocked := errors.AsType[*ErrBlockedAddress](err)
+	return blocked
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// TrustedRegistries are private hosts and networks the operator explicitly
+// allows, exempting them from the SSRF checks. A nil value trusts nothing.
+type TrustedRegistries struct {
+	hosts    map[string]bool
+	networks []*net.IPNet
+}
+
+// ParseTrustedRegistries parses hostnames, IP addresses and CIDR ranges.
+// Trust applies to a host on every port, so entries must not include one.
+func ParseTrustedRegistries(entries []string) (*TrustedRegistries, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	trusted := &TrustedRegistries{hosts: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			trusted.networks = append(trusted.networks, network)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			trusted.networks = append(trusted.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if strings.Contains(entry, ":") {
+			return nil, fmt.Errorf("invalid trusted registry %q: list the host without a port", entry)
+		}
+		if !registryPattern.MatchString(entry) {
+			return nil, fmt.Errorf("invalid trusted registry %q: must be a hostname, IP address or CIDR", entry)
+		}
+		trusted.hosts[entry] = true
+	}
+	return trusted, nil
+}
+
+// trustsHost reports whether a hostname or IP literal was explicitly trusted
+func (t *TrustedRegistries) trustsHost(host string) bool {
+	if t == nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	if t.hosts[host] {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return t.trustsIP(ip)
+	}
+	return false
+}
+
+// trustsIP reports whether ip lies in a trusted network. Any hostname that
+// resolves into a trusted network is allowed to connect.
+func (t *TrustedRegistries) trustsIP(ip net.IP) bool {
+	if t == nil {
+		return false
+	}
+	for _, network := range t.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedRegistriesStore holds the trusted registries applied from the configuration
+type trustedRegistriesStore struct {
+	trusted *TrustedRegistries
+	mu      sync.RWMutex
+}
+
+var globalTrustedRegistries = &trustedRegistriesStore{}
+
+// SetTrustedRegistries sets the private registries exempt from the SSRF checks
+func SetTrustedRegistries(trusted *TrustedRegistries) {
+	globalTrustedRegistries.mu.Lock()
+	defer globalTrustedRegistries.mu.Unlock()
+	globalTrustedRegistries.trusted = trusted
+}
+
+// getTrustedRegistries returns the trusted registries currently in effect
+func getTrustedRegistries() *TrustedRegistries {
+	globalTrustedRegistries.mu.RLock()
+	defer globalTrustedRegistries.mu.RUnlock()
+	return globalTrustedRegistries.trusted
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// useTrustedRegistries trusts entries for the duration of the test
+func useTrustedRegistries(t *testing.T, entries ...string) {
+	t.Helper()
+	trusted, err := ParseTrustedRegistries(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTrustedRegistries(trusted)
+	t.Cleanup(func() { SetTrustedRegistries(nil) })
+}
+
+func TestParseTrustedRegistries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		wantErr bool
+	}{
+		{name: "empty", entries: nil, wantErr: false},
+		{name: "hostname", entries: []string{"registry.internal"}, wantErr: false},
+		{name: "localhost", entries: []string{"localhost"}, wantErr: false},
+		{name: "ipv4 address", entries: []string{"10.0.0.5"}, wantErr: false},
+		{name: "ipv6 address", entries: []string{"fd00::5"}, wantErr: false},
+		{name: "cidr", entries: []string{"10.0.0.0/8", "fd00::/8"}, wantErr: false},
+		{name: "host with port", entries: []string{"10.0.0.5:5000"}, wantErr: true},
+		{name: "invalid cidr", entries: []string{"10.0.0.0/40"}, wantErr: true},
+		{name: "url", entries: []string{"https://registry.internal"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTrustedRegistries(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseTrustedRegistries(%v) error = %v, wantErr %v", tt.entries, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrustedRegistries_TrustsHost(t *testing.T) {
+	trusted, err := ParseTrustedRegistries([]string{"Registry.Internal", "10.0.0.5", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "registry.internal", want: true},
+		{host: "REGISTRY.INTERNAL", want: true},
+		{host: "other.internal", want: false},
+		{host: "10.0.0.5", want: true},
+		{host: "10.0.0.6", want: false},
+		{host: "192.168.1.20", want: true},
+		{host: "localhost", want: false},
+		{host: "169.254.169.254", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := trusted.trustsHost(tt.host); got != tt.want {
+				t.Errorf("trustsHost(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+
+	var none *TrustedRegistries
+	if none.trustsHost("10.0.0.5") || none.trustsIP(net.ParseIP("10.0.0.5")) {
+		t.Error("expected nil trusted registries to trust nothing")
+	}
+}
+
+func TestTrustedRegistries_BypassChecks(t *testing.T) {
+	useTrustedRegistries(t, "10.0.0.5", "localhost")
+
+	if err := validateRegistry("10.0.0.5:5000"); err != nil {
+		t.Errorf("expected trusted registry to be valid, got %v", err)
+	}
+	if err := validateRegistry("localhost:5000"); err != nil {
+		t.Errorf("expected trusted localhost to be valid, got %v", err)
+	}
+	if err := validateRegistry("10.0.0.6:5000"); err == nil {
+		t.Error("expected untrusted private registry to stay blocked")
+	}
+	if err := validateAuthRealm("http://10.0.0.5:5001/token"); err != nil {
+		t.Errorf("expected trusted auth realm to be valid, got %v", err)
+	}
+	if err := validateAuthRealm("http://10.0.0.6/token"); err == nil {
+		t.Error("expected untrusted auth realm to stay blocked")
+	}
+
+	origin := &http.Request{URL: &url.URL{Scheme: "http", Host: "10.0.0.5:5000"}}
+	if err := checkRedirect(&http.Request{URL: &url.URL{Scheme: "http", Host: "10.0.0.5:5000", Path: "/blob"}}, []*http.Request{origin}); err != nil {
+		t.Errorf("expected redirect to trusted registry to be allowed, got %v", err)
+	}
+	if err := checkRedirect(&http.Request{URL: &url.URL{Scheme: "http", Host: "169.254.169.254"}}, []*http.Request{origin}); err == nil {
+		t.Error("expected redirect to metadata endpoint to stay blocked")
+	}
+}
+
+func TestSafeTransport_ConnectsToTrustedRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewRegistryClient()
+	if _, err := client.httpClient.Get(server.URL); err == nil {
+		t.Fatal("expected loopback server to be blocked before it is trusted")
+	}
+
+	useTrustedRegistries(t, "127.0.0.0/8")
+	resp, err := client.httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected trusted loopback server to be reachable, got %v", err)
+	}
+	closeWithLog(resp.Body, "response body")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ttlRule sets cache lifetimes for the images whose repository and tag it matches
+type ttlRule struct {
+	repository *regexp.Regexp
+	tag        *regexp.Regexp
+	// maxAge and revalidateInterval are zero when the defaults apply
+	maxAge             time.Duration
+	revalidateInterval time.Duration
+}
+
+// CacheTTLPolicy holds ordered cache lifetime rules. The first rule matching
+// an image applies; images matching no rule use the defaults. A nil policy
+// has no rules.
+type CacheTTLPolicy struct {
+	rules []ttlRule
+}
+
+// NewCacheTTLPolicy compiles the configured TTL rules
+func NewCacheTTLPolicy(rules []CacheTTLRule) (*CacheTTLPolicy, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	policy := &CacheTTLPolicy{rules: make([]ttlRule, 0, len(rules))}
+	for i, rule := range rules {
+		compiled, err := rule.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		policy.rules = append(policy.rules, compiled)
+	}
+	return policy, nil
+}
+
+// compile checks a configured rule and turns it into a ttlRule
+func (r CacheTTLRule) compile() (ttlRule, error) {
+	if r.MaxAge < 0 || r.RevalidateInterval < 0 {
+		return ttlRule{}, fmt.Errorf("durations cannot be negative")
+	}
+	if r.MaxAge == 0 && r.RevalidateInterval == 0 {
+		return ttlRule{}, fmt.Errorf("set max_age, revalidate_interval or both")
+	}
+
+	repository := r.Repository
+	if repository == "" {
+		repository = "*"
+	}
+	repositoryRe, err := compileRepositoryGlob(repository)
+	if err != nil {
+		return ttlRule{}, fmt.Errorf("invalid repository: %w", err)
+	}
+
+	tag := r.Tag
+	if tag == "" {
+		tag = ".*"
+	}
+	// The expression has to match the whole tag, so "1\.25" does not match "1.25.3"
+	tagRe, err := regexp.Compile("^(?:" + tag + ")$")
+	if err != nil {
+		return ttlRule{}, fmt.Errorf("invalid tag expression %q: %w", r.Tag, err)
+	}
+
+	return ttlRule{
+		repository:         repositoryRe,
+		tag:                tagRe,
+		maxAge:             r.MaxAge,
+		revalidateInterval: r.RevalidateInterval,
+	}, nil
+}
+
+// match returns the first rule matching ref. Digest-pinned images are matched
+// by their digest instead of their tag.
+func (p *CacheTTLPolicy) match(ref ImageReference) (ttlRule, bool) {
+	if p == nil {
+		return ttlRule{}, false
+	}
+	subject := repositorySubject(ref)
+	for _, rule := range p.rules {
+		if rule.repository.MatchString(subject) && rule.tag.MatchString(ref.Reference()) {
+			return rule, true
+		}
+	}
+	return ttlRule{}, false
+}
+
+// maxAge returns how long cached archives of ref are kept after they were last served
+func (p *CacheTTLPolicy) maxAge(ref ImageReference, fallback time.Duration) time.Duration {
+	if rule, ok := p.match(ref); ok && rule.maxAge > 0 {
+		return rule.maxAge
+	}
+	return fallback
+}
+
+// revalidateInterval returns how long a cached archive of ref is served before its tag is checked again
+func (p *CacheTTLPolicy) revalidateInterval(ref ImageReference, fallback time.Duration) time.Duration {
+	if rule, ok := p.match(ref); ok && rule.revalidateInterval > 0 {
+		return rule.revalidateInterval
+	}
+	return fallback
+}
+
+// cacheTTLStore holds the TTL policy applied from the configuration
+type cacheTTLStore struct {
+	policy *CacheTTLPolicy
+	mu     sync.RWMutex
+}
+
+var globalCacheTTLPolicy = &cacheTTLStore{}
+
+// SetCacheTTLPolicy sets the rules cache cleanup and revalidation follow
+func SetCacheTTLPolicy(policy *CacheTTLPolicy) {
+	globalCacheTTLPolicy.mu.Lock()
+	defer globalCacheTTLPolicy.mu.Unlock()
+	globalCacheTTLPolicy.policy = policy
+}
+
+func getCacheTTLPolicy() *CacheTTLPolicy {
+	globalCacheTTLPolicy.mu.RLock()
+	defer globalCacheTTLPolicy.mu.RUnlock()
+	return globalCacheTTLPolicy.policy
+}
+
+// cacheMaxAge returns the maximum age of cached archives of ref
+func cacheMaxAge(ref ImageReference, fallback time.Duration) time.Duration {
+	return getCacheTTLPolicy().maxAge(ref, fallback)
+}
+
+// cacheRevalidateInterval returns the revalidation interval of cached archives of ref
+func cacheRevalidateInterval(ref ImageReference) time.Duration {
+	return getCacheTTLPolicy().revalidateInterval(ref, currentRevalidateInterval())
+}
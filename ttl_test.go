@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheTTLPolicy_Match(t *testing.T) {
+	policy, err := NewCacheTTLPolicy([]CacheTTLRule{
+		{Repository: "docker.io/library/*", Tag: "latest|edge|nightly", MaxAge: 6 * time.Hour, RevalidateInterval: time.Minute},
+		{Tag: `v?\d+\.\d+\.\d+`, MaxAge: 90 * 24 * time.Hour},
+		{Tag: `sha256:.*`, MaxAge: 180 * 24 * time.Hour},
+		{Repository: "ghcr.io/our-org/*", RevalidateInterval: 30 * time.Second},
+	})
+	if err != nil {
+		t.Fatalf("NewCacheTTLPolicy() error: %v", err)
+	}
+
+	defaultAge := 48 * time.Hour
+	defaultInterval := 5 * time.Minute
+	tests := []struct {
+		image        string
+		wantAge      time.Duration
+		wantInterval time.Duration
+	}{
+		{"alpine", 6 * time.Hour, time.Minute},
+		{"index.docker.io/library/nginx:edge", 6 * time.Hour, time.Minute},
+		{"alpine:3.20", defaultAge, defaultInterval},
+		{"golang:1.25.3", 90 * 24 * time.Hour, defaultInterval},
+		{"ghcr.io/other/app:v2.0.1", 90 * 24 * time.Hour, defaultInterval},
+		{"ghcr.io/other/app:v2.0.1-rc1", defaultAge, defaultInterval},
+		{"alpine@sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", 180 * 24 * time.Hour, defaultInterval},
+		{"ghcr.io/our-org/app:main", defaultAge, 30 * time.Second},
+		{"GHCR.IO/our-org/app:main", defaultAge, 30 * time.Second},
+		{"ghcr.io:443/our-org/app:main", defaultAge, 30 * time.Second},
+		{"DOCKER.IO/alpine", 6 * time.Hour, time.Minute},
+		{"someuser/app:latest", defaultAge, defaultInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref := ParseImageReference(tt.image)
+			if got := policy.maxAge(ref, defaultAge); got != tt.wantAge {
+				t.Errorf("maxAge() = %s, want %s", got, tt.wantAge)
+			}
+			if got := policy.revalidateInterval(ref, defaultInterval); got != tt.wantInterval {
+				t.Errorf("revalidateInterval() = %s, want %s", got, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestCacheTTLPolicy_FirstMatchWins(t *testing.T) {
+	policy, err := NewCacheTTLPolicy([]CacheTTLRule{
+		{Repository: "docker.io/library/alpine", RevalidateInterval: time.Minute},
+		{Tag: "latest", MaxAge: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("NewCacheTTLPolicy() error: %v", err)
+	}
+
+	// The first rule matches and leaves max_age at the default, even though
+	// the second rule would set it
+	if got := policy.maxAge(ParseImageReference("alpine:latest"), 48*time.Hour); got != 48*time.Hour {
+		t.Errorf("maxAge() = %s, want the default", got)
+	}
+}
+
+func TestNewCacheTTLPolicy_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule CacheTTLRule
+	}{
+		{"no durations", CacheTTLRule{Tag: "latest"}},
+		{"negative max age", CacheTTLRule{MaxAge: -time.Hour}},
+		{"negative revalidate interval", CacheTTLRule{RevalidateInterval: -time.Minute}},
+		{"invalid repository glob", CacheTTLRule{Repository: "Docker.io/[library]", MaxAge: time.Hour}},
+		{"invalid tag expression", CacheTTLRule{Tag: "v(1", MaxAge: time.Hour}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCacheTTLPolicy([]CacheTTLRule{tt.rule}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestNewCacheTTLPolicy_Empty(t *testing.T) {
+	policy, err := NewCacheTTLPolicy(nil)
+	if err != nil || policy != nil {
+		t.Fatalf("NewCacheTTLPolicy(nil) = %v, %v; want nil, nil", policy, err)
+	}
+	if got := policy.maxAge(ParseImageReference("alpine"), time.Hour); got != time.Hour {
+		t.Errorf("nil policy maxAge() = %s, want the default", got)
+	}
+}
@@ -9,15 +9,22 @@ import (
 )
 
 var (
-	registryPattern   = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$`)
-	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
-	tagPattern        = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
-	digestPattern     = regexp.MustCompile(`^[a-z0-9]+:[a-f0-9]+$`)
-	imageNamePattern  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._\-/:]*$`)
-	platformPattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	registryPattern     = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$`)
+	repositoryPattern   = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+	tagPattern          = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	digestPattern       = regexp.MustCompile(`^[a-z0-9]+:[a-f0-9]+$`)
+	pinnedDigestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	imageNamePattern    = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._\-/:@]*$`)
+	platformPattern     = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
 )
 
 func validateRegistry(registry string) error {
+	return validateRegistryTrusting(registry, getTrustedRegistries())
+}
+
+// validateRegistryTrusting validates registry, exempting hosts in trusted from
+// the private address checks
+func validateRegistryTrusting(registry string, trusted *TrustedRegistries) error {
 	if registry == "" {
 		return fmt.Errorf("registry cannot be empty")
 	}
@@ -28,7 +35,7 @@ func validateRegistry(registry string) error {
 		return fmt.Errorf("invalid registry hostname: %s", registry)
 	}
 	host := strings.Split(strings.ToLower(registry), ":")[0]
-	if isBlockedHost(host) {
+	if isBlockedHost(host) && !trusted.trustsHost(host) {
 		return fmt.Errorf("registry hostname not allowed: %s", registry)
 	}
 	return nil
@@ -51,9 +58,39 @@ func isBlockedHost(host string) bool {
 	return hasIPObfuscation(strings.Split(host, "."))
 }
 
-// isPrivateIP returns true if the IP is loopback, link-local, or private.
+// reservedNetworks are special-purpose ranges not covered by the net.IP helpers
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved
+	"64:ff9b::/96",  // NAT64, can embed private IPv4 addresses
+)
+
+// isPrivateIP returns true if the IP is loopback, link-local, private, or otherwise reserved.
 func isPrivateIP(ip net.IP) bool {
-	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
 }
 
 // hasIPObfuscation returns true if any part of the IP uses hex or zero-padded notation.
@@ -138,12 +175,32 @@ func ValidateImageReference(ref ImageReference) error {
 	if err := validateRepository(ref.Repository); err != nil {
 		return err
 	}
+	if ref.Digest != "" {
+		if err := validatePinnedDigest(ref.Digest); err != nil {
+			return err
+		}
+		if ref.Tag == "" {
+			return nil
+		}
+	}
 	if err := validateTag(ref.Tag); err != nil {
 		return err
 	}
 	return nil
 }
 
+// validatePinnedDigest checks a user-supplied image digest. Only sha256 is
+// accepted since that is what the downloaded content is verified against.
+func validatePinnedDigest(digest string) error {
+	if err := validateDigest(digest); err != nil {
+		return err
+	}
+	if !pinnedDigestPattern.MatchString(digest) {
+		return fmt.Errorf("unsupported image digest (expected sha256:<64 hex chars>): %s", digest)
+	}
+	return nil
+}
+
 func buildRegistryURL(registry, pathFormat string, args ...interface{}) (string, error) {
 	if err := validateRegistry(registry); err != nil {
 		return "", err
@@ -157,7 +214,11 @@ func buildRegistryURL(registry, pathFormat string, args ...interface{}) (string,
 		}
 	}
 	path := fmt.Sprintf(pathFormat, escapedArgs...)
-	return fmt.Sprintf("https://%s%s", registry, path), nil
+	scheme := "https"
+	if GetRegistrySettings(registry).PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, registry, path), nil
 }
 
 func sanitizeImageName(imageName string) (string, error) {
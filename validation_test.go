@@ -346,6 +346,36 @@ func TestValidateImageReference(t *testing.T) {
 			errMsg:  "invalid repository name",
 		},
 
+		// Digest-pinned references
+		{
+			name:    "valid digest only",
+			ref:     ImageReference{Registry: "registry-1.docker.io", Repository: "library/nginx", Digest: "sha256:" + strings.Repeat("a", 64)},
+			wantErr: false,
+		},
+		{
+			name:    "valid tag and digest",
+			ref:     ImageReference{Registry: "registry-1.docker.io", Repository: "library/nginx", Tag: "1.25", Digest: "sha256:" + strings.Repeat("a", 64)},
+			wantErr: false,
+		},
+		{
+			name:    "invalid short digest",
+			ref:     ImageReference{Registry: "registry-1.docker.io", Repository: "library/nginx", Digest: "sha256:abc"},
+			wantErr: true,
+			errMsg:  "unsupported image digest",
+		},
+		{
+			name:    "invalid digest algorithm",
+			ref:     ImageReference{Registry: "registry-1.docker.io", Repository: "library/nginx", Digest: "md5:" + strings.Repeat("a", 32)},
+			wantErr: true,
+			errMsg:  "unsupported image digest",
+		},
+		{
+			name:    "invalid digest format",
+			ref:     ImageReference{Registry: "registry-1.docker.io", Repository: "library/nginx", Digest: "sha256:XYZ"},
+			wantErr: true,
+			errMsg:  "invalid digest format",
+		},
+
 		// Invalid tag
 		{
 			name:    "invalid empty tag",
@@ -517,6 +547,31 @@ func TestBuildRegistryURL(t *testing.T) {
 }
 
 // Test SSRF bypass attempts
+func TestBuildRegistryURL_PlainHTTP(t *testing.T) {
+	SetRegistrySettings("registry.internal.example.com", RegistrySettings{PlainHTTP: true})
+	defer func() {
+		globalRegistrySettings.mu.Lock()
+		defer globalRegistrySettings.mu.Unlock()
+		delete(globalRegistrySettings.registries, "registry.internal.example.com")
+	}()
+
+	gotURL, err := buildRegistryURL("registry.internal.example.com", "/v2/%s/manifests/%s", "app", "latest")
+	if err != nil {
+		t.Fatalf("buildRegistryURL() unexpected error: %v", err)
+	}
+	if gotURL != "http://registry.internal.example.com/v2/app/manifests/latest" {
+		t.Errorf("buildRegistryURL() = %q, want plain http URL", gotURL)
+	}
+
+	gotURL, err = buildRegistryURL("registry.example.com", "/v2/")
+	if err != nil {
+		t.Fatalf("buildRegistryURL() unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(gotURL, "https://") {
+		t.Errorf("buildRegistryURL() = %q, want https for registries without plain_http", gotURL)
+	}
+}
+
 func TestValidateRegistry_SSRFBypassAttempts(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -620,6 +675,8 @@ func TestSanitizeImageName(t *testing.T) {
 		{name: "image with namespace", imageName: "library/nginx:1.0", want: "library/nginx:1.0", wantErr: false},
 		{name: "full reference", imageName: "gcr.io/myproject/myimage:v1", want: "gcr.io/myproject/myimage:v1", wantErr: false},
 		{name: "with whitespace", imageName: "  nginx:latest  ", want: "nginx:latest", wantErr: false},
+		{name: "digest pinned", imageName: "nginx@sha256:" + strings.Repeat("a", 64), want: "nginx@sha256:" + strings.Repeat("a", 64), wantErr: false},
+		{name: "tag and digest", imageName: "nginx:1.25@sha256:" + strings.Repeat("a", 64), want: "nginx:1.25@sha256:" + strings.Repeat("a", 64), wantErr: false},
 
 		// Invalid - empty
 		{name: "empty string", imageName: "", wantErr: true, errMsg: "image name cannot be empty"},
@@ -634,6 +691,7 @@ func TestSanitizeImageName(t *testing.T) {
 
 		// Invalid - bad characters
 		{name: "special chars", imageName: "nginx<script>", wantErr: true, errMsg: "image name contains invalid characters"},
+		{name: "truncated digest", imageName: "nginx@sha256:abc", wantErr: true, errMsg: "unsupported image digest"},
 		{name: "starts with dot", imageName: ".nginx", wantErr: true, errMsg: "image name contains invalid characters"},
 
 		// SSRF protection